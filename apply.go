@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/rancher/system-agent/pkg/applyinator"
+	"github.com/rancher/system-agent/pkg/prober"
+)
+
+const probeInterval = 5 * time.Second
+
+// applyReport is the result of applying a plan file once with the apply command.
+type applyReport struct {
+	Checksum             string                         `json:"checksum"`
+	Succeeded            bool                           `json:"succeeded"`
+	Error                string                         `json:"error,omitempty"`
+	SnapshotID           string                         `json:"snapshotID,omitempty"`
+	FilesRolledBack      bool                           `json:"filesRolledBack,omitempty"`
+	OneTimeInstructions  []instructionReport            `json:"oneTimeInstructions,omitempty"`
+	PeriodicInstructions []instructionReport            `json:"periodicInstructions,omitempty"`
+	Probes               map[string]planapi.ProbeStatus `json:"probes,omitempty"`
+}
+
+// instructionReport is the result of a single instruction. Ran is false for instructions that were not run because an
+// earlier instruction failed. The status of unnamed instructions is not recorded, so they are only reported as run
+// when all one-time instructions succeeded.
+type instructionReport struct {
+	Index    int    `json:"index"`
+	Name     string `json:"name,omitempty"`
+	Ran      bool   `json:"ran"`
+	ExitCode int    `json:"exitCode"`
+	TimedOut bool   `json:"timedOut,omitempty"`
+	Output   []byte `json:"output,omitempty"`
+}
+
+func apply(c *cli.Context) error {
+	planFile := c.Args().First()
+	if planFile == "" {
+		return fmt.Errorf("plan file not specified")
+	}
+
+	cf, err := loadAgentConfig()
+	if err != nil {
+		return err
+	}
+
+	rawPlan, err := os.ReadFile(planFile)
+	if err != nil {
+		return fmt.Errorf("unable to read plan file: %w", err)
+	}
+	cp, err := applyinator.CalculatePlan(rawPlan)
+	if err != nil {
+		return err
+	}
+
+	// The plan is always applied in full, regardless of the position file of a local plan, which is left untouched.
+	report := applyReport{
+		Checksum:  cp.Checksum,
+		Succeeded: true,
+	}
+	output, err := newApplyinator(cf).Apply(context.Background(), applyinator.ApplyInput{
+		CalculatedPlan:         cp,
+		ReconcileFiles:         true,
+		RunOneTimeInstructions: true,
+	})
+	report.SnapshotID = output.SnapshotID
+	report.FilesRolledBack = output.FilesRolledBack
+	if err != nil {
+		report.Succeeded = false
+		report.Error = err.Error()
+	} else {
+		if err := report.addInstructions(cp, output); err != nil {
+			return err
+		}
+		report.Probes = runProbes(cp.Plan.Probes, c.Duration("probe-wait"))
+		for _, probeStatus := range report.Probes {
+			if !probeStatus.Healthy {
+				report.Succeeded = false
+			}
+		}
+	}
+
+	printApplyReport(c.App.Writer, report)
+	reportJSON, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.Writer, "\n%s\n", reportJSON)
+
+	if !report.Succeeded {
+		return fmt.Errorf("plan %s was not applied successfully", cp.Checksum)
+	}
+	return nil
+}
+
+// addInstructions adds the results of the one-time and periodic instructions in the output to the report.
+func (r *applyReport) addInstructions(cp applyinator.CalculatedPlan, output applyinator.ApplyOutput) error {
+	statuses, err := applyinator.DecodeOneTimeInstructionStatus(output.OneTimeInstructionStatus)
+	if err != nil {
+		return fmt.Errorf("unable to decode one-time instruction status: %w", err)
+	}
+	outputs, err := applyinator.DecodeOneTimeOutput(output.OneTimeOutput)
+	if err != nil {
+		return fmt.Errorf("unable to decode one-time instruction output: %w", err)
+	}
+	periodicOutputs, err := applyinator.DecodePeriodicOutput(output.PeriodicOutput)
+	if err != nil {
+		return fmt.Errorf("unable to decode periodic instruction output: %w", err)
+	}
+
+	for index, instruction := range cp.Plan.OneTimeInstructions {
+		ir := instructionReport{
+			Index: index,
+			Name:  instruction.Name,
+		}
+		if status, ok := statuses[instruction.Name]; ok && instruction.Name != "" {
+			ir.Ran = true
+			ir.ExitCode = status.ExitCode
+			ir.TimedOut = status.TimedOut
+			ir.Output = outputs[instruction.Name]
+		} else if instruction.Name == "" && output.OneTimeApplySucceeded {
+			ir.Ran = true
+		}
+		r.OneTimeInstructions = append(r.OneTimeInstructions, ir)
+	}
+	for index, instruction := range cp.Plan.PeriodicInstructions {
+		ir := instructionReport{
+			Index: index,
+			Name:  instruction.Name,
+		}
+		if po, ok := periodicOutputs[instruction.Name]; ok && instruction.Name != "" {
+			ir.Ran = true
+			ir.ExitCode = po.ExitCode
+			ir.TimedOut = po.TimedOut
+			ir.Output = po.Stdout
+		}
+		r.PeriodicInstructions = append(r.PeriodicInstructions, ir)
+	}
+
+	if !output.OneTimeApplySucceeded || !output.PeriodicApplySucceeded {
+		r.Succeeded = false
+	}
+	return nil
+}
+
+// runProbes runs the probes until all of them are healthy or wait has elapsed. The probes are always run at least once.
+func runProbes(probes map[string]planapi.Probe, wait time.Duration) map[string]planapi.ProbeStatus {
+	probeStatuses := map[string]planapi.ProbeStatus{}
+	if len(probes) == 0 {
+		return probeStatuses
+	}
+	deadline := time.Now().Add(wait)
+	prober.DoProbes(probes, probeStatuses, true)
+	for !probesHealthy(probeStatuses) && time.Now().Add(probeInterval).Before(deadline) {
+		logrus.Debugf("Waiting %s before running probes again", probeInterval)
+		time.Sleep(probeInterval)
+		prober.DoProbes(probes, probeStatuses, false)
+	}
+	return probeStatuses
+}
+
+func probesHealthy(probeStatuses map[string]planapi.ProbeStatus) bool {
+	for _, probeStatus := range probeStatuses {
+		if !probeStatus.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// printApplyReport writes a human-readable summary of the report.
+func printApplyReport(w io.Writer, report applyReport) {
+	result := "succeeded"
+	if !report.Succeeded {
+		result = "failed"
+	}
+	fmt.Fprintf(w, "Plan %s %s\n", report.Checksum, result)
+	if report.SnapshotID != "" {
+		fmt.Fprintf(w, "  file snapshot: %s", report.SnapshotID)
+		if report.FilesRolledBack {
+			fmt.Fprintf(w, " (files were rolled back)")
+		}
+		fmt.Fprintln(w)
+	}
+	if report.Error != "" {
+		fmt.Fprintf(w, "  error: %s\n", report.Error)
+		return
+	}
+
+	printInstructionReports(w, "One-time instructions", report.OneTimeInstructions)
+	printInstructionReports(w, "Periodic instructions", report.PeriodicInstructions)
+
+	fmt.Fprintf(w, "\nProbes:\n")
+	if len(report.Probes) == 0 {
+		fmt.Fprintf(w, "  (none)\n")
+	}
+	probeNames := make([]string, 0, len(report.Probes))
+	for probeName := range report.Probes {
+		probeNames = append(probeNames, probeName)
+	}
+	sort.Strings(probeNames)
+	for _, probeName := range probeNames {
+		probeStatus := report.Probes[probeName]
+		health := "healthy"
+		if !probeStatus.Healthy {
+			health = "unhealthy"
+		}
+		fmt.Fprintf(w, "  %-12s %s (successes=%d, failures=%d)\n", health, probeName, probeStatus.SuccessCount, probeStatus.FailureCount)
+	}
+}
+
+func printInstructionReports(w io.Writer, title string, instructions []instructionReport) {
+	fmt.Fprintf(w, "\n%s:\n", title)
+	if len(instructions) == 0 {
+		fmt.Fprintf(w, "  (none)\n")
+	}
+	for _, instruction := range instructions {
+		name := instruction.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", instruction.Index)
+		}
+		switch {
+		case !instruction.Ran:
+			fmt.Fprintf(w, "  %-12s %s\n", "not run", name)
+		case instruction.TimedOut:
+			fmt.Fprintf(w, "  %-12s %s\n", "timed out", name)
+		case instruction.ExitCode != 0:
+			fmt.Fprintf(w, "  %-12s %s (exit code %d)\n", "failed", name, instruction.ExitCode)
+		default:
+			fmt.Fprintf(w, "  %-12s %s\n", "succeeded", name)
+		}
+	}
+}
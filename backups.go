@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/rancher/system-agent/pkg/applyinator"
+	"github.com/rancher/system-agent/pkg/config"
+)
+
+func listBackups(c *cli.Context) error {
+	cf, err := requireConfigDir("backupDirectory", func(cf config.AgentConfig) string { return cf.BackupDir })
+	if err != nil {
+		return err
+	}
+
+	backups, err := applyinator.ListBackups(cf.BackupDir)
+	if err != nil {
+		return fmt.Errorf("unable to list backups: %w", err)
+	}
+	if len(backups) == 0 {
+		fmt.Fprintf(c.App.Writer, "No backups in %s\n", cf.BackupDir)
+		return nil
+	}
+	for _, backup := range backups {
+		created := "unknown"
+		if !backup.CreatedAt.IsZero() {
+			created = backup.CreatedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(c.App.Writer, "%s\n  created:  %s\n  checksum: %s\n", backup.ID, created, backup.Checksum)
+		for _, path := range backup.Paths {
+			fmt.Fprintf(c.App.Writer, "  %s\n", path)
+		}
+	}
+	return nil
+}
+
+func restoreBackup(c *cli.Context) error {
+	id := c.Args().First()
+	if id == "" {
+		return fmt.Errorf("backup ID not specified")
+	}
+
+	cf, err := requireConfigDir("backupDirectory", func(cf config.AgentConfig) string { return cf.BackupDir })
+	if err != nil {
+		return err
+	}
+
+	skipped, err := applyinator.RestoreBackup(cf.BackupDir, id, c.Bool("force"))
+	for _, path := range skipped {
+		fmt.Fprintf(c.App.Writer, "Skipped %s, it changed since the plan was applied\n", path)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.Writer, "Restored backup %s\n", id)
+	return nil
+}
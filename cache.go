@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/rancher/system-agent/pkg/config"
+	"github.com/rancher/system-agent/pkg/image"
+)
+
+func listCache(c *cli.Context) error {
+	cf, err := requireConfigDir("imageCacheDirectory", func(cf config.AgentConfig) string { return cf.ImageCacheDir })
+	if err != nil {
+		return err
+	}
+
+	entries, err := image.ListCache(cf.ImageCacheDir)
+	if err != nil {
+		return fmt.Errorf("unable to list cached images: %w", err)
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(c.App.Writer, "No cached images in %s\n", cf.ImageCacheDir)
+		return nil
+	}
+	var total int64
+	for _, entry := range entries {
+		fmt.Fprintf(c.App.Writer, "%s\n  image:     %s\n  size:      %d\n  last used: %s\n", entry.Digest, entry.Image, entry.Size, entry.LastUsed.Format(time.RFC3339))
+		total += entry.Size
+	}
+	fmt.Fprintf(c.App.Writer, "%d cached images, %d bytes\n", len(entries), total)
+	return nil
+}
+
+func pruneCache(c *cli.Context) error {
+	cf, err := requireConfigDir("imageCacheDirectory", func(cf config.AgentConfig) string { return cf.ImageCacheDir })
+	if err != nil {
+		return err
+	}
+	if !c.Bool("all") && cf.ImageCacheMaxBytes <= 0 {
+		return fmt.Errorf("no image cache size is configured, set imageCacheMaxBytes in %s or use --all to evict every cached image", configFilePath())
+	}
+
+	maxBytes := cf.ImageCacheMaxBytes
+	if c.Bool("all") {
+		maxBytes = 0
+	}
+	evicted, err := image.PruneCache(cf.ImageCacheDir, maxBytes)
+	for _, entry := range evicted {
+		fmt.Fprintf(c.App.Writer, "Evicted %s (%s, %d bytes)\n", entry.Digest, entry.Image, entry.Size)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to prune image cache: %w", err)
+	}
+	fmt.Fprintf(c.App.Writer, "Evicted %d cached images\n", len(evicted))
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+	planapi "github.com/rancher/rancher/pkg/plan"
+	"github.com/urfave/cli/v2"
+
+	"github.com/rancher/system-agent/pkg/applyinator"
+	"github.com/rancher/system-agent/pkg/config"
+)
+
+func listHistory(c *cli.Context) error {
+	cf, err := requireConfigDir("appliedPlanDirectory", func(cf config.AgentConfig) string { return cf.AppliedPlanDir })
+	if err != nil {
+		return err
+	}
+
+	plans, err := applyinator.ListAppliedPlans(cf.AppliedPlanDir)
+	if err != nil {
+		return fmt.Errorf("unable to list applied plans: %w", err)
+	}
+	if len(plans) == 0 {
+		fmt.Fprintf(c.App.Writer, "No applied plans in %s\n", cf.AppliedPlanDir)
+		return nil
+	}
+	for _, plan := range plans {
+		outcome := string(plan.Outcome)
+		if outcome == "" {
+			outcome = "unknown"
+		}
+		fmt.Fprintf(c.App.Writer, "%s  %-9s  %s\n", plan.ID, outcome, plan.Checksum)
+		if appliedAt := plan.AppliedAt(); !appliedAt.IsZero() {
+			fmt.Fprintf(c.App.Writer, "  applied at:   %s\n", appliedAt.Format(time.RFC3339))
+		}
+		var oneTime, periodic []string
+		for index, instruction := range plan.Plan.OneTimeInstructions {
+			oneTime = append(oneTime, instructionName(index, instruction.CommonInstruction))
+		}
+		for index, instruction := range plan.Plan.PeriodicInstructions {
+			periodic = append(periodic, instructionName(index, instruction.CommonInstruction))
+		}
+		if len(oneTime) > 0 {
+			fmt.Fprintf(c.App.Writer, "  instructions: %s\n", strings.Join(oneTime, ", "))
+		}
+		if len(periodic) > 0 {
+			fmt.Fprintf(c.App.Writer, "  periodic:     %s\n", strings.Join(periodic, ", "))
+		}
+		if plan.Error != "" {
+			fmt.Fprintf(c.App.Writer, "  error:        %s\n", plan.Error)
+		}
+	}
+	return nil
+}
+
+func showHistory(c *cli.Context) error {
+	id := c.Args().First()
+	if id == "" {
+		return fmt.Errorf("applied plan ID not specified")
+	}
+
+	cf, err := requireConfigDir("appliedPlanDirectory", func(cf config.AgentConfig) string { return cf.AppliedPlanDir })
+	if err != nil {
+		return err
+	}
+
+	plan, err := applyinator.ReadAppliedPlan(cf.AppliedPlanDir, id)
+	if err != nil {
+		return fmt.Errorf("unable to read applied plan: %w", err)
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.Writer, "%s\n", data)
+	return nil
+}
+
+func diffHistory(c *cli.Context) error {
+	if c.Args().Len() != 2 {
+		return fmt.Errorf("two applied plan IDs must be specified")
+	}
+
+	cf, err := requireConfigDir("appliedPlanDirectory", func(cf config.AgentConfig) string { return cf.AppliedPlanDir })
+	if err != nil {
+		return err
+	}
+
+	var texts [2]string
+	for i, id := range c.Args().Slice() {
+		plan, err := applyinator.ReadAppliedPlan(cf.AppliedPlanDir, id)
+		if err != nil {
+			return fmt.Errorf("unable to read applied plan: %w", err)
+		}
+		texts[i], err = readablePlan(plan)
+		if err != nil {
+			return err
+		}
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(texts[0]),
+		B:        difflib.SplitLines(texts[1]),
+		FromFile: c.Args().Get(0),
+		ToFile:   c.Args().Get(1),
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	if diff == "" {
+		fmt.Fprintf(c.App.Writer, "Applied plans %s and %s are identical\n", c.Args().Get(0), c.Args().Get(1))
+		return nil
+	}
+	fmt.Fprint(c.App.Writer, diff)
+	return nil
+}
+
+// readablePlan returns the applied plan as indented json followed by the content of its files that are text, so that
+// changes to the content can be read line by line in a diff.
+func readablePlan(plan applyinator.AppliedPlan) (string, error) {
+	var contents strings.Builder
+	files := make([]planapi.File, len(plan.Plan.Files))
+	copy(files, plan.Plan.Files)
+	for i, file := range files {
+		content, err := base64.StdEncoding.DecodeString(file.Content)
+		if err != nil || file.Content == "" || !utf8.Valid(content) {
+			continue
+		}
+		files[i].Content = "(text, see below)"
+		fmt.Fprintf(&contents, "\n--- content of %s ---\n%s", file.Path, content)
+		if !strings.HasSuffix(string(content), "\n") {
+			contents.WriteString("\n")
+		}
+	}
+	plan.Plan.Files = files
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n" + contents.String(), nil
+}
+
+func instructionName(index int, instruction planapi.CommonInstruction) string {
+	if instruction.Name == "" {
+		return fmt.Sprintf("#%d", index)
+	}
+	return instruction.Name
+}
@@ -838,6 +838,8 @@ generate_config() {
 cat <<-EOF >"${CATTLE_AGENT_CONFIG_DIR}/config.yaml"
 workDirectory: ${CATTLE_AGENT_VAR_DIR}/work
 appliedPlanDirectory: ${CATTLE_AGENT_VAR_DIR}/applied
+backupDirectory: ${CATTLE_AGENT_VAR_DIR}/backups
+instructionLogDirectory: ${CATTLE_AGENT_VAR_DIR}/logs
 remoteEnabled: ${CATTLE_REMOTE_ENABLED}
 localEnabled: ${CATTLE_LOCAL_ENABLED}
 localPlanDirectory: ${CATTLE_AGENT_VAR_DIR}/plans
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/rancher/system-agent/pkg/applyinator"
+	"github.com/rancher/system-agent/pkg/config"
+)
+
+func printLogs(c *cli.Context) error {
+	cf, err := requireConfigDir("instructionLogDirectory", func(cf config.AgentConfig) string { return cf.InstructionLogDir })
+	if err != nil {
+		return err
+	}
+
+	runs, err := applyinator.ListRuns(cf.InstructionLogDir)
+	if err != nil {
+		return fmt.Errorf("unable to list instruction runs: %w", err)
+	}
+	if len(runs) == 0 {
+		fmt.Fprintf(c.App.Writer, "No instruction logs in %s\n", cf.InstructionLogDir)
+		return nil
+	}
+	if count := c.Int("runs"); count > 0 && count < len(runs) {
+		runs = runs[len(runs)-count:]
+	}
+	for _, run := range runs {
+		finished := "unfinished"
+		if run.FinishedAt != nil {
+			finished = "finished " + run.FinishedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(c.App.Writer, "=== %s (checksum %s, started %s, %s)\n", run.ID, run.Checksum, run.StartedAt.Format(time.RFC3339), finished)
+		for _, instruction := range run.Runs {
+			fmt.Fprintf(c.App.Writer, "--- %s: %s\n", instruction.LogFile, describeInstructionRun(instruction))
+			content, err := applyinator.ReadRunLog(cf.InstructionLogDir, run.ID, instruction.LogFile)
+			if err != nil {
+				return fmt.Errorf("unable to read instruction log: %w", err)
+			}
+			fmt.Fprint(c.App.Writer, tailLines(string(content), c.Int("tail")))
+		}
+	}
+	return nil
+}
+
+// describeInstructionRun summarizes the manifest entry of an instruction run on a single line.
+func describeInstructionRun(run applyinator.InstructionRun) string {
+	name := run.Name
+	if name == "" {
+		name = fmt.Sprintf("#%d", run.Index)
+	}
+	if run.Periodic {
+		name = "periodic " + name
+	}
+	parts := []string{name, fmt.Sprintf("attempt %d", run.Attempt)}
+	if run.Image != "" {
+		image := run.Image
+		if run.ImageDigest != "" {
+			image += "@" + run.ImageDigest
+		}
+		if run.ImageIndexDigest != "" {
+			image += " of index " + run.ImageIndexDigest
+		}
+		parts = append(parts, "image "+image)
+	}
+	if run.FinishedAt == nil {
+		parts = append(parts, "running")
+	} else {
+		parts = append(parts, fmt.Sprintf("exit code %d", run.ExitCode), "took "+run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond).String())
+	}
+	if run.TimedOut {
+		parts = append(parts, "timed out")
+	}
+	if run.Error != "" {
+		parts = append(parts, "error: "+run.Error)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// tailLines returns the last n lines of content, or all of it when n is not positive.
+func tailLines(content string, n int) string {
+	if n <= 0 {
+		return content
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(content, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	result := strings.Join(lines, "")
+	if result != "" && !strings.HasSuffix(result, "\n") {
+		result += "\n"
+	}
+	return result
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/mattn/go-colorable"
 	"github.com/sirupsen/logrus"
@@ -42,7 +44,14 @@ func main() {
 		}
 	}
 
-	app := &cli.App{
+	if err := newApp().Run(os.Args); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+// newApp returns the command line application of the agent.
+func newApp() *cli.App {
+	return &cli.App{
 		Name:    "rancher-system-agent",
 		Usage:   "Rancher System Agent runs a sentinel that reconciles desired plans with the node it is being run on",
 		Version: version.FriendlyVersion(),
@@ -52,6 +61,108 @@ func main() {
 				Usage:  "run the rancher-system-agent sentinel to watch plans",
 				Action: run,
 			},
+			{
+				Name:      "apply",
+				Usage:     "apply a plan file once in the foreground and report the result",
+				Action:    apply,
+				ArgsUsage: "<plan-file>",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "probe-wait",
+						Usage: "how long to keep running the probes of the plan until they are healthy",
+					},
+				},
+			},
+			{
+				Name:      "preview",
+				Usage:     "show what applying a plan file would change on this node without applying it",
+				Action:    preview,
+				ArgsUsage: "<plan-file>",
+			},
+			{
+				Name:  "history",
+				Usage: "query the plans applied by the agent",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "list the applied plans with their outcome, oldest first",
+						Action: listHistory,
+					},
+					{
+						Name:      "show",
+						Usage:     "show an applied plan in full",
+						Action:    showHistory,
+						ArgsUsage: "<id>",
+					},
+					{
+						Name:      "diff",
+						Usage:     "show the differences between two applied plans",
+						Action:    diffHistory,
+						ArgsUsage: "<id> <id>",
+					},
+				},
+			},
+			{
+				Name:  "backups",
+				Usage: "list and restore the backups of the files overwritten or deleted by applied plans",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "list the backups, oldest first",
+						Action: listBackups,
+					},
+					{
+						Name:      "restore",
+						Usage:     "restore the files of a backup to their state before its plan was applied",
+						Action:    restoreBackup,
+						ArgsUsage: "<backup-id>",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "remove directories that are not empty and restore backups that do not record what their plan wrote",
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "manage the cache of extracted instruction images",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "list the cached images, least recently used first",
+						Action: listCache,
+					},
+					{
+						Name:   "prune",
+						Usage:  "evict the least recently used images until the cache fits imageCacheMaxBytes",
+						Action: pruneCache,
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "all",
+								Usage: "evict every cached image",
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:   "logs",
+				Usage:  "print the logs of the instructions run by the agent",
+				Action: printLogs,
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "runs",
+						Usage: "number of most recent runs to print the logs of",
+						Value: 1,
+					},
+					&cli.IntFlag{
+						Name:  "tail",
+						Usage: "only print the last lines of every log, zero prints the whole log",
+					},
+				},
+			},
 			{
 				Name:      "validate-config",
 				Usage:     "validate agent configuration",
@@ -66,10 +177,6 @@ func main() {
 			},
 		},
 	}
-
-	if err := app.Run(os.Args); err != nil {
-		logrus.Fatalf("Validation failed: %v", err)
-	}
 }
 
 func run(_ *cli.Context) error {
@@ -77,17 +184,9 @@ func run(_ *cli.Context) error {
 
 	logrus.Infof("Rancher System Agent version %s is starting", version.FriendlyVersion())
 
-	configFile := os.Getenv(cattleAgentConfigEnv)
-
-	if configFile == "" {
-		configFile = defaultConfigFile
-	}
-
-	var cf config.AgentConfig
-
-	err := config.Parse(configFile, &cf)
+	cf, err := loadAgentConfig()
 	if err != nil {
-		return fmt.Errorf("unable to parse config file: %w", err)
+		return err
 	}
 
 	if !cf.LocalEnabled && !cf.RemoteEnabled {
@@ -96,8 +195,7 @@ func run(_ *cli.Context) error {
 
 	logrus.Infof("Using directory %s for work", cf.WorkDir)
 
-	imageUtil := image.NewUtility(cf.ImagesDir, cf.ImageCredentialProviderConfig, cf.ImageCredentialProviderBinDir, cf.AgentRegistriesFile)
-	applyinator := applyinator.NewApplyinator(cf.WorkDir, cf.PreserveWorkDir, cf.AppliedPlanDir, cf.InterlockDir, imageUtil)
+	applyinator := newApplyinator(cf)
 
 	if cf.RemoteEnabled {
 		logrus.Infof("Starting remote watch of plans")
@@ -128,16 +226,136 @@ func run(_ *cli.Context) error {
 	return nil
 }
 
+// configFilePath returns the path of the agent configuration file.
+func configFilePath() string {
+	if configFile := os.Getenv(cattleAgentConfigEnv); configFile != "" {
+		return configFile
+	}
+	return defaultConfigFile
+}
+
+func loadAgentConfig() (config.AgentConfig, error) {
+	var cf config.AgentConfig
+	if err := config.Parse(configFilePath(), &cf); err != nil {
+		return cf, fmt.Errorf("unable to parse config file: %w", err)
+	}
+	return cf, nil
+}
+
+// requireConfigDir loads the agent configuration, which must set the directory that dir returns under key.
+func requireConfigDir(key string, dir func(cf config.AgentConfig) string) (config.AgentConfig, error) {
+	cf, err := loadAgentConfig()
+	if err != nil {
+		return cf, err
+	}
+	if dir(cf) == "" {
+		return cf, fmt.Errorf("no %s is configured in %s", key, configFilePath())
+	}
+	return cf, nil
+}
+
+func newApplyinator(cf config.AgentConfig) *applyinator.Applyinator {
+	imageUtil := image.NewUtility(cf.ImagesDir, cf.ImageCredentialProviderConfig, cf.ImageCredentialProviderBinDir, cf.AgentRegistriesFile, imageOptions(cf))
+	return applyinator.NewApplyinator(cf.WorkDir, cf.PreserveWorkDir, cf.AppliedPlanDir, cf.InterlockDir, imageUtil, applyinatorOptions(cf))
+}
+
+func imageOptions(cf config.AgentConfig) image.Options {
+	return image.Options{
+		CacheDir:          cf.ImageCacheDir,
+		CacheMaxBytes:     cf.ImageCacheMaxBytes,
+		CacheHardlink:     cf.ImageCacheHardlink,
+		SignaturePolicies: signaturePolicies(cf.ImageSignaturePolicies),
+		PullAttempts:      cf.ImagePullAttempts,
+		PullBackoff:       time.Duration(cf.ImagePullBackoffSeconds) * time.Second,
+		PullMaxBackoff:    time.Duration(cf.ImagePullMaxBackoffSeconds) * time.Second,
+		PullTimeout:       time.Duration(cf.ImagePullTimeoutSeconds) * time.Second,
+	}
+}
+
+// signaturePolicies converts the image signature policies of the configuration to the policies of the image utility.
+func signaturePolicies(policies []config.SignaturePolicy) []image.SignaturePolicy {
+	var result []image.SignaturePolicy
+	for _, policy := range policies {
+		p := image.SignaturePolicy{
+			Scope:      policy.Scope,
+			Mode:       image.SignatureMode(policy.Mode),
+			PublicKeys: policy.PublicKeys,
+		}
+		if policy.Keyless != nil {
+			p.Keyless = &image.KeylessPolicy{
+				TrustRoot:                 policy.Keyless.TrustRoot,
+				TransparencyLogPublicKeys: policy.Keyless.TransparencyLogPublicKeys,
+			}
+			for _, identity := range policy.Keyless.Identities {
+				p.Keyless.Identities = append(p.Keyless.Identities, image.SignerIdentity{
+					Subject: identity.Subject,
+					Issuer:  identity.Issuer,
+				})
+			}
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+func applyinatorOptions(cf config.AgentConfig) applyinator.Options {
+	return applyinator.Options{
+		InstructionTimeout:     time.Duration(cf.InstructionTimeoutSeconds) * time.Second,
+		TerminationGracePeriod: time.Duration(cf.InstructionTerminationGracePeriodSeconds) * time.Second,
+		Cgroup: applyinator.CgroupOptions{
+			Enabled:       cf.InstructionCgroupsEnabled,
+			Root:          cf.InstructionCgroupRoot,
+			MemoryMax:     cf.InstructionMemoryLimitBytes,
+			CPUMillicores: cf.InstructionCPULimitMillicores,
+			PidsMax:       cf.InstructionPidsLimit,
+		},
+		SecurityContext: applyinator.SecurityContext{
+			UID:                cf.InstructionUID,
+			GID:                cf.InstructionGID,
+			SupplementalGroups: cf.InstructionSupplementalGroups,
+			Capabilities:       cf.InstructionCapabilities,
+			NoNewPrivs:         cf.InstructionNoNewPrivs,
+		},
+		InstructionConcurrency:            cf.InstructionConcurrency,
+		RollbackFilesOnInstructionFailure: cf.RollbackFilesOnInstructionFailure,
+		FileDriftCheckInterval:            time.Duration(cf.FileDriftCheckIntervalSeconds) * time.Second,
+		FileDriftPolicy:                   applyinator.DriftPolicy(cf.FileDriftPolicy),
+		BackupDir:                         cf.BackupDir,
+		AppliedPlanRetentionCount:         cf.AppliedPlanRetentionCount,
+		AppliedPlanRetentionAge:           time.Duration(cf.AppliedPlanRetentionMaxAgeSeconds) * time.Second,
+		BackupRetentionCount:              cf.BackupRetentionCount,
+		InstructionOutputMaxBytes:         cf.InstructionOutputMaxBytes,
+		InstructionLogDir:                 cf.InstructionLogDir,
+		InstructionLogMaxBytes:            cf.InstructionLogMaxBytes,
+		InstructionLogMaxFiles:            cf.InstructionLogMaxFiles,
+		InstructionLogRetentionCount:      cf.InstructionLogRetentionCount,
+		ImageDigestPolicy:                 applyinator.ImageDigestPolicy(cf.ImageDigestPolicy),
+		HooksDir:                          cf.HooksDir,
+		HookTimeout:                       time.Duration(cf.HookTimeoutSeconds) * time.Second,
+		ImagePrefetch:                     cf.ImagePrefetch,
+		ImagePrefetchConcurrency:          cf.ImagePrefetchConcurrency,
+		ImagePrefetchWhileBlocked:         cf.ImagePrefetchWhileBlocked,
+		Redaction: applyinator.Redaction{
+			Env:      cf.RedactEnv,
+			Args:     cf.RedactArgs,
+			Patterns: cf.RedactPatterns,
+		},
+	}
+}
+
 func validateConfig(c *cli.Context) error {
 	logrus.Infof("Rancher System Agent version %s - Configuration Validation", version.FriendlyVersion())
 
 	// Get config file from positional argument or use default
 	configFile := c.Args().First()
 	if configFile == "" {
-		return fmt.Errorf("configuration file not specified. Please provide a configuration file as an argument or set the %s environment variable to point to the configuration file", cattleAgentConfigEnv)
+		return fmt.Errorf("validation failed: configuration file not specified. Please provide a configuration file as an argument or set the %s environment variable to point to the configuration file", cattleAgentConfigEnv)
 	}
 
-	return validateConfigurationFile(configFile)
+	if err := validateConfigurationFile(configFile); err != nil {
+		return fmt.Errorf("validation failed: %w", err)
+	}
+	return nil
 }
 
 func validateConfigurationFile(configFile string) error {
@@ -174,6 +392,32 @@ func validateConfigurationFile(configFile string) error {
 		}
 	}
 
+	switch applyinator.DriftPolicy(cf.FileDriftPolicy) {
+	case "", applyinator.DriftPolicyReport, applyinator.DriftPolicyReapply:
+	default:
+		return fmt.Errorf("invalid file drift policy %s, must be %s or %s", cf.FileDriftPolicy, applyinator.DriftPolicyReport, applyinator.DriftPolicyReapply)
+	}
+
+	switch applyinator.ImageDigestPolicy(cf.ImageDigestPolicy) {
+	case "", applyinator.ImageDigestPolicyRequireDigest, applyinator.ImageDigestPolicyRequireListed:
+	default:
+		return fmt.Errorf("invalid image digest policy %s, must be %s or %s", cf.ImageDigestPolicy, applyinator.ImageDigestPolicyRequireDigest, applyinator.ImageDigestPolicyRequireListed)
+	}
+
+	if err := image.ValidateSignaturePolicies(signaturePolicies(cf.ImageSignaturePolicies)); err != nil {
+		return err
+	}
+
+	if cf.ImagePrefetch && cf.ImageCacheDir == "" {
+		return fmt.Errorf("image prefetch enabled but image cache directory not specified")
+	}
+
+	for _, pattern := range cf.RedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid redact pattern %q: %w", pattern, err)
+		}
+	}
+
 	// Validate local configuration if enabled
 	if cf.LocalEnabled {
 		if err := validateLocalConfig(cf); err != nil {
@@ -190,11 +434,11 @@ func validateConnection(c *cli.Context) error {
 
 	connectionInfoFile := c.Args().First()
 	if connectionInfoFile == "" {
-		return fmt.Errorf("connection info file not specified")
+		return fmt.Errorf("validation failed: connection info file not specified")
 	}
 
 	if err := validateConnectionInfoFile(connectionInfoFile); err != nil {
-		return err
+		return fmt.Errorf("validation failed: %w", err)
 	}
 
 	logrus.Infof("Connection info validation successful")
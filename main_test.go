@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/base64"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
@@ -120,6 +122,70 @@ localEnabled: true
 			expectError:   true,
 			errorContains: "local plan directory not specified",
 		},
+		{
+			name: "image prefetch enabled but image cache directory not specified",
+			setupFunc: func() (string, error) {
+				configFile := filepath.Join(tmpDir, "prefetch-no-cache.yaml")
+				configContent := `workDirectory: /tmp/test-work
+remoteEnabled: true
+localEnabled: false
+connectionInfoFile: ` + filepath.Join(tmpDir, "connection-info.json") + `
+imagePrefetch: true
+`
+				if err := os.WriteFile(configFile, []byte(configContent), 0o600); err != nil {
+					return "", err
+				}
+
+				return configFile, nil
+			},
+			expectError:   true,
+			errorContains: "image cache directory not specified",
+		},
+		{
+			name: "invalid redact pattern",
+			setupFunc: func() (string, error) {
+				configFile := filepath.Join(tmpDir, "invalid-redact-pattern.yaml")
+				configContent := `workDirectory: /tmp/test-work
+remoteEnabled: true
+localEnabled: false
+connectionInfoFile: ` + filepath.Join(tmpDir, "connection-info.json") + `
+redactPatterns: ["token=(\\w+", "key=(\\w+)"]
+`
+				if err := os.WriteFile(configFile, []byte(configContent), 0o600); err != nil {
+					return "", err
+				}
+
+				return configFile, nil
+			},
+			expectError:   true,
+			errorContains: "invalid redact pattern",
+		},
+		{
+			name: "invalid image signature policy",
+			setupFunc: func() (string, error) {
+				configFile := filepath.Join(tmpDir, "invalid-image-signature-policy.yaml")
+				configContent := `workDirectory: /tmp/test-work
+remoteEnabled: true
+localEnabled: false
+connectionInfoFile: ` + filepath.Join(tmpDir, "connection-info.json") + `
+imageSignaturePolicies:
+- scope: docker.io/rancher
+  mode: audit
+  keyless:
+    trustRoot: /etc/rancher/agent/fulcio.pem
+    identities:
+    - subject: https://github.com/rancher/system-agent/.github/workflows/release.yml@refs/heads/main
+      issuer: https://token.actions.githubusercontent.com
+`
+				if err := os.WriteFile(configFile, []byte(configContent), 0o600); err != nil {
+					return "", err
+				}
+
+				return configFile, nil
+			},
+			expectError:   true,
+			errorContains: "invalid mode",
+		},
 	}
 
 	for _, tt := range tests {
@@ -147,6 +213,8 @@ localEnabled: true
 					t.Errorf("Expected error but got none")
 				} else if tt.errorContains != "" && !strings.Contains(err.Error(), tt.errorContains) {
 					t.Errorf("Expected error containing %q, got: %v", tt.errorContains, err)
+				} else if !strings.HasPrefix(err.Error(), "validation failed: ") {
+					t.Errorf("Expected validation error, got: %v", err)
 				}
 			} else if err != nil {
 				t.Errorf("Unexpected error: %v", err)
@@ -267,6 +335,8 @@ func TestValidateConnection(t *testing.T) {
 					t.Errorf("Expected error but got none")
 				} else if tt.errorContains != "" && !strings.Contains(err.Error(), tt.errorContains) {
 					t.Errorf("Expected error containing %q, got: %v", tt.errorContains, err)
+				} else if !strings.HasPrefix(err.Error(), "validation failed: ") {
+					t.Errorf("Expected validation error, got: %v", err)
 				}
 			} else if err != nil {
 				t.Errorf("Unexpected error: %v", err)
@@ -292,3 +362,418 @@ func TestValidateConnection(t *testing.T) {
 		}
 	})
 }
+
+func TestPreview(t *testing.T) {
+	tmpDir := t.TempDir()
+	t.Setenv(cattleAgentConfigEnv, filepath.Join(tmpDir, "missing-config.yaml"))
+
+	targetFile := filepath.Join(tmpDir, "config.yaml")
+	planFile := filepath.Join(tmpDir, "test.plan")
+	planContent := `{"files":[{"path":"` + targetFile + `","content":"aGVsbG8K"}],"instructions":[{"name":"install","command":"/bin/false"}]}`
+	if err := os.WriteFile(planFile, []byte(planContent), 0o600); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	out, err := runCommand("preview", planFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, expected := range []string{"create       " + targetFile, "+hello", "run          install"} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected output containing %q, got: %s", expected, out)
+		}
+	}
+	if _, err := os.Stat(targetFile); !os.IsNotExist(err) {
+		t.Errorf("Expected preview not to write %s", targetFile)
+	}
+}
+
+func TestApply(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	interlockDir := filepath.Join(tmpDir, "interlock")
+	if err := os.MkdirAll(interlockDir, 0o755); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	configContent := `workDirectory: ` + filepath.Join(tmpDir, "work") + `
+interlockDirectory: ` + interlockDir + `
+`
+	writeTestConfig(t, tmpDir, configContent)
+
+	tests := []struct {
+		name           string
+		instructions   string
+		restartPending bool
+		expectError    bool
+		expectOutput   []string
+	}{
+		{
+			name:         "successful instruction",
+			instructions: `[{"name":"hello","command":"/bin/sh","args":["-c","echo hello"],"saveOutput":true}]`,
+			expectOutput: []string{"succeeded    hello", `"succeeded": true`, `"output": "aGVsbG8K"`},
+		},
+		{
+			name:         "failing instruction",
+			instructions: `[{"name":"fail","command":"/bin/sh","args":["-c","exit 3"]},{"name":"skipped","command":"/bin/true"}]`,
+			expectError:  true,
+			expectOutput: []string{"failed       fail (exit code 3)", "not run      skipped", `"succeeded": false`},
+		},
+		{
+			name:           "restart pending",
+			instructions:   `[{"name":"hello","command":"/bin/true"}]`,
+			restartPending: true,
+			expectError:    true,
+			expectOutput:   []string{"restart is pending"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restartPendingFile := filepath.Join(interlockDir, "restart-pending")
+			if tt.restartPending {
+				if err := os.WriteFile(restartPendingFile, []byte(time.Now().Format(time.UnixDate)), 0o600); err != nil {
+					t.Fatalf("Setup failed: %v", err)
+				}
+				defer os.Remove(restartPendingFile)
+			}
+
+			planFile := filepath.Join(tmpDir, "test.plan")
+			if err := os.WriteFile(planFile, []byte(`{"instructions":`+tt.instructions+`}`), 0o600); err != nil {
+				t.Fatalf("Setup failed: %v", err)
+			}
+
+			out, err := runCommand("apply", planFile)
+			if tt.expectError && err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			for _, expected := range tt.expectOutput {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected output containing %q, got: %s", expected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestBackups(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	configContent := `workDirectory: ` + filepath.Join(tmpDir, "work") + `
+backupDirectory: ` + filepath.Join(tmpDir, "backups") + `
+`
+	writeTestConfig(t, tmpDir, configContent)
+
+	targetFile := filepath.Join(tmpDir, "target")
+	if err := os.WriteFile(targetFile, []byte("original"), 0o600); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	planFile := filepath.Join(tmpDir, "test.plan")
+	planContent := `{"files":[{"path":"` + targetFile + `","content":"` + base64.StdEncoding.EncodeToString([]byte("planned")) + `","uid":-1,"gid":-1}]}`
+	if err := os.WriteFile(planFile, []byte(planContent), 0o600); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+
+	if _, err := runCommand("apply", planFile); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	out, err := runCommand("backups", "list")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	lines := strings.Split(out, "\n")
+	if len(lines) < 4 || !strings.Contains(out, targetFile) {
+		t.Fatalf("Expected a backup of %s, got: %s", targetFile, out)
+	}
+	id := lines[0]
+
+	if _, err := runCommand("backups", "restore", id); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(targetFile)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", targetFile, err)
+	}
+	if string(content) != "original" {
+		t.Errorf("Expected restored content %q, got %q", "original", content)
+	}
+
+	if _, err := runCommand("backups", "restore", "missing"); err == nil {
+		t.Errorf("Expected error restoring a missing backup but got none")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	appliedPlanDir := filepath.Join(tmpDir, "applied")
+	if err := os.MkdirAll(appliedPlanDir, 0o700); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	configContent := `workDirectory: ` + filepath.Join(tmpDir, "work") + `
+appliedPlanDirectory: ` + appliedPlanDir + `
+`
+	writeTestConfig(t, tmpDir, configContent)
+
+	records := map[string]string{
+		"20260101-100000": `{"Plan":{"files":[{"path":"/etc/test.yaml","content":"` + base64.StdEncoding.EncodeToString([]byte("a: 1\nb: 2\n")) + `"}],"instructions":[{"name":"install"}]},"Checksum":"first","Outcome":"succeeded"}`,
+		"20260102-100000": `{"Plan":{"files":[{"path":"/etc/test.yaml","content":"` + base64.StdEncoding.EncodeToString([]byte("a: 1\nb: 3\n")) + `"}],"instructions":[{"name":"install"}]},"Checksum":"second","Outcome":"failed","Error":"boom"}`,
+	}
+	for id, record := range records {
+		if err := os.WriteFile(filepath.Join(appliedPlanDir, id+"-applied.plan"), []byte(record), 0o600); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		args         []string
+		expectError  bool
+		expectOutput []string
+	}{
+		{
+			name:         "list",
+			args:         []string{"list"},
+			expectOutput: []string{"20260101-100000  succeeded  first", "20260102-100000  failed     second", "instructions: install", "error:        boom"},
+		},
+		{
+			name:         "show",
+			args:         []string{"show", "20260102-100000"},
+			expectOutput: []string{`"Checksum": "second"`, `"Outcome": "failed"`},
+		},
+		{
+			name:         "diff",
+			args:         []string{"diff", "20260101-100000", "20260102-100000"},
+			expectOutput: []string{`-  "Checksum": "first",`, `+  "Checksum": "second",`, "-b: 2", "+b: 3"},
+		},
+		{
+			name:        "missing",
+			args:        []string{"show", "20260103-100000"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runCommand(append([]string{"history"}, tt.args...)...)
+			if tt.expectError && err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !tt.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			for _, expected := range tt.expectOutput {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected output containing %q, got: %s", expected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestLogs(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	logDir := filepath.Join(tmpDir, "logs")
+	configContent := `workDirectory: ` + filepath.Join(tmpDir, "work") + `
+instructionLogDirectory: ` + logDir + `
+`
+	writeTestConfig(t, tmpDir, configContent)
+
+	runs := map[string]struct {
+		manifest string
+		log      string
+	}{
+		"20260101-100000-first": {
+			manifest: `{"checksum":"first","startedAt":"2026-01-01T10:00:00Z","finishedAt":"2026-01-01T10:00:05Z","instructions":[{"name":"install","index":0,"attempt":1,"image":"example.com/installer:v1","imageDigest":"sha256:abc","startedAt":"2026-01-01T10:00:00Z","finishedAt":"2026-01-01T10:00:05Z","exitCode":0,"logFile":"instruction-0.log"}]}`,
+			log:      "2026-01-01T10:00:01Z stdout: first line\n2026-01-01T10:00:02Z stdout: second line\n",
+		},
+		"20260102-100000-second": {
+			manifest: `{"checksum":"second","startedAt":"2026-01-02T10:00:00Z","instructions":[{"name":"install","index":0,"attempt":2,"startedAt":"2026-01-02T10:00:00Z","finishedAt":"2026-01-02T10:00:01Z","exitCode":1,"logFile":"instruction-0.log"}]}`,
+			log:      "2026-01-02T10:00:01Z stderr: failed\n",
+		},
+	}
+	for id, run := range runs {
+		if err := os.MkdirAll(filepath.Join(logDir, id), 0o700); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(logDir, id, "manifest.json"), []byte(run.manifest), 0o600); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(logDir, id, "instruction-0.log"), []byte(run.log), 0o600); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		args           []string
+		expectOutput   []string
+		unexpectOutput []string
+	}{
+		{
+			name:           "last run",
+			args:           []string{},
+			expectOutput:   []string{"=== 20260102-100000-second", "install, attempt 2, exit code 1", "stderr: failed", "unfinished"},
+			unexpectOutput: []string{"20260101-100000-first"},
+		},
+		{
+			name:         "all runs",
+			args:         []string{"--runs", "2"},
+			expectOutput: []string{"=== 20260101-100000-first", "image example.com/installer:v1@sha256:abc", "first line", "=== 20260102-100000-second"},
+		},
+		{
+			name:           "tail",
+			args:           []string{"--runs", "2", "--tail", "1"},
+			expectOutput:   []string{"second line", "stderr: failed"},
+			unexpectOutput: []string{"first line"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := runCommand(append([]string{"logs"}, tt.args...)...)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			for _, expected := range tt.expectOutput {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected output containing %q, got: %s", expected, out)
+				}
+			}
+			for _, unexpected := range tt.unexpectOutput {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Expected output not containing %q, got: %s", unexpected, out)
+				}
+			}
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	cacheDir := filepath.Join(tmpDir, "cache")
+
+	entries := []struct {
+		dir      string
+		entry    string
+		lastUsed time.Time
+	}{
+		{
+			dir:      "sha256-old",
+			entry:    `{"digest":"sha256:old","image":"example.com/installer:v1","size":20}`,
+			lastUsed: time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			dir:      "sha256-new",
+			entry:    `{"digest":"sha256:new","image":"example.com/installer:v2","size":20}`,
+			lastUsed: time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, entry := range entries {
+		if err := os.MkdirAll(filepath.Join(cacheDir, entry.dir, "rootfs"), 0o700); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+		entryFile := filepath.Join(cacheDir, entry.dir, "entry.json")
+		if err := os.WriteFile(entryFile, []byte(entry.entry), 0o600); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+		if err := os.Chtimes(entryFile, entry.lastUsed, entry.lastUsed); err != nil {
+			t.Fatalf("Setup failed: %v", err)
+		}
+	}
+
+	// The test cases run in order, as pruning removes entries from the cache.
+	tests := []struct {
+		name           string
+		maxBytes       string
+		args           []string
+		expectError    string
+		expectOutput   []string
+		unexpectOutput []string
+	}{
+		{
+			name:         "list",
+			args:         []string{"list"},
+			expectOutput: []string{"sha256:old\n  image:     example.com/installer:v1", "last used: " + entries[0].lastUsed.Local().Format(time.RFC3339), "sha256:new", "2 cached images, 40 bytes"},
+		},
+		{
+			name:        "prune without size",
+			args:        []string{"prune"},
+			expectError: "no image cache size is configured",
+		},
+		{
+			name:           "prune to size",
+			maxBytes:       "30",
+			args:           []string{"prune"},
+			expectOutput:   []string{"Evicted sha256:old (example.com/installer:v1, 20 bytes)", "Evicted 1 cached images"},
+			unexpectOutput: []string{"Evicted sha256:new"},
+		},
+		{
+			name:         "prune all",
+			maxBytes:     "30",
+			args:         []string{"prune", "--all"},
+			expectOutput: []string{"Evicted sha256:new", "Evicted 1 cached images"},
+		},
+		{
+			name:         "list empty",
+			args:         []string{"list"},
+			expectOutput: []string{"No cached images in " + cacheDir},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configContent := `workDirectory: ` + filepath.Join(tmpDir, "work") + `
+imageCacheDirectory: ` + cacheDir + `
+`
+			if tt.maxBytes != "" {
+				configContent += "imageCacheMaxBytes: " + tt.maxBytes + "\n"
+			}
+			writeTestConfig(t, tmpDir, configContent)
+
+			out, err := runCommand(append([]string{"cache"}, tt.args...)...)
+			if tt.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+					t.Errorf("Expected error containing %q, got: %v", tt.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			for _, expected := range tt.expectOutput {
+				if !strings.Contains(out, expected) {
+					t.Errorf("Expected output containing %q, got: %s", expected, out)
+				}
+			}
+			for _, unexpected := range tt.unexpectOutput {
+				if strings.Contains(out, unexpected) {
+					t.Errorf("Expected output not containing %q, got: %s", unexpected, out)
+				}
+			}
+		})
+	}
+}
+
+// writeTestConfig writes the agent configuration that the commands under test load to the temporary directory.
+func writeTestConfig(t *testing.T, tmpDir, configContent string) {
+	t.Helper()
+	configFile := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte(configContent), 0o600); err != nil {
+		t.Fatalf("Setup failed: %v", err)
+	}
+	t.Setenv(cattleAgentConfigEnv, configFile)
+}
+
+// runCommand runs the command line of the agent with args and returns its output.
+func runCommand(args ...string) (string, error) {
+	var out strings.Builder
+	app := newApp()
+	app.Writer = &out
+	err := app.Run(append([]string{"test"}, args...))
+	return out.String(), err
+}
@@ -1,11 +1,11 @@
 package applyinator
 
 import (
-	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -30,12 +30,112 @@ type Applyinator struct {
 	appliedPlanDir  string
 	interlockDir    string
 	imageUtil       *image.Utility
+	options         Options
+	prefetch        *imagePrefetch
+}
+
+// Options holds the optional tunables of an Applyinator. The zero value preserves the historical behavior.
+type Options struct {
+	// InstructionTimeout is the default maximum runtime of an instruction. Zero disables the timeout.
+	InstructionTimeout time.Duration
+	// TerminationGracePeriod is how long a timed out instruction is given to exit after SIGTERM before its process
+	// group is sent SIGKILL.
+	TerminationGracePeriod time.Duration
+	// Cgroup configures running each instruction in its own transient cgroup v2.
+	Cgroup CgroupOptions
+	// SecurityContext is the default security context of instructions.
+	SecurityContext SecurityContext
+	// InstructionConcurrency is the maximum number of one-time instructions that are run at once when a plan declares
+	// dependencies between its instructions. Plans without dependencies always run their instructions in order.
+	InstructionConcurrency int
+	// RollbackFilesOnInstructionFailure restores the files of a plan to their snapshot when its one-time instructions
+	// fail. Files are always restored when reconciling them fails.
+	RollbackFilesOnInstructionFailure bool
+	// FileDriftCheckInterval is how often the files of an applied plan are compared against the disk. Zero disables
+	// drift detection.
+	FileDriftCheckInterval time.Duration
+	// FileDriftPolicy determines whether drifted files are only reported or also reapplied.
+	FileDriftPolicy DriftPolicy
+	// BackupDir is the directory that the snapshot of the files of every applied plan is kept in as a backup, instead of
+	// the work directory. Backups can be listed and restored with ListBackups and RestoreBackup.
+	BackupDir string
+	// BackupRetentionCount is the number of backups that are kept.
+	BackupRetentionCount int
+	// AppliedPlanRetentionCount is the number of applied plans that are kept in the applied plan directory.
+	AppliedPlanRetentionCount int
+	// AppliedPlanRetentionAge is how long applied plans are kept in the applied plan directory. The most recent applied
+	// plan is always kept. Zero keeps applied plans regardless of their age.
+	AppliedPlanRetentionAge time.Duration
+	// InstructionLogDir is the directory that the output of every instruction run is logged to, together with a
+	// manifest of the runs. Logs are kept independently of the work directory. Empty disables instruction logs.
+	InstructionLogDir string
+	// InstructionLogMaxBytes is the size at which the log of an instruction is rotated.
+	InstructionLogMaxBytes int64
+	// InstructionLogMaxFiles is the number of rotated files that are kept for the log of an instruction.
+	InstructionLogMaxFiles int
+	// InstructionLogRetentionCount is the number of runs of one-time instructions whose logs are kept in the instruction
+	// log directory, which is also the number of runs of only periodic instructions that are kept.
+	InstructionLogRetentionCount int
+	// InstructionOutputMaxBytes is the maximum size of each of the stdout and stderr of an instruction that are kept as
+	// its output, 256 KiB by default. Larger output keeps its head and tail with a truncation marker in between. A
+	// negative size keeps all output. There is no limit on the combined output of all instructions of a plan.
+	InstructionOutputMaxBytes int
+	// Redaction declares sensitive values of instructions in addition to those declared by plans, which are masked in
+	// logs, the saved output of instructions and applied plans.
+	Redaction Redaction
+	// ImageDigestPolicy refuses instruction images that are referenced by tag alone. Empty allows them.
+	ImageDigestPolicy ImageDigestPolicy
+	// HooksDir is the directory whose pre-apply.d and post-apply.d directories hold executables that are run before
+	// the files of a plan are reconciled and after its instructions were run. Empty disables hooks.
+	HooksDir string
+	// HookTimeout is the maximum runtime of a hook.
+	HookTimeout time.Duration
+	// NodeEnvFile is the environment file of the agent service whose CATTLE_* variables are available to templated
+	// files.
+	NodeEnvFile string
+	// ImagePrefetch pulls the images of the instructions of a plan into the image cache concurrently as soon as the
+	// plan is applied, rather than one at a time as the instructions are run. It requires an image cache.
+	ImagePrefetch bool
+	// ImagePrefetchConcurrency is the maximum number of images that are prefetched at once.
+	ImagePrefetchConcurrency int
+	// ImagePrefetchWhileBlocked also prefetches the images of a plan while a pending restart of the agent blocks
+	// applying it. Plans can request this with prefetchImagesWhileBlocked.
+	ImagePrefetchWhileBlocked bool
+}
+
+// CgroupOptions configures the transient cgroup v2 that each instruction is run in. Limits that are zero are not set.
+type CgroupOptions struct {
+	Enabled bool
+	// Root is the cgroup directory below which the instruction cgroups are created.
+	Root string
+	// MemoryMax is the memory limit of an instruction in bytes.
+	MemoryMax int64
+	// CPUMillicores is the CPU bandwidth limit of an instruction in thousandths of a CPU.
+	CPUMillicores int64
+	// PidsMax is the maximum number of processes an instruction may have.
+	PidsMax int64
 }
 
 // CalculatedPlan is passed into Applyinator and is a Plan with checksum calculated
 type CalculatedPlan struct {
-	Plan     planapi.Plan
-	Checksum string
+	Plan       planapi.Plan
+	Extensions PlanExtensions
+	Checksum   string
+}
+
+// AppliedPlan is the record of an applied plan that is written to the applied plan directory.
+type AppliedPlan struct {
+	CalculatedPlan
+	// SnapshotID identifies the snapshot of the files of the plan in the work directory, or the backup directory.
+	SnapshotID string `json:",omitempty"`
+	// Outcome is the outcome of applying the plan, which is empty while the plan is being applied.
+	Outcome PlanOutcome `json:",omitempty"`
+	// Error is the error that applying the plan failed with.
+	Error string `json:",omitempty"`
+
+	// ID is the name of the record in the applied plan directory without its suffix, which is the time the plan was
+	// applied at. It is set when the record is read.
+	ID string `json:"-"`
 }
 
 const appliedPlanFileSuffix = "-applied.plan"
@@ -44,12 +144,50 @@ const defaultCommand = "/run.sh"
 const cattleAgentExecutionPwdEnvKey = "CATTLE_AGENT_EXECUTION_PWD"
 const cattleAgentAttemptKey = "CATTLE_AGENT_ATTEMPT_NUMBER"
 const planRetentionPolicyCount = 64
+const defaultInstructionOutputMaxBytes = 256 * 1024
 const restartPendingInterlockFile = "restart-pending"
 const applyinatorActiveInterlockFile = "applyinator-active"
 const restartPendingTimeout = 5 * time.Minute // Wait a maximum of 5 minutes before force-applying a plan if a restart is pending.
 const deleteFileAction = "delete"
+const defaultTerminationGracePeriod = 10 * time.Second
+const defaultCgroupName = "rancher-system-agent"
+const defaultInstructionConcurrency = 4
+const defaultImagePrefetchConcurrency = 4
 
-func NewApplyinator(workDir string, preserveWorkDir bool, appliedPlanDir, interlockDir string, imageUtil *image.Utility) *Applyinator {
+func NewApplyinator(workDir string, preserveWorkDir bool, appliedPlanDir, interlockDir string, imageUtil *image.Utility, options Options) *Applyinator {
+	if options.TerminationGracePeriod <= 0 {
+		options.TerminationGracePeriod = defaultTerminationGracePeriod
+	}
+	if options.InstructionConcurrency <= 0 {
+		options.InstructionConcurrency = defaultInstructionConcurrency
+	}
+	if options.AppliedPlanRetentionCount <= 0 {
+		options.AppliedPlanRetentionCount = planRetentionPolicyCount
+	}
+	if options.BackupRetentionCount <= 0 {
+		options.BackupRetentionCount = planRetentionPolicyCount
+	}
+	if options.InstructionOutputMaxBytes == 0 {
+		options.InstructionOutputMaxBytes = defaultInstructionOutputMaxBytes
+	}
+	if options.InstructionLogMaxBytes <= 0 {
+		options.InstructionLogMaxBytes = defaultInstructionLogMaxBytes
+	}
+	if options.InstructionLogMaxFiles <= 0 {
+		options.InstructionLogMaxFiles = defaultInstructionLogMaxFiles
+	}
+	if options.InstructionLogRetentionCount <= 0 {
+		options.InstructionLogRetentionCount = planRetentionPolicyCount
+	}
+	if options.HookTimeout <= 0 {
+		options.HookTimeout = defaultHookTimeout
+	}
+	if options.NodeEnvFile == "" {
+		options.NodeEnvFile = defaultNodeEnvFile
+	}
+	if options.ImagePrefetchConcurrency <= 0 {
+		options.ImagePrefetchConcurrency = defaultImagePrefetchConcurrency
+	}
 	return &Applyinator{
 		mu:              &sync.Mutex{},
 		workDir:         workDir,
@@ -57,6 +195,8 @@ func NewApplyinator(workDir string, preserveWorkDir bool, appliedPlanDir, interl
 		appliedPlanDir:  appliedPlanDir,
 		interlockDir:    interlockDir,
 		imageUtil:       imageUtil,
+		options:         options,
+		prefetch:        &imagePrefetch{},
 	}
 }
 
@@ -65,36 +205,105 @@ func CalculatePlan(rawPlan []byte) (CalculatedPlan, error) {
 	if err != nil {
 		return CalculatedPlan{}, err
 	}
+	extensions, err := parsePlanExtensions(rawPlan)
+	if err != nil {
+		return CalculatedPlan{}, err
+	}
 	return CalculatedPlan{
-		Plan:     p,
-		Checksum: planapi.Checksum(rawPlan),
+		Plan:       p,
+		Extensions: extensions,
+		Checksum:   planapi.Checksum(rawPlan),
 	}, nil
 }
 
+// ExecutionStatus records agent-side details of an instruction execution that are not captured by its output.
+type ExecutionStatus struct {
+	// TimedOut is true when the instruction was terminated because it exceeded its timeout.
+	TimedOut bool `json:"timedOut,omitempty"`
+	// PeakMemoryBytes is the peak memory usage of the instruction when it was run in a cgroup.
+	PeakMemoryBytes int64 `json:"peakMemoryBytes,omitempty"`
+	// CPUTimeSeconds is the CPU time consumed by the instruction when it was run in a cgroup.
+	CPUTimeSeconds float64 `json:"cpuTimeSeconds,omitempty"`
+	// ImageDigest is the digest that the image of the instruction resolved to, which is the image that was run.
+	ImageDigest string `json:"imageDigest,omitempty"`
+	// ImageIndexDigest is the digest of the index of the multi-platform image that the image of the instruction
+	// resolved to, when it is multi-platform and its index was resolved.
+	ImageIndexDigest string `json:"imageIndexDigest,omitempty"`
+	// ImagePullError is the failure of pulling the image of the instruction, with every registry endpoint that was
+	// tried and why it failed.
+	ImagePullError *image.PullError `json:"imagePullError,omitempty"`
+	// ImageSignature is the result of verifying the signature of the image of the instruction, with the verified
+	// digest and signer, when a signature policy applies to the image.
+	ImageSignature *image.SignatureVerification `json:"imageSignature,omitempty"`
+}
+
+// OneTimeInstructionStatus is the status of a one-time instruction, keyed by instruction name in
+// ApplyOutput.OneTimeInstructionStatus.
+type OneTimeInstructionStatus struct {
+	ExitCode int `json:"exitCode"`
+	ExecutionStatus
+}
+
+// PeriodicInstructionOutput extends planapi.PeriodicInstructionOutput with the execution status of the last run.
+type PeriodicInstructionOutput struct {
+	planapi.PeriodicInstructionOutput
+	ExecutionStatus
+}
+
 type ApplyOutput struct {
 	OneTimeOutput          []byte
 	OneTimeApplySucceeded  bool
 	PeriodicOutput         []byte
 	PeriodicApplySucceeded bool
+	// OneTimeInstructionStatus is a gzipped, json-marshalled map of OneTimeInstructionStatus entries where the key is
+	// the instruction name.
+	OneTimeInstructionStatus []byte
+	// Preview is the computed preview of the plan when ApplyInput.DryRun is set.
+	Preview *PlanPreview
+	// SnapshotID identifies the snapshot of the files taken before they were reconciled.
+	SnapshotID string
+	// FilesRolledBack is true when the files were restored to the snapshot.
+	FilesRolledBack bool
+	// FileDrift is the json-marshalled FileDriftReport of the last drift check, when drift detection is enabled.
+	FileDrift []byte
 }
 
 type ApplyInput struct {
-	CalculatedPlan             CalculatedPlan
-	RunOneTimeInstructions     bool
-	OneTimeInstructionAttempts int
-	ReconcileFiles             bool
-	ExistingOneTimeOutput      []byte
-	ExistingPeriodicOutput     []byte
+	CalculatedPlan                   CalculatedPlan
+	RunOneTimeInstructions           bool
+	OneTimeInstructionAttempts       int
+	ReconcileFiles                   bool
+	ExistingOneTimeOutput            []byte
+	ExistingPeriodicOutput           []byte
+	ExistingOneTimeInstructionStatus []byte
+	ExistingFileDrift                []byte
+	// DryRun computes ApplyOutput.Preview instead of applying the plan. Nothing is executed or written.
+	DryRun bool
+}
+
+// executionResult is the result of running a single instruction.
+type executionResult struct {
+	stdout   []byte
+	stderr   []byte
+	exitCode int
+	status   ExecutionStatus
 }
 
 // Apply accepts a context, calculated plan, a bool to indicate whether to run the onetime instructions, the existing onetimeinstruction output, and an input byte slice which is a base64+gzip json-marshalled map of PeriodicInstructionOutput
 // entries where the key is the PeriodicInstructionOutput.Name. It outputs a revised versions of the existing outputs, and if specified, runs the one time instructions. Notably, ApplyOutput.OneTimeApplySucceeded will be false if ApplyInput.RunOneTimeInstructions is false
-func (a *Applyinator) Apply(ctx context.Context, input ApplyInput) (ApplyOutput, error) {
+func (a *Applyinator) Apply(ctx context.Context, input ApplyInput) (output ApplyOutput, err error) {
 	logrus.Debugf("[Applyinator] Applying plan with checksum %s", input.CalculatedPlan.Checksum)
 	logrus.Tracef("[Applyinator] Applying plan - attempting to get lock")
-	output := ApplyOutput{
-		OneTimeOutput:  input.ExistingOneTimeOutput,
-		PeriodicOutput: input.ExistingPeriodicOutput,
+	output = ApplyOutput{
+		OneTimeOutput:            input.ExistingOneTimeOutput,
+		PeriodicOutput:           input.ExistingPeriodicOutput,
+		OneTimeInstructionStatus: input.ExistingOneTimeInstructionStatus,
+		FileDrift:                input.ExistingFileDrift,
+	}
+	// The images of the plan are prefetched while the plan waits for an apply in progress, unless a pending restart
+	// blocks it.
+	if !a.restartPending() || a.prefetchWhileBlocked(input.CalculatedPlan) {
+		a.prefetchImages(ctx, input)
 	}
 	a.mu.Lock()
 	logrus.Tracef("[Applyinator] Applying plan - lock achieved")
@@ -103,6 +312,19 @@ func (a *Applyinator) Apply(ctx context.Context, input ApplyInput) (ApplyOutput,
 	nowUnixTimeString := now.Format(time.UnixDate)
 	nowString := now.Format(applyinatorDateCodeLayout)
 
+	// Patterns that do not compile are skipped rather than failing the plan, which is still redacted with the rest.
+	redactor, redactErr := a.newRedactor(input.CalculatedPlan)
+	if redactErr != nil {
+		logrus.Errorf("error in redaction of plan %s: %v", input.CalculatedPlan.Checksum, redactErr)
+	}
+
+	if input.DryRun {
+		logrus.Debugf("[Applyinator] Computing preview of plan with checksum %s", input.CalculatedPlan.Checksum)
+		preview, err := a.preview(now, input, redactor)
+		output.Preview = preview
+		return output, err
+	}
+
 	// Check to see if we are safe to apply.
 	if a.interlockDir != "" {
 		restartPendingInterlockFilePath := filepath.Join(a.interlockDir, restartPendingInterlockFile)
@@ -147,55 +369,120 @@ func (a *Applyinator) Apply(ctx context.Context, input ApplyInput) (ApplyOutput,
 		}
 		defer func() {
 			// Remove the Applyinator Active Interlock File
-			err = os.Remove(applyinatorActiveInterlockFilePath)
-			if err != nil {
+			if err := os.Remove(applyinatorActiveInterlockFilePath); err != nil {
 				logrus.Errorf("unable to remove applyinator active interlock file %s: %v", applyinatorActiveInterlockFilePath, err)
 			}
 		}()
 	}
 
+	a.prefetchImages(ctx, input)
+
 	executionDir := filepath.Join(a.workDir, nowString)
 	logrus.Tracef("[Applyinator] Applying calculated node plan contents %v", input.CalculatedPlan.Checksum)
 	logrus.Tracef("[Applyinator] Using %s as execution directory", executionDir)
-	if a.appliedPlanDir != "" {
+
+	// Render templated files before anything is written, so that a rendering error leaves the node untouched.
+	var files []planFile
+	driftCheckDue := a.driftCheckDue(now, input)
+	if input.ReconcileFiles || driftCheckDue {
+		var err error
+		files, err = a.renderFiles(input.CalculatedPlan)
+		if err != nil {
+			if input.ReconcileFiles {
+				return output, err
+			}
+			// The periodic instructions of an applied plan keep running when its files cannot be checked for drift.
+			logrus.Errorf("error rendering files of plan %s to check them for drift: %v", input.CalculatedPlan.Checksum, err)
+			output.FileDrift = fileDriftError(now, err)
+			driftCheckDue = false
+		}
+	}
+
+	// Hooks are only run around applying the plan, rather than every time an applied plan is checked. The pre-apply hooks
+	// are run before the files are snapshotted and the plan is recorded, so that an aborted apply leaves neither behind.
+	if input.ReconcileFiles || input.RunOneTimeInstructions {
+		// The post-apply hooks are run whenever the pre-apply hooks were, so that they can undo them.
+		defer func() {
+			var applyErr string
+			if err != nil {
+				applyErr = redactor.redactString(err.Error())
+			}
+			if hookErr := a.runHooks(ctx, HookPhasePost, input.CalculatedPlan.Checksum, planOutcome(input, output, err), applyErr); hookErr != nil {
+				logrus.Errorf("error running post-apply hooks: %v", hookErr)
+			}
+		}()
+		if err := a.runHooks(ctx, HookPhasePre, input.CalculatedPlan.Checksum, "", ""); err != nil {
+			logrus.Errorf("[Applyinator] Not applying plan %s: %v", input.CalculatedPlan.Checksum, err)
+			return output, err
+		}
+	}
+
+	var snapshot *fileSnapshot
+	if input.ReconcileFiles && len(files) > 0 {
+		var err error
+		snapshot, err = a.snapshotFiles(nowString+"-"+input.CalculatedPlan.Checksum, input.CalculatedPlan.Checksum, files)
+		if err != nil {
+			return output, fmt.Errorf("unable to snapshot files before reconciling: %w", err)
+		}
+		output.SnapshotID = snapshot.ID
+	}
+
+	// Only plans that are being applied are recorded, rather than every time an applied plan is checked.
+	if a.appliedPlanDir != "" && (input.ReconcileFiles || input.RunOneTimeInstructions) {
 		logrus.Debugf("[Applyinator] Writing applied calculated plan contents to historical plan directory %s", a.appliedPlanDir)
 		if err := os.MkdirAll(a.appliedPlanDir, 0700); err != nil {
 			logrus.Errorf("error creawting applied plan directory: %v", err)
 		}
-		if err := a.writePlanToDisk(now, &input.CalculatedPlan); err != nil {
-			logrus.Errorf("error writing applied plan to disk: %v", err)
+		recordedPlan := input.CalculatedPlan
+		recordedPlan.Plan = redactor.redactPlan(recordedPlan.Plan)
+		record := &AppliedPlan{CalculatedPlan: recordedPlan, SnapshotID: output.SnapshotID}
+		historyFile, writeErr := a.writePlanToDisk(now, record)
+		if writeErr != nil {
+			logrus.Errorf("error writing applied plan to disk: %v", writeErr)
 		}
-		if err := a.appliedPlanRetentionPolicy(planRetentionPolicyCount); err != nil {
+		if err := a.appliedPlanRetentionPolicy(now, a.options.AppliedPlanRetentionCount, a.options.AppliedPlanRetentionAge); err != nil {
 			logrus.Errorf("error while applying plan retention policy: %v", err)
 		}
+		if historyFile != "" {
+			defer func() {
+				a.recordPlanOutcome(historyFile, record, input, output, err, redactor)
+			}()
+		}
 	}
 
 	if input.ReconcileFiles {
-		for _, file := range input.CalculatedPlan.Plan.Files {
-			if file.Action == deleteFileAction {
-				if err := removeFile(file); err != nil {
-					return output, err
-				}
-			} else if file.Directory {
-				logrus.Debugf("[Applyinator] Creating directory %s", file.Path)
-				if err := createDirectory(file); err != nil {
-					return output, err
-				}
-			} else {
-				logrus.Debugf("[Applyinator] Writing file %s", file.Path)
-				if err := writeBase64ContentToFile(file); err != nil {
-					return output, err
+		if err := reconcileFiles(files); err != nil {
+			if snapshot != nil {
+				if err := snapshot.restore(); err != nil {
+					logrus.Errorf("error rolling back files to snapshot %s: %v", snapshot.ID, err)
 				}
+				output.FilesRolledBack = true
+			}
+			return output, err
+		}
+		if snapshot != nil {
+			if err := snapshot.recordWritten(); err != nil {
+				logrus.Errorf("error recording the reconciled files in snapshot %s: %v", snapshot.ID, err)
 			}
 		}
+		if err := pruneSources(a.workDir, files); err != nil {
+			logrus.Errorf("error removing unused staged sources: %v", err)
+		}
+	}
+
+	if driftCheckDue {
+		output.FileDrift = a.checkFileDrift(now, input, files)
 	}
 
 	if !a.preserveWorkDir {
 		logrus.Debugf("[Applyinator] Cleaning working directory before applying %s", a.workDir)
-		if err := os.RemoveAll(a.workDir); err != nil {
+		if err := cleanWorkDir(a.workDir); err != nil {
 			return output, err
 		}
 	}
+	runLog := a.newRunLog(now, input.CalculatedPlan.Checksum, redactor)
+	defer runLog.finish()
+
 	if input.RunOneTimeInstructions {
 		logrus.Infof("[Applyinator] Applying one-time instructions for plan with checksum %s", input.CalculatedPlan.Checksum)
 		executionOutputs := map[string][]byte{}
@@ -209,29 +496,67 @@ func (a *Applyinator) Apply(ctx context.Context, input ApplyInput) (ApplyOutput,
 			}
 		}
 
-		oneTimeApplySucceeded := true
-		for index, instruction := range input.CalculatedPlan.Plan.OneTimeInstructions {
+		executionStatuses := map[string]OneTimeInstructionStatus{}
+		var executionOutputsLock sync.Mutex
+		runInstruction := func(index int) bool {
+			instruction := input.CalculatedPlan.Plan.OneTimeInstructions[index]
 			logrus.Debugf("[Applyinator] Executing instruction %d attempt %d for plan %s", index, input.OneTimeInstructionAttempts, input.CalculatedPlan.Checksum)
 			executionInstructionDir := filepath.Join(executionDir, input.CalculatedPlan.Checksum+"_"+strconv.Itoa(index))
 			prefix := input.CalculatedPlan.Checksum + "_" + strconv.Itoa(index)
-			executeOutput, _, exitCode, err := a.execute(ctx, prefix, executionInstructionDir, instruction.CommonInstruction, true, input.OneTimeInstructionAttempts)
-			if err != nil || exitCode != 0 {
+			extensions := input.CalculatedPlan.Extensions.oneTimeInstruction(index)
+			log := runLog.start(index, false, instruction.CommonInstruction, input.OneTimeInstructionAttempts)
+			result, err := a.execute(ctx, prefix, executionInstructionDir, instruction.CommonInstruction, extensions, true, input.OneTimeInstructionAttempts, log, redactor)
+			log.finish(result, err)
+			succeeded := err == nil && result.exitCode == 0
+			if !succeeded {
 				logrus.Errorf("error executing instruction %d: %v", index, err)
-				oneTimeApplySucceeded = false
 			}
+			executionOutputsLock.Lock()
+			defer executionOutputsLock.Unlock()
 			if instruction.Name == "" && instruction.SaveOutput {
 				logrus.Errorf("instruction does not have a name set, cannot save output data")
 			} else if instruction.SaveOutput {
-				executionOutputs[instruction.Name] = executeOutput
+				executionOutputs[instruction.Name] = result.stdout
 			}
-			// If we have failed to apply our one-time instructions, we need to break in order to stop subsequent instructions from executing.
-			if !oneTimeApplySucceeded {
-				break
+			if instruction.Name != "" {
+				executionStatuses[instruction.Name] = OneTimeInstructionStatus{
+					ExitCode:        result.exitCode,
+					ExecutionStatus: result.status,
+				}
+			}
+			return succeeded
+		}
+
+		oneTimeApplySucceeded := true
+		if input.CalculatedPlan.Extensions.hasInstructionDependencies() {
+			logrus.Debugf("[Applyinator] Plan %s declares instruction dependencies, executing instructions with up to %d workers", input.CalculatedPlan.Checksum, a.options.InstructionConcurrency)
+			graph, err := newInstructionGraph(input.CalculatedPlan.Plan.OneTimeInstructions, input.CalculatedPlan.Extensions.OneTimeInstructions)
+			if err != nil {
+				logrus.Errorf("error in instruction dependencies of plan %s: %v", input.CalculatedPlan.Checksum, err)
+				oneTimeApplySucceeded = false
+			} else {
+				oneTimeApplySucceeded = graph.run(a.options.InstructionConcurrency, runInstruction)
+			}
+		} else {
+			for index := range input.CalculatedPlan.Plan.OneTimeInstructions {
+				// If we have failed to apply our one-time instructions, we need to break in order to stop subsequent instructions from executing.
+				if !runInstruction(index) {
+					oneTimeApplySucceeded = false
+					break
+				}
 			}
 		}
 
 		output.OneTimeApplySucceeded = oneTimeApplySucceeded
 
+		if !oneTimeApplySucceeded && snapshot != nil && a.options.RollbackFilesOnInstructionFailure {
+			logrus.Infof("[Applyinator] One-time instructions of plan %s failed, rolling back its files", input.CalculatedPlan.Checksum)
+			if err := snapshot.restore(); err != nil {
+				logrus.Errorf("error rolling back files to snapshot %s: %v", snapshot.ID, err)
+			}
+			output.FilesRolledBack = true
+		}
+
 		marshalledExecutionOutputs, err := json.Marshal(executionOutputs)
 		if err != nil {
 			return output, err
@@ -243,17 +568,23 @@ func (a *Applyinator) Apply(ctx context.Context, input ApplyInput) (ApplyOutput,
 		}
 
 		output.OneTimeOutput = oneTimeApplyOutput
-	}
 
-	periodicOutputs := map[string]planapi.PeriodicInstructionOutput{}
-	if len(input.ExistingPeriodicOutput) > 0 {
-		objectBuffer, err := generateByteBufferFromBytes(input.ExistingPeriodicOutput)
+		marshalledExecutionStatuses, err := json.Marshal(executionStatuses)
 		if err != nil {
 			return output, err
 		}
-		if err := json.Unmarshal(objectBuffer.Bytes(), &periodicOutputs); err != nil {
+
+		oneTimeInstructionStatus, err := gzipByteSlice(marshalledExecutionStatuses)
+		if err != nil {
 			return output, err
 		}
+
+		output.OneTimeInstructionStatus = oneTimeInstructionStatus
+	}
+
+	periodicOutputs, err := DecodePeriodicOutput(input.ExistingPeriodicOutput)
+	if err != nil {
+		return output, err
 	}
 
 	periodicApplySucceeded := true
@@ -262,56 +593,24 @@ func (a *Applyinator) Apply(ctx context.Context, input ApplyInput) (ApplyOutput,
 			logrus.Errorf("periodic instruction %d did not have name, unable to run", index)
 			continue
 		}
-		var previousRunTime, lastFailureTime string
-		var failures int
-		if po, ok := periodicOutputs[instruction.Name]; ok {
-			if po.LastSuccessfulRunTime != "" {
-				logrus.Debugf("[Applyinator] Got periodic output for instruction %s and am now parsing last successful run time %s", instruction.Name, po.LastSuccessfulRunTime)
-				t, err := time.Parse(time.UnixDate, po.LastSuccessfulRunTime)
-				if err != nil {
-					logrus.Errorf("error encountered during parsing of last successful run time: %v", err)
-				} else {
-					previousRunTime = po.LastSuccessfulRunTime
-					if instruction.PeriodSeconds == 0 {
-						instruction.PeriodSeconds = 600 // set default period to 600 seconds
-					}
-					if now.Before(t.Add(time.Second*time.Duration(instruction.PeriodSeconds))) && !input.RunOneTimeInstructions {
-						logrus.Debugf("[Applyinator] Not running periodic instruction %s as period duration has not elapsed since last successful run", instruction.Name)
-						continue
-					}
-				}
-			}
-			if po.LastFailedRunTime != "" {
-				logrus.Debugf("[Applyinator] Got periodic output for instruction %s and am now parsing last failed time %s", instruction.Name, po.LastFailedRunTime)
-				t, err := time.Parse(time.UnixDate, po.LastFailedRunTime)
-				if err != nil {
-					logrus.Errorf("error encountered during parsing of last failed run time: %+v", err)
-				} else {
-					lastFailureTime = po.LastFailedRunTime
-					failures = po.Failures
-					failureCooldown := failures
-					if failures > 6 {
-						failureCooldown = 6
-					} else if failures == 0 {
-						failureCooldown = 1
-					}
-					logrus.Debugf("[Applyinator] Instruction %s - Last failed run attempt was %s, failures: %d, failureCooldown: %d", instruction.Name, lastFailureTime, failures, failureCooldown)
-					if now.Before(t.Add(time.Second*time.Duration(30*failureCooldown))) && !input.RunOneTimeInstructions {
-						logrus.Debugf("[Applyinator] Not running periodic instruction %s as failure cooldown has not elapsed since last failed run", instruction.Name)
-						continue
-					}
-				}
-			}
+		po, ok := periodicOutputs[instruction.Name]
+		schedule := schedulePeriodicInstruction(now, instruction, po, ok, input.RunOneTimeInstructions)
+		if !schedule.due {
+			continue
 		}
+		previousRunTime, lastFailureTime, failures := schedule.previousRunTime, schedule.lastFailureTime, schedule.failures
 		logrus.Debugf("[Applyinator] Executing periodic instruction %d for plan %s", index, input.CalculatedPlan.Checksum)
 		executionInstructionDir := filepath.Join(executionDir, input.CalculatedPlan.Checksum+"_"+strconv.Itoa(index))
 		prefix := input.CalculatedPlan.Checksum + "_" + strconv.Itoa(index)
-		stdout, stderr, exitCode, err := a.execute(ctx, prefix, executionInstructionDir, instruction.CommonInstruction, false, failures+1)
-		if err != nil || exitCode != 0 {
+		extensions := input.CalculatedPlan.Extensions.periodicInstruction(index)
+		log := runLog.start(index, true, instruction.CommonInstruction, failures+1)
+		result, err := a.execute(ctx, prefix, executionInstructionDir, instruction.CommonInstruction, extensions, false, failures+1, log, redactor)
+		log.finish(result, err)
+		if err != nil || result.exitCode != 0 {
 			periodicApplySucceeded = false
 		}
 		lsrt := nowUnixTimeString
-		if exitCode != 0 {
+		if result.exitCode != 0 {
 			lsrt = previousRunTime
 			lastFailureTime = nowUnixTimeString
 			failures++
@@ -320,17 +619,21 @@ func (a *Applyinator) Apply(ctx context.Context, input ApplyInput) (ApplyOutput,
 			lastFailureTime = ""
 			failures = 0
 		}
+		stderr := result.stderr
 		if !instruction.SaveStderrOutput {
 			stderr = []byte{}
 		}
-		periodicOutputs[instruction.Name] = planapi.PeriodicInstructionOutput{
-			Name:                  instruction.Name,
-			Stdout:                stdout,
-			Stderr:                stderr,
-			ExitCode:              exitCode,
-			LastSuccessfulRunTime: lsrt,
-			LastFailedRunTime:     lastFailureTime,
-			Failures:              failures,
+		periodicOutputs[instruction.Name] = PeriodicInstructionOutput{
+			PeriodicInstructionOutput: planapi.PeriodicInstructionOutput{
+				Name:                  instruction.Name,
+				Stdout:                result.stdout,
+				Stderr:                stderr,
+				ExitCode:              result.exitCode,
+				LastSuccessfulRunTime: lsrt,
+				LastFailedRunTime:     lastFailureTime,
+				Failures:              failures,
+			},
+			ExecutionStatus: result.status,
 		}
 		if !periodicApplySucceeded {
 			break
@@ -352,6 +655,111 @@ func (a *Applyinator) Apply(ctx context.Context, input ApplyInput) (ApplyOutput,
 	return output, nil
 }
 
+// periodicSchedule is the result of checking whether a periodic instruction is due to run.
+type periodicSchedule struct {
+	due             bool
+	reason          string
+	previousRunTime string
+	lastFailureTime string
+	failures        int
+}
+
+// schedulePeriodicInstruction determines whether a periodic instruction is due based on its previous output. The
+// instruction is due once its period has elapsed since the last successful run and its failure cooldown has elapsed
+// since the last failed run, or always when the one-time instructions are being run.
+func schedulePeriodicInstruction(now time.Time, instruction planapi.PeriodicInstruction, po PeriodicInstructionOutput, hasOutput, runOneTimeInstructions bool) periodicSchedule {
+	schedule := periodicSchedule{due: true, reason: "no previous run"}
+	if !hasOutput {
+		return schedule
+	}
+	schedule.reason = "period and failure cooldown elapsed"
+	if runOneTimeInstructions {
+		schedule.reason = "one-time instructions are being applied"
+	}
+	if po.LastSuccessfulRunTime != "" {
+		logrus.Debugf("[Applyinator] Got periodic output for instruction %s and am now parsing last successful run time %s", instruction.Name, po.LastSuccessfulRunTime)
+		t, err := time.Parse(time.UnixDate, po.LastSuccessfulRunTime)
+		if err != nil {
+			logrus.Errorf("error encountered during parsing of last successful run time: %v", err)
+		} else {
+			schedule.previousRunTime = po.LastSuccessfulRunTime
+			if instruction.PeriodSeconds == 0 {
+				instruction.PeriodSeconds = 600 // set default period to 600 seconds
+			}
+			if next := t.Add(time.Second * time.Duration(instruction.PeriodSeconds)); now.Before(next) && !runOneTimeInstructions {
+				logrus.Debugf("[Applyinator] Not running periodic instruction %s as period duration has not elapsed since last successful run", instruction.Name)
+				schedule.due = false
+				schedule.reason = fmt.Sprintf("period has not elapsed, next run at %s", next.Format(time.UnixDate))
+				return schedule
+			}
+		}
+	}
+	if po.LastFailedRunTime != "" {
+		logrus.Debugf("[Applyinator] Got periodic output for instruction %s and am now parsing last failed time %s", instruction.Name, po.LastFailedRunTime)
+		t, err := time.Parse(time.UnixDate, po.LastFailedRunTime)
+		if err != nil {
+			logrus.Errorf("error encountered during parsing of last failed run time: %+v", err)
+		} else {
+			schedule.lastFailureTime = po.LastFailedRunTime
+			schedule.failures = po.Failures
+			failureCooldown := po.Failures
+			if po.Failures > 6 {
+				failureCooldown = 6
+			} else if po.Failures == 0 {
+				failureCooldown = 1
+			}
+			logrus.Debugf("[Applyinator] Instruction %s - Last failed run attempt was %s, failures: %d, failureCooldown: %d", instruction.Name, schedule.lastFailureTime, schedule.failures, failureCooldown)
+			if next := t.Add(time.Second * time.Duration(30*failureCooldown)); now.Before(next) && !runOneTimeInstructions {
+				logrus.Debugf("[Applyinator] Not running periodic instruction %s as failure cooldown has not elapsed since last failed run", instruction.Name)
+				schedule.due = false
+				schedule.reason = fmt.Sprintf("failure cooldown has not elapsed, next run at %s", next.Format(time.UnixDate))
+				return schedule
+			}
+		}
+	}
+	return schedule
+}
+
+// DecodePeriodicOutput decodes a gzipped, json-marshalled map of PeriodicInstructionOutput entries, such as
+// ApplyOutput.PeriodicOutput.
+func DecodePeriodicOutput(input []byte) (map[string]PeriodicInstructionOutput, error) {
+	periodicOutputs := map[string]PeriodicInstructionOutput{}
+	if err := decodeGzippedJSON(input, &periodicOutputs); err != nil {
+		return nil, err
+	}
+	return periodicOutputs, nil
+}
+
+// DecodeOneTimeOutput decodes ApplyOutput.OneTimeOutput into the saved stdout of the one-time instructions by name.
+func DecodeOneTimeOutput(input []byte) (map[string][]byte, error) {
+	outputs := map[string][]byte{}
+	if err := decodeGzippedJSON(input, &outputs); err != nil {
+		return nil, err
+	}
+	return outputs, nil
+}
+
+// DecodeOneTimeInstructionStatus decodes ApplyOutput.OneTimeInstructionStatus.
+func DecodeOneTimeInstructionStatus(input []byte) (map[string]OneTimeInstructionStatus, error) {
+	statuses := map[string]OneTimeInstructionStatus{}
+	if err := decodeGzippedJSON(input, &statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// decodeGzippedJSON unmarshals gzipped json into v. Empty input leaves v unchanged.
+func decodeGzippedJSON(input []byte, v interface{}) error {
+	if len(input) == 0 {
+		return nil
+	}
+	objectBuffer, err := generateByteBufferFromBytes(input)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(objectBuffer.Bytes(), v)
+}
+
 func gzipByteSlice(input []byte) ([]byte, error) {
 	var gzOutput bytes.Buffer
 
@@ -382,21 +790,22 @@ func generateByteBufferFromBytes(input []byte) (*bytes.Buffer, error) {
 	return &objectBuffer, nil
 }
 
-func (a *Applyinator) appliedPlanRetentionPolicy(retention int) error {
+// appliedPlanRetentionPolicy removes all but the newest retention applied plans, and applied plans older than maxAge
+// except for the newest one.
+func (a *Applyinator) appliedPlanRetentionPolicy(now time.Time, retention int, maxAge time.Duration) error {
 	planFiles, err := a.getAppliedPlanFiles()
 	if err != nil {
 		return err
 	}
 
-	if len(planFiles) <= retention {
-		return nil
-	}
-
 	sort.Slice(planFiles, func(i, j int) bool {
 		return planFiles[i].Name() < planFiles[j].Name()
 	})
 
-	delCount := len(planFiles) - retention
+	delCount := 0
+	if len(planFiles) > retention {
+		delCount = len(planFiles) - retention
+	}
 	for _, df := range planFiles[:delCount] {
 		historicalPlanFile := filepath.Join(a.appliedPlanDir, df.Name())
 		logrus.Infof("[Applyinator] Removing historical applied plan (retention policy count: %d) %s", retention, historicalPlanFile)
@@ -404,6 +813,21 @@ func (a *Applyinator) appliedPlanRetentionPolicy(retention int) error {
 			return err
 		}
 	}
+
+	if maxAge <= 0 || len(planFiles) == 0 {
+		return nil
+	}
+	for _, df := range planFiles[delCount : len(planFiles)-1] {
+		appliedAt, err := time.ParseInLocation(applyinatorDateCodeLayout, strings.TrimSuffix(df.Name(), appliedPlanFileSuffix), time.Local)
+		if err != nil || now.Sub(appliedAt) <= maxAge {
+			continue
+		}
+		historicalPlanFile := filepath.Join(a.appliedPlanDir, df.Name())
+		logrus.Infof("[Applyinator] Removing historical applied plan (retention policy age: %s) %s", maxAge, historicalPlanFile)
+		if err := os.Remove(historicalPlanFile); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -422,47 +846,84 @@ func (a *Applyinator) getAppliedPlanFiles() ([]os.DirEntry, error) {
 	return planFiles, nil
 }
 
-func (a *Applyinator) writePlanToDisk(now time.Time, plan *CalculatedPlan) error {
+// writePlanToDisk writes the record of an applied plan to the applied plan directory and returns the name of the file
+// it was written to. A plan with the same checksum as the last record is not recorded again, and the name of the last
+// record is returned instead, so that the outcome of applying the plan again replaces its outcome.
+func (a *Applyinator) writePlanToDisk(now time.Time, plan *AppliedPlan) (string, error) {
 	planFiles, err := a.getAppliedPlanFiles()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	file := now.Format(applyinatorDateCodeLayout) + appliedPlanFileSuffix
-	anpString, err := json.Marshal(plan)
-	if err != nil {
-		return err
-	}
-
 	if len(planFiles) != 0 {
 		sort.Slice(planFiles, func(i, j int) bool {
 			return planFiles[i].Name() > planFiles[j].Name()
 		})
-		existingFileContent, err := os.ReadFile(filepath.Join(a.appliedPlanDir, planFiles[0].Name()))
+		// The outcome and snapshot of the last record differ from a plan that is being applied, so only the checksum
+		// of the plans is compared.
+		lastPlan, err := ReadAppliedPlan(a.appliedPlanDir, strings.TrimSuffix(planFiles[0].Name(), appliedPlanFileSuffix))
 		if err != nil {
-			return err
+			return "", err
 		}
-		if bytes.Equal(existingFileContent, anpString) {
-			logrus.Debugf("[Applyinator] Not writing applied plan to file %s as the last file written (%s) had identical contents", file, planFiles[0].Name())
-			return nil
+		if lastPlan.Checksum == plan.Checksum {
+			logrus.Debugf("[Applyinator] Not writing applied plan to file %s as the last file written (%s) had the same checksum", file, planFiles[0].Name())
+			return planFiles[0].Name(), nil
 		}
 	}
 
-	return writeContentToFile(filepath.Join(a.appliedPlanDir, file), os.Getuid(), os.Getgid(), 0600, anpString)
+	anpString, err := json.Marshal(plan)
+	if err != nil {
+		return "", err
+	}
+	return file, writeContentToFile(filepath.Join(a.appliedPlanDir, file), os.Getuid(), os.Getgid(), 0600, anpString)
 }
 
-func (a *Applyinator) execute(ctx context.Context, prefix, executionDir string, instruction planapi.CommonInstruction, combinedOutput bool, attempt int) ([]byte, []byte, int, error) {
+// execute runs the instruction in the execution directory and returns its output, which is also written to the log
+// when it is not nil. The sensitive values of the instruction are masked by the redactor in everything that is logged
+// and in the output.
+func (a *Applyinator) execute(ctx context.Context, prefix, executionDir string, instruction planapi.CommonInstruction, extensions InstructionExtensions, combinedOutput bool, attempt int, log *instructionLog, redactor *redactor) (executionResult, error) {
+	var status ExecutionStatus
+	securityContext := a.options.SecurityContext.merge(extensions.SecurityContext)
 	if instruction.Image == "" {
 		logrus.Infof("[Applyinator] No image provided, creating empty working directory %s", executionDir)
 		if err := createDirectory(planapi.File{Directory: true, Path: executionDir}); err != nil {
 			logrus.Errorf("error while creating empty working directory: %v", err)
-			return nil, nil, -1, err
+			return executionResult{exitCode: -1}, err
 		}
 	} else {
+		if err := a.checkImageReference(instruction.Image, extensions.ImageDigests); err != nil {
+			logrus.Errorf("error while checking image reference: %v", err)
+			return executionResult{exitCode: -1}, err
+		}
 		logrus.Infof("[Applyinator] Extracting image %s to directory %s", instruction.Image, executionDir)
-		if err := a.imageUtil.Stage(executionDir, instruction.Image); err != nil {
+		stage := a.imageUtil.Stage
+		if securityContext.changesOwner() {
+			// The working directory is given to the user of the instruction, so it must not share the files of the
+			// image cache.
+			stage = a.imageUtil.StageCopy
+		}
+		staged, err := stage(ctx, executionDir, instruction.Image)
+		status.ImageDigest = staged.Digest
+		status.ImageIndexDigest = staged.IndexDigest
+		status.ImageSignature = staged.Signature
+		log.setImageDigest(staged.Digest, staged.IndexDigest)
+		if err != nil {
 			logrus.Errorf("error while staging: %v", err)
-			return nil, nil, -1, err
+			var pullErr *image.PullError
+			if errors.As(err, &pullErr) {
+				status.ImagePullError = pullErr
+			}
+			return executionResult{exitCode: -1, status: status}, err
+		}
+		if err := checkImageDigest(instruction.Image, staged.Digest, staged.IndexDigest, extensions.ImageDigests); err != nil {
+			logrus.Errorf("error while checking image digest: %v", err)
+			return executionResult{exitCode: -1, status: status}, err
+		}
+		if staged.IndexDigest != "" {
+			logrus.Infof("[Applyinator] Image %s resolved to digest %s of index %s", instruction.Image, staged.Digest, staged.IndexDigest)
+		} else {
+			logrus.Infof("[Applyinator] Image %s resolved to digest %s", instruction.Image, staged.Digest)
 		}
 	}
 
@@ -473,35 +934,78 @@ func (a *Applyinator) execute(ctx context.Context, prefix, executionDir string,
 		command = executionDir + defaultCommand
 	}
 
-	cmd := exec.CommandContext(ctx, command, instruction.Args...)
-	logrus.Infof("[Applyinator] Running command: %s %v", instruction.Command, instruction.Args)
+	timeout := a.options.InstructionTimeout
+	if extensions.TimeoutSeconds > 0 {
+		timeout = time.Duration(extensions.TimeoutSeconds) * time.Second
+	}
+	execCtx := ctx
+	if timeout > 0 {
+		logrus.Debugf("[Applyinator] Running command with a timeout of %s", timeout.String())
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(execCtx, command, instruction.Args...)
+	redacted := redactor.redactInstruction(instruction)
+	logrus.Infof("[Applyinator] Running command: %s %v", redacted.Command, redacted.Args)
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, instruction.Env...)
 	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", cattleAgentExecutionPwdEnvKey, executionDir))
 	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", cattleAgentAttemptKey, attempt))
 	cmd.Env = append(cmd.Env, "PATH="+os.Getenv("PATH")+":"+executionDir)
 	cmd.Dir = executionDir
+	stopTermination := setProcessGroupTermination(cmd, a.options.TerminationGracePeriod)
+	if err := applySecurityContext(cmd, securityContext); err != nil {
+		logrus.Errorf("error while applying security context: %v", err)
+		return executionResult{exitCode: -1}, err
+	}
+	if securityContext.changesOwner() {
+		uid, gid := securityContext.owner()
+		logrus.Debugf("[Applyinator] Changing owner of working directory %s to %d:%d", executionDir, uid, gid)
+		if err := chownRecursive(executionDir, uid, gid); err != nil {
+			logrus.Errorf("error while changing owner of working directory: %v", err)
+			return executionResult{exitCode: -1}, err
+		}
+	}
+
+	var cgroup *instructionCgroup
+	if a.options.Cgroup.Enabled {
+		var err error
+		cgroup, err = newInstructionCgroup(a.options.Cgroup, fmt.Sprintf("%s-%d", prefix, time.Now().UnixNano()))
+		if err != nil {
+			logrus.Errorf("error while creating cgroup for instruction: %v", err)
+			return executionResult{exitCode: -1}, err
+		}
+		defer cgroup.remove()
+		cgroup.addCommand(cmd)
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		logrus.Errorf("error setting up stdout pipe: %v", err)
-		return nil, nil, -1, err
+		return executionResult{exitCode: -1}, err
 	}
 	defer stdout.Close()
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		logrus.Errorf("error setting up stderr pipe: %v", err)
-		return nil, nil, -1, err
+		return executionResult{exitCode: -1}, err
 	}
 	defer stderr.Close()
 
+	outputLimit := a.options.InstructionOutputMaxBytes
+	if extensions.OutputMaxBytes > 0 {
+		outputLimit = extensions.OutputMaxBytes
+	}
+
 	var (
 		eg              = errgroup.Group{}
 		stdoutWriteLock *sync.Mutex
 		stderrWriteLock *sync.Mutex
-		stdoutBuffer    bytes.Buffer
-		stderrBuffer    bytes.Buffer
+		stdoutBuffer    = outputBuffer{limit: outputLimit}
+		stderrBuffer    = outputBuffer{limit: outputLimit}
 	)
 
 	if combinedOutput {
@@ -514,39 +1018,60 @@ func (a *Applyinator) execute(ctx context.Context, prefix, executionDir string,
 	}
 
 	eg.Go(func() error {
-		return streamLogs("["+prefix+":stdout]", &stdoutBuffer, stdout, stdoutWriteLock)
+		return streamLogs("["+prefix+":stdout]", &stdoutBuffer, stdout, stdoutWriteLock, log.stream("stdout"), redactor)
 	})
 	eg.Go(func() error {
-		return streamLogs("["+prefix+":stderr]", &stderrBuffer, stderr, stderrWriteLock)
+		return streamLogs("["+prefix+":stderr]", &stderrBuffer, stderr, stderrWriteLock, log.stream("stderr"), redactor)
 	})
 
-	if err := cmd.Start(); err != nil {
-		return nil, nil, -1, err
+	if err := startCommand(cmd, securityContext); err != nil {
+		return executionResult{exitCode: -1}, err
 	}
 
 	// Wait for I/O to complete before calling cmd.Wait() because cmd.Wait() will close the I/O pipes.
-	_ = eg.Wait()
-	exitCode := 0
-	if err := cmd.Wait(); err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			exitCode = ee.ExitCode()
+	if err := eg.Wait(); err != nil {
+		logrus.Errorf("[Applyinator] error reading output of command %s %v: %v", redacted.Command, redacted.Args, err)
+	}
+	result := executionResult{status: status}
+	waitErr := cmd.Wait()
+	stopTermination()
+	if waitErr != nil {
+		if ee, ok := waitErr.(*exec.ExitError); ok {
+			result.exitCode = ee.ExitCode()
 		} else {
-			exitCode = -1
+			result.exitCode = -1
 		}
 	}
-	logrus.Infof("[Applyinator] Command %s %v finished with err: %v and exit code: %d", instruction.Command, instruction.Args, err, exitCode)
-	return stdoutBuffer.Bytes(), stderrBuffer.Bytes(), exitCode, err
+	if cgroup != nil {
+		cgroup.recordUsage(&result.status)
+	}
+	if errors.Is(execCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		logrus.Errorf("[Applyinator] Command %s %v timed out after %s", redacted.Command, redacted.Args, timeout.String())
+		result.status.TimedOut = true
+		if result.exitCode == 0 {
+			result.exitCode = -1
+		}
+	}
+	logrus.Infof("[Applyinator] Command %s %v finished with err: %v and exit code: %d", redacted.Command, redacted.Args, err, result.exitCode)
+	if truncated := stdoutBuffer.truncated + stderrBuffer.truncated; truncated > 0 {
+		logrus.Infof("[Applyinator] Output of command %s %v exceeded %d bytes, %d bytes were truncated", redacted.Command, redacted.Args, outputLimit, truncated)
+	}
+	result.stdout = stdoutBuffer.Bytes()
+	result.stderr = stderrBuffer.Bytes()
+	return result, err
 }
 
-// streamLogs accepts a prefix, outputBuffer, reader, and buffer lock and will scan input from the reader and write it
-// to the output buffer while also logging anything that comes from the reader with the prefix.
-func streamLogs(prefix string, outputBuffer *bytes.Buffer, reader io.Reader, lock *sync.Mutex) error {
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		logrus.Infof("%s: %s", prefix, scanner.Text())
+// streamLogs accepts a prefix, outputBuffer, reader, buffer lock, and instruction log and will scan input from the
+// reader and write it to the output buffer and instruction log while also logging anything that comes from the reader
+// with the prefix. The output buffer enforces the output limit of the instruction, while the full output is still
+// logged. Every line is masked by the redactor first, and lines that are too long are split into chunks.
+func streamLogs(prefix string, outputBuffer *outputBuffer, reader io.Reader, lock *sync.Mutex, log io.Writer, redactor *redactor) error {
+	return readLines(reader, func(line []byte) {
+		line = append(redactor.redact(line), '\n')
+		logrus.Infof("%s: %s", prefix, line[:len(line)-1])
+		_, _ = log.Write(line)
 		lock.Lock()
-		outputBuffer.Write(append(scanner.Bytes(), []byte("\n")...))
+		outputBuffer.Write(line)
 		lock.Unlock()
-	}
-	return nil
+	})
 }
@@ -0,0 +1,88 @@
+package applyinator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Backup is a snapshot of the files of a plan kept in the backup directory, taken before the files were reconciled.
+type Backup struct {
+	// ID is the timestamp and checksum of the plan the backup was taken for.
+	ID       string
+	Checksum string
+	// CreatedAt is the time the backup was taken.
+	CreatedAt time.Time
+	// Paths are the paths that restoring the backup returns to their previous state.
+	Paths []string
+}
+
+// snapshotFiles snapshots the paths that reconciling the files would touch, into the backup directory if one is
+// configured and the work directory otherwise, and applies the retention policy of that directory.
+func (a *Applyinator) snapshotFiles(id, checksum string, files []planFile) (*fileSnapshot, error) {
+	root, retention := filepath.Join(a.workDir, snapshotsDirName), snapshotRetentionCount
+	if a.options.BackupDir != "" {
+		root, retention = a.options.BackupDir, a.options.BackupRetentionCount
+	}
+	logrus.Debugf("[Applyinator] Snapshotting files of plan %s to %s", checksum, root)
+	snapshot, err := newFileSnapshot(root, id, checksum, files)
+	if err != nil {
+		return nil, err
+	}
+	if err := pruneDirectories(root, retention, "file snapshot"); err != nil {
+		logrus.Errorf("error while applying file snapshot retention policy: %v", err)
+	}
+	return snapshot, nil
+}
+
+// ListBackups returns the backups in the backup directory, oldest first.
+func ListBackups(backupDir string) ([]Backup, error) {
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var backups []Backup
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		snapshot, err := loadFileSnapshot(backupDir, entry.Name())
+		if err != nil {
+			logrus.Warnf("[Applyinator] Skipping backup %s: %v", entry.Name(), err)
+			continue
+		}
+		backup := Backup{
+			ID:       snapshot.ID,
+			Checksum: snapshot.Checksum,
+		}
+		if len(snapshot.ID) >= len(applyinatorDateCodeLayout) {
+			backup.CreatedAt, _ = time.ParseInLocation(applyinatorDateCodeLayout, snapshot.ID[:len(applyinatorDateCodeLayout)], time.Local)
+		}
+		for _, snapshotEntry := range snapshot.Entries {
+			backup.Paths = append(backup.Paths, snapshotEntry.Path)
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ID < backups[j].ID
+	})
+	return backups, nil
+}
+
+// RestoreBackup returns every path in the backup to the state it was in before the plan was applied, and removes the
+// paths that the plan created. Paths that changed since the plan wrote them are left alone and returned. Directories
+// that are not empty are only removed with force, which also restores backups that do not record what the plan wrote.
+func RestoreBackup(backupDir, id string, force bool) ([]string, error) {
+	snapshot, err := loadFileSnapshot(backupDir, id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load backup %s: %w", id, err)
+	}
+	return snapshot.restoreBackup(force)
+}
@@ -0,0 +1,196 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestBackups(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-backup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	backupDir := filepath.Join(tempDir, "backups")
+	overwritten := filepath.Join(tempDir, "overwritten")
+	deleted := filepath.Join(tempDir, "deleted")
+	if err := os.WriteFile(overwritten, []byte("original"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(deleted, []byte("deleted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewApplyinator(filepath.Join(tempDir, "work"), false, "", "", nil, Options{
+		BackupDir:            backupDir,
+		BackupRetentionCount: 2,
+	})
+	apply := func(content, checksum string) string {
+		output, err := a.Apply(context.Background(), ApplyInput{
+			CalculatedPlan: CalculatedPlan{
+				Plan: planapi.Plan{Files: []planapi.File{
+					{Path: overwritten, Content: base64.StdEncoding.EncodeToString([]byte(content)), UID: -1, GID: -1},
+					{Path: deleted, Action: deleteFileAction},
+				}},
+				Checksum: checksum,
+			},
+			ReconcileFiles: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return output.SnapshotID
+	}
+
+	first := apply("first", "checksum1")
+	apply("second", "checksum2")
+	apply("third", "checksum3")
+
+	backups, err := ListBackups(backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups to be retained, found %d", len(backups))
+	}
+	for _, backup := range backups {
+		if backup.ID == first {
+			t.Errorf("expected the oldest backup %s to be removed", first)
+		}
+		if backup.CreatedAt.IsZero() {
+			t.Errorf("expected creation time of backup %s to be parsed", backup.ID)
+		}
+		if len(backup.Paths) != 2 {
+			t.Errorf("expected backup %s to hold 2 paths, found %v", backup.ID, backup.Paths)
+		}
+	}
+	if backups[1].Checksum != "checksum3" {
+		t.Errorf("expected newest backup to be of checksum3, found %s", backups[1].Checksum)
+	}
+
+	if _, err := RestoreBackup(backupDir, backups[1].ID, false); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(overwritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "second" {
+		t.Errorf("expected restored content %q, found %q", "second", content)
+	}
+
+	if _, err := RestoreBackup(backupDir, "../work", false); err == nil {
+		t.Error("expected restoring a backup outside the backup directory to fail")
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	testCases := []struct {
+		Name        string
+		ModifyFile  bool
+		AddToDir    bool
+		Force       bool
+		ExpectedErr bool
+
+		ExpectedContent string
+		ExpectedSkipped []string
+		ExpectedDir     bool
+	}{
+		{
+			Name:            "unchanged",
+			ExpectedContent: "original",
+		},
+		{
+			Name:            "modified file",
+			ModifyFile:      true,
+			ExpectedContent: "modified",
+			ExpectedSkipped: []string{"overwritten"},
+		},
+		{
+			Name:            "content added to created directory",
+			AddToDir:        true,
+			ExpectedErr:     true,
+			ExpectedContent: "original",
+			ExpectedDir:     true,
+		},
+		{
+			Name:            "content added to created directory with force",
+			AddToDir:        true,
+			Force:           true,
+			ExpectedContent: "original",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			backupDir := filepath.Join(tempDir, "backups")
+			overwritten := filepath.Join(tempDir, "overwritten")
+			createdDir := filepath.Join(tempDir, "created")
+			created := filepath.Join(createdDir, "nested", "file")
+			if err := os.WriteFile(overwritten, []byte("original"), 0640); err != nil {
+				t.Fatal(err)
+			}
+
+			a := NewApplyinator(filepath.Join(tempDir, "work"), false, "", "", nil, Options{BackupDir: backupDir})
+			output, err := a.Apply(context.Background(), ApplyInput{
+				CalculatedPlan: CalculatedPlan{
+					Plan: planapi.Plan{Files: []planapi.File{
+						{Path: overwritten, Content: base64.StdEncoding.EncodeToString([]byte("planned")), UID: -1, GID: -1},
+						{Path: created, Content: base64.StdEncoding.EncodeToString([]byte("planned")), UID: -1, GID: -1},
+					}},
+					Checksum: "checksum",
+				},
+				ReconcileFiles: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.ModifyFile {
+				if err := os.WriteFile(overwritten, []byte("modified"), 0640); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.AddToDir {
+				if err := os.WriteFile(filepath.Join(createdDir, "added"), []byte("added"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			skipped, err := RestoreBackup(backupDir, output.SnapshotID, tc.Force)
+			if tc.ExpectedErr != (err != nil) {
+				t.Fatalf("expected error %t, found %v", tc.ExpectedErr, err)
+			}
+			var expectedSkipped []string
+			for _, path := range tc.ExpectedSkipped {
+				expectedSkipped = append(expectedSkipped, filepath.Join(tempDir, path))
+			}
+			if !reflect.DeepEqual(skipped, expectedSkipped) {
+				t.Errorf("expected skipped paths %v, found %v", expectedSkipped, skipped)
+			}
+			content, err := os.ReadFile(overwritten)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tc.ExpectedContent {
+				t.Errorf("expected content %q, found %q", tc.ExpectedContent, content)
+			}
+			if _, err := os.Stat(created); !os.IsNotExist(err) {
+				t.Errorf("expected the file created by the plan to be removed, found %v", err)
+			}
+			if _, err := os.Stat(createdDir); tc.ExpectedDir != (err == nil) {
+				t.Errorf("expected the directory created by the plan to remain %t, found %v", tc.ExpectedDir, err)
+			}
+		})
+	}
+}
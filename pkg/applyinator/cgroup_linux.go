@@ -0,0 +1,184 @@
+//go:build linux
+
+package applyinator
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cgroupV2MountPoint   = "/sys/fs/cgroup"
+	cgroupCPUPeriod      = 100000 // cpu.max period in microseconds
+	cgroupRemoveAttempts = 10
+)
+
+// cgroupAccountingControllers are enabled when they are available, so that the usage of instructions is recorded even
+// when it is not limited.
+var cgroupAccountingControllers = []string{"memory"}
+
+// instructionCgroup is a transient cgroup v2 that an instruction is run in.
+type instructionCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// newInstructionCgroup creates a cgroup named name below the configured cgroup root and applies the configured limits.
+func newInstructionCgroup(options CgroupOptions, name string) (*instructionCgroup, error) {
+	if _, err := os.Stat(filepath.Join(cgroupV2MountPoint, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup v2 is not mounted at %s: %w", cgroupV2MountPoint, err)
+	}
+
+	root := options.Root
+	if root == "" {
+		root = filepath.Join(cgroupV2MountPoint, defaultCgroupName)
+	}
+	if err := os.MkdirAll(root, defaultDirectoryPermissions); err != nil {
+		return nil, fmt.Errorf("unable to create cgroup root %s: %w", root, err)
+	}
+	if err := enableCgroupControllers(root, options.controllers()); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(root, name)
+	if err := os.Mkdir(path, defaultDirectoryPermissions); err != nil {
+		return nil, fmt.Errorf("unable to create cgroup %s: %w", path, err)
+	}
+	c := &instructionCgroup{path: path}
+
+	limits := map[string]string{}
+	if options.MemoryMax > 0 {
+		limits["memory.max"] = strconv.FormatInt(options.MemoryMax, 10)
+		// Do not let the instruction push the rest of the node into swap instead of being OOM killed.
+		limits["memory.swap.max"] = "0"
+	}
+	if options.CPUMillicores > 0 {
+		limits["cpu.max"] = fmt.Sprintf("%d %d", options.CPUMillicores*cgroupCPUPeriod/1000, cgroupCPUPeriod)
+	}
+	if options.PidsMax > 0 {
+		limits["pids.max"] = strconv.FormatInt(options.PidsMax, 10)
+	}
+	for file, value := range limits {
+		logrus.Debugf("[Applyinator] Setting %s to %s for cgroup %s", file, value, path)
+		if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+			if file == "memory.swap.max" && os.IsNotExist(err) {
+				continue
+			}
+			c.remove()
+			return nil, fmt.Errorf("unable to set %s for cgroup %s: %w", file, path, err)
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		c.remove()
+		return nil, err
+	}
+	c.dir = dir
+	return c, nil
+}
+
+// controllers returns the controllers that the configured limits need.
+func (o CgroupOptions) controllers() []string {
+	var controllers []string
+	if o.CPUMillicores > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if o.MemoryMax > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if o.PidsMax > 0 {
+		controllers = append(controllers, "pids")
+	}
+	return controllers
+}
+
+// enableCgroupControllers delegates the required controllers of root to its children, along with the accounting
+// controllers that are available. A required controller that is not available is an error.
+func enableCgroupControllers(root string, required []string) error {
+	data, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("unable to read controllers of cgroup %s: %w", root, err)
+	}
+	available := strings.Fields(string(data))
+	var enable []string
+	for _, controller := range required {
+		if !slices.Contains(available, controller) {
+			return fmt.Errorf("controller %s is not available in cgroup %s", controller, root)
+		}
+		enable = append(enable, "+"+controller)
+	}
+	for _, controller := range cgroupAccountingControllers {
+		if slices.Contains(available, controller) && !slices.Contains(required, controller) {
+			enable = append(enable, "+"+controller)
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644); err != nil {
+		return fmt.Errorf("unable to enable controllers for cgroup %s: %w", root, err)
+	}
+	return nil
+}
+
+// addCommand arranges for the command to be started directly inside the cgroup.
+func (c *instructionCgroup) addCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(c.dir.Fd())
+}
+
+// recordUsage reads the peak memory and total CPU time consumed by the cgroup into status.
+func (c *instructionCgroup) recordUsage(status *ExecutionStatus) {
+	if peak, err := os.ReadFile(filepath.Join(c.path, "memory.peak")); err == nil {
+		if v, err := strconv.ParseInt(strings.TrimSpace(string(peak)), 10, 64); err == nil {
+			status.PeakMemoryBytes = v
+		}
+	} else {
+		logrus.Debugf("[Applyinator] Unable to read peak memory of cgroup %s: %v", c.path, err)
+	}
+
+	cpuStat, err := os.ReadFile(filepath.Join(c.path, "cpu.stat"))
+	if err != nil {
+		logrus.Debugf("[Applyinator] Unable to read cpu statistics of cgroup %s: %v", c.path, err)
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(cpuStat))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				status.CPUTimeSeconds = float64(v) / float64(time.Second/time.Microsecond)
+			}
+		}
+	}
+}
+
+// remove kills any process left in the cgroup and removes it.
+func (c *instructionCgroup) remove() {
+	if c.dir != nil {
+		c.dir.Close()
+	}
+	if err := os.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644); err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("[Applyinator] Unable to kill processes in cgroup %s: %v", c.path, err)
+	}
+	// Removal fails with EBUSY until the killed processes have exited, so retry for a short while.
+	var err error
+	for i := 0; i < cgroupRemoveAttempts; i++ {
+		if err = os.Remove(c.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	logrus.Errorf("unable to remove cgroup %s: %v", c.path, err)
+}
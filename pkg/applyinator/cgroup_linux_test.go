@@ -0,0 +1,139 @@
+//go:build linux
+
+package applyinator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestEnableCgroupControllers(t *testing.T) {
+	testCases := []struct {
+		Name      string
+		Available string
+		Options   CgroupOptions
+
+		ExpectedSubtreeControl string
+		ExpectError            bool
+	}{
+		{
+			Name:                   "no limits",
+			Available:              "cpuset cpu io memory pids",
+			ExpectedSubtreeControl: "+memory",
+		},
+		{
+			Name:                   "pids limit",
+			Available:              "cpuset cpu io memory pids",
+			Options:                CgroupOptions{PidsMax: 10},
+			ExpectedSubtreeControl: "+pids +memory",
+		},
+		{
+			Name:                   "all limits",
+			Available:              "cpu memory pids",
+			Options:                CgroupOptions{CPUMillicores: 500, MemoryMax: 1 << 20, PidsMax: 10},
+			ExpectedSubtreeControl: "+cpu +memory +pids",
+		},
+		{
+			Name:                   "unused controller unavailable",
+			Available:              "pids",
+			Options:                CgroupOptions{PidsMax: 10},
+			ExpectedSubtreeControl: "+pids",
+		},
+		{
+			Name:        "required controller unavailable",
+			Available:   "memory pids",
+			Options:     CgroupOptions{CPUMillicores: 500},
+			ExpectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			root := t.TempDir()
+			if err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), []byte(tc.Available+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := enableCgroupControllers(root, tc.Options.controllers())
+			if tc.ExpectError {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			subtreeControl, err := os.ReadFile(filepath.Join(root, "cgroup.subtree_control"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(subtreeControl) != tc.ExpectedSubtreeControl {
+				t.Errorf("expected subtree control %q, found %q", tc.ExpectedSubtreeControl, subtreeControl)
+			}
+		})
+	}
+}
+
+func TestExecuteCgroup(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must be run as root to create cgroups")
+	}
+	available, err := os.ReadFile(filepath.Join(cgroupV2MountPoint, "cgroup.controllers"))
+	if err != nil {
+		t.Skipf("cgroup v2 is not mounted at %s", cgroupV2MountPoint)
+	}
+	for _, controller := range []string{"memory", "pids"} {
+		if !strings.Contains(" "+strings.TrimSpace(string(available))+" ", " "+controller+" ") {
+			t.Skipf("controller %s is not available", controller)
+		}
+	}
+
+	tempDir, err := os.MkdirTemp("", "test-cgroup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	root, err := os.MkdirTemp(cgroupV2MountPoint, "test-system-agent-")
+	if err != nil {
+		t.Skipf("unable to create cgroup root: %v", err)
+	}
+	defer os.Remove(root)
+
+	options := CgroupOptions{Enabled: true, Root: root, MemoryMax: 64 << 20, PidsMax: 16}
+	a := NewApplyinator(tempDir, true, "", "", nil, Options{Cgroup: options})
+
+	// The instruction reports the cgroup it runs in and its limits.
+	script := `cg=/sys/fs/cgroup$(cut -d: -f3 /proc/self/cgroup); echo $cg; cat $cg/memory.max $cg/pids.max; head -c 1048576 /dev/zero | tail -c 1 >/dev/null`
+	result, err := a.execute(context.Background(), "cgroup", filepath.Join(tempDir, "cgroup"), planapi.CommonInstruction{
+		Command: "/bin/sh",
+		Args:    []string{"-c", script},
+	}, InstructionExtensions{}, true, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.exitCode != 0 {
+		t.Fatalf("expected exit code 0, found %d with output %s", result.exitCode, result.stdout)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(result.stdout)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected the cgroup and its limits, found %q", result.stdout)
+	}
+	if filepath.Dir(lines[0]) != root {
+		t.Errorf("expected instruction to run in a cgroup below %s, found %s", root, lines[0])
+	}
+	if lines[1] != "67108864" || lines[2] != "16" {
+		t.Errorf("expected memory.max 67108864 and pids.max 16, found %s and %s", lines[1], lines[2])
+	}
+	if result.status.PeakMemoryBytes <= 0 {
+		t.Errorf("expected peak memory to be recorded, found %d", result.status.PeakMemoryBytes)
+	}
+	if _, err := os.Stat(lines[0]); !os.IsNotExist(err) {
+		t.Errorf("expected cgroup %s to be removed, found %v", lines[0], err)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package applyinator
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// instructionCgroup is not supported outside of Linux.
+type instructionCgroup struct{}
+
+func newInstructionCgroup(_ CgroupOptions, _ string) (*instructionCgroup, error) {
+	return nil, fmt.Errorf("cgroup isolation of instructions is only supported on linux")
+}
+
+func (c *instructionCgroup) addCommand(_ *exec.Cmd) {}
+
+func (c *instructionCgroup) recordUsage(_ *ExecutionStatus) {}
+
+func (c *instructionCgroup) remove() {}
@@ -0,0 +1,115 @@
+package applyinator
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FileDigestMismatch is a file whose content does not have the digest given in the plan.
+type FileDigestMismatch struct {
+	Path     string `json:"path"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// DigestMismatchError is returned by Apply when the content of any file does not have its digest. No file is written.
+type DigestMismatchError struct {
+	Files []FileDigestMismatch
+}
+
+func (e *DigestMismatchError) Error() string {
+	mismatches := make([]string, 0, len(e.Files))
+	for _, file := range e.Files {
+		mismatches = append(mismatches, fmt.Sprintf("%s has digest %s, expected %s", file.Path, file.Actual, file.Expected))
+	}
+	return "content digest mismatch: " + strings.Join(mismatches, "; ")
+}
+
+// verifyContentDigest returns a DigestMismatchError if the decoded content of the file does not have its digest.
+func verifyContentDigest(file planFile) error {
+	digest, err := parseContentDigest(file.Extensions.Digest)
+	if err != nil {
+		return fmt.Errorf("invalid digest of file %s: %w", file.Path, err)
+	}
+	content, err := base64.StdEncoding.DecodeString(file.Content)
+	if err != nil {
+		return fmt.Errorf("unable to decode content of file %s: %w", file.Path, err)
+	}
+	if actual := digest.digestBytes(content); actual != digest.hex {
+		logrus.Errorf("[Applyinator] Content of file %s has digest %s:%s, expected %s", file.Path, digest.algorithm, actual, digest)
+		return &DigestMismatchError{Files: []FileDigestMismatch{{
+			Path:     file.Path,
+			Expected: digest.String(),
+			Actual:   digest.algorithm + ":" + actual,
+		}}}
+	}
+	return nil
+}
+
+// contentDigest is a parsed digest of file content.
+type contentDigest struct {
+	algorithm string
+	hex       string
+}
+
+func (d contentDigest) String() string {
+	return d.algorithm + ":" + d.hex
+}
+
+func (d contentDigest) newHash() hash.Hash {
+	if d.algorithm == "sha512" {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// parseContentDigest parses a digest of the form sha256:<hex> or sha512:<hex>.
+func parseContentDigest(digest string) (contentDigest, error) {
+	algorithm, hexDigest, ok := strings.Cut(digest, ":")
+	if !ok {
+		return contentDigest{}, fmt.Errorf("digest %q is not of the form <algorithm>:<hex>", digest)
+	}
+	var size int
+	switch algorithm {
+	case "sha256":
+		size = sha256.Size
+	case "sha512":
+		size = sha512.Size
+	default:
+		return contentDigest{}, fmt.Errorf("digest %q has unsupported algorithm %s", digest, algorithm)
+	}
+	if decoded, err := hex.DecodeString(hexDigest); err != nil || len(decoded) != size {
+		return contentDigest{}, fmt.Errorf("digest %q is not a valid %s digest", digest, algorithm)
+	}
+	return contentDigest{algorithm: algorithm, hex: strings.ToLower(hexDigest)}, nil
+}
+
+// digestBytes returns the digest of content using the algorithm of d.
+func (d contentDigest) digestBytes(content []byte) string {
+	h := d.newHash()
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestFile returns the digest of the content of the file at path using the algorithm of d.
+func (d contentDigest) digestFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := d.newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,107 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestApplyFileDigest(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-digest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	content := []byte("planned")
+	sha256Digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+	sha512Digest := fmt.Sprintf("sha512:%x", sha512.Sum512(content))
+	otherDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))
+
+	testCases := []struct {
+		Name    string
+		Digests []string
+
+		ExpectedMismatches []string
+		ExpectedErr        bool
+	}{
+		{
+			Name:    "sha256",
+			Digests: []string{sha256Digest},
+		},
+		{
+			Name:    "sha512",
+			Digests: []string{sha512Digest},
+		},
+		{
+			Name:    "mismatch",
+			Digests: []string{sha256Digest, otherDigest},
+
+			ExpectedMismatches: []string{"1"},
+			ExpectedErr:        true,
+		},
+		{
+			Name:    "invalid digest",
+			Digests: []string{"sha1:abc"},
+
+			ExpectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			root := filepath.Join(tempDir, filepath.Base(tc.Name))
+			a := NewApplyinator(filepath.Join(root, "work"), false, "", "", nil, Options{})
+			cp := CalculatedPlan{Checksum: "checksum"}
+			for i, digest := range tc.Digests {
+				cp.Plan.Files = append(cp.Plan.Files, planapi.File{Path: filepath.Join(root, fmt.Sprint(i)), Content: base64.StdEncoding.EncodeToString(content), UID: -1, GID: -1})
+				cp.Extensions.Files = append(cp.Extensions.Files, FileExtensions{Digest: digest})
+			}
+
+			_, err := a.Apply(context.Background(), ApplyInput{CalculatedPlan: cp, ReconcileFiles: true})
+			if tc.ExpectedErr {
+				if err == nil {
+					t.Fatal("expected error, returned successfully")
+				}
+				var mismatch *DigestMismatchError
+				if errors.As(err, &mismatch) != (len(tc.ExpectedMismatches) > 0) {
+					t.Fatalf("expected %d mismatched files, found error %v", len(tc.ExpectedMismatches), err)
+				}
+				for i, path := range tc.ExpectedMismatches {
+					if mismatch.Files[i].Path != filepath.Join(root, path) || mismatch.Files[i].Expected != otherDigest || mismatch.Files[i].Actual != sha256Digest {
+						t.Errorf("unexpected mismatch %v", mismatch.Files[i])
+					}
+				}
+				// No file is written when any file does not match its digest.
+				for _, file := range cp.Plan.Files {
+					if _, err := os.Stat(file.Path); !os.IsNotExist(err) {
+						t.Errorf("expected %s not to be written: %v", file.Path, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, file := range cp.Plan.Files {
+				written, err := os.ReadFile(file.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(written) != string(content) {
+					t.Errorf("expected content %q, found %q", content, written)
+				}
+			}
+		})
+	}
+}
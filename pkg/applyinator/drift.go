@@ -0,0 +1,139 @@
+package applyinator
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DriftPolicy determines what happens when the files of an applied plan have drifted from the plan.
+type DriftPolicy string
+
+const (
+	// DriftPolicyReport only reports the drifted files.
+	DriftPolicyReport DriftPolicy = "report"
+	// DriftPolicyReapply reports the drifted files and writes them again.
+	DriftPolicyReapply DriftPolicy = "reapply"
+)
+
+// FileDriftReport is the result of the last file drift check of a plan, stored as json in ApplyOutput.FileDrift.
+type FileDriftReport struct {
+	CheckedAt string      `json:"checkedAt"`
+	Files     []FileDrift `json:"files,omitempty"`
+	// Error is set when the files of the plan could not be rendered to check them, or when reapplying the drifted files
+	// failed, in which case they were rolled back.
+	Error string `json:"error,omitempty"`
+}
+
+// FileDrift describes how a file on disk differs from the plan.
+type FileDrift struct {
+	Path      string     `json:"path"`
+	Change    FileChange `json:"change,omitempty"`
+	Details   []string   `json:"details,omitempty"`
+	Reapplied bool       `json:"reapplied,omitempty"`
+	// Error is set when the file could not be compared against the plan.
+	Error string `json:"error,omitempty"`
+}
+
+// driftCheckDue returns true if drift detection is enabled and the drift check interval has elapsed since the previous
+// check, or the files of the plan are being reconciled.
+func (a *Applyinator) driftCheckDue(now time.Time, input ApplyInput) bool {
+	if a.options.FileDriftCheckInterval <= 0 {
+		return false
+	}
+	if input.ReconcileFiles || len(input.ExistingFileDrift) == 0 {
+		return true
+	}
+	var previous FileDriftReport
+	if err := json.Unmarshal(input.ExistingFileDrift, &previous); err != nil {
+		logrus.Errorf("error parsing existing file drift report: %v", err)
+		return true
+	}
+	checkedAt, err := time.Parse(time.UnixDate, previous.CheckedAt)
+	return err != nil || !now.Before(checkedAt.Add(a.options.FileDriftCheckInterval))
+}
+
+// checkFileDrift compares the files of the plan against the disk and reapplies the drifted files if the drift policy
+// says so. Files that were just reconciled have not drifted. It returns the json-marshalled FileDriftReport.
+func (a *Applyinator) checkFileDrift(now time.Time, input ApplyInput, files []planFile) []byte {
+	report := FileDriftReport{
+		CheckedAt: now.Format(time.UnixDate),
+	}
+	if !input.ReconcileFiles {
+		logrus.Debugf("[Applyinator] Checking files of plan %s for drift", input.CalculatedPlan.Checksum)
+		var drifted []planFile
+		for _, file := range files {
+			if file.Action == deleteFileAction {
+				continue
+			}
+			filePreview, err := previewFile(file, false)
+			if err != nil {
+				logrus.Errorf("error checking file %s for drift: %v", file.Path, err)
+				report.Files = append(report.Files, FileDrift{Path: file.Path, Error: err.Error()})
+				continue
+			}
+			if filePreview.Change == FileChangeNone {
+				continue
+			}
+			logrus.Warnf("[Applyinator] File %s has drifted from plan %s: %s %s", file.Path, input.CalculatedPlan.Checksum, filePreview.Change, strings.Join(filePreview.Details, ", "))
+			report.Files = append(report.Files, FileDrift{
+				Path:    file.Path,
+				Change:  filePreview.Change,
+				Details: filePreview.Details,
+			})
+			drifted = append(drifted, file)
+		}
+
+		if len(drifted) > 0 && a.options.FileDriftPolicy == DriftPolicyReapply {
+			if err := a.reapplyDriftedFiles(now, input.CalculatedPlan.Checksum, drifted); err != nil {
+				logrus.Errorf("error reapplying drifted files of plan %s: %v", input.CalculatedPlan.Checksum, err)
+				report.Error = err.Error()
+			} else {
+				for i := range report.Files {
+					report.Files[i].Reapplied = report.Files[i].Error == ""
+				}
+			}
+		}
+	}
+
+	marshalledReport, err := json.Marshal(report)
+	if err != nil {
+		logrus.Errorf("error marshalling file drift report: %v", err)
+		return input.ExistingFileDrift
+	}
+	return marshalledReport
+}
+
+// reapplyDriftedFiles reconciles the drifted files, rolling them back to a snapshot if that fails.
+func (a *Applyinator) reapplyDriftedFiles(now time.Time, checksum string, files []planFile) error {
+	logrus.Infof("[Applyinator] Reapplying %d drifted files", len(files))
+	snapshot, err := a.snapshotFiles(now.Format(applyinatorDateCodeLayout)+"-"+checksum+"-drift", checksum, files)
+	if err != nil {
+		return err
+	}
+	if err := reconcileFiles(files); err != nil {
+		if err := snapshot.restore(); err != nil {
+			logrus.Errorf("error rolling back files to snapshot %s: %v", snapshot.ID, err)
+		}
+		return err
+	}
+	if err := snapshot.recordWritten(); err != nil {
+		logrus.Errorf("error recording the reconciled files in snapshot %s: %v", snapshot.ID, err)
+	}
+	return nil
+}
+
+// fileDriftError returns the json-marshalled FileDriftReport of a drift check that failed before any file was compared.
+func fileDriftError(now time.Time, err error) []byte {
+	marshalledReport, marshalErr := json.Marshal(FileDriftReport{
+		CheckedAt: now.Format(time.UnixDate),
+		Error:     err.Error(),
+	})
+	if marshalErr != nil {
+		logrus.Errorf("error marshalling file drift report: %v", marshalErr)
+		return nil
+	}
+	return marshalledReport
+}
@@ -0,0 +1,186 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestApplyFileDrift(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-drift-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	testCases := []struct {
+		Name   string
+		Policy DriftPolicy
+
+		ExpectedContent string
+	}{
+		{
+			Name:   "report",
+			Policy: DriftPolicyReport,
+
+			ExpectedContent: "edited",
+		},
+		{
+			Name:   "reapply",
+			Policy: DriftPolicyReapply,
+
+			ExpectedContent: "planned",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			root := filepath.Join(tempDir, tc.Name)
+			path := filepath.Join(root, "config.yaml")
+			a := NewApplyinator(filepath.Join(root, "work"), false, "", "", nil, Options{
+				FileDriftCheckInterval: time.Minute,
+				FileDriftPolicy:        tc.Policy,
+			})
+			input := ApplyInput{
+				CalculatedPlan: CalculatedPlan{
+					Plan: planapi.Plan{Files: []planapi.File{
+						{Path: path, Content: base64.StdEncoding.EncodeToString([]byte("planned")), UID: -1, GID: -1},
+					}},
+					Checksum: "checksum",
+				},
+				ReconcileFiles: true,
+			}
+
+			output, err := a.Apply(context.Background(), input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report := decodeDriftReport(t, output.FileDrift)
+			if len(report.Files) != 0 {
+				t.Errorf("expected no drift after reconciling files, found %v", report.Files)
+			}
+
+			if err := os.WriteFile(path, []byte("edited"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			// The drift check interval has not elapsed since the files were reconciled.
+			input.ReconcileFiles = false
+			input.ExistingFileDrift = output.FileDrift
+			output, err = a.Apply(context.Background(), input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output.FileDrift) != string(input.ExistingFileDrift) {
+				t.Errorf("expected drift report to be unchanged before the check interval elapsed, found %s", output.FileDrift)
+			}
+
+			report.CheckedAt = time.Now().Add(-time.Hour).Format(time.UnixDate)
+			input.ExistingFileDrift, err = json.Marshal(report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err = a.Apply(context.Background(), input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report = decodeDriftReport(t, output.FileDrift)
+			if len(report.Files) != 1 || report.Files[0].Path != path || report.Files[0].Change != FileChangeModify {
+				t.Fatalf("expected %s to be reported as changed, found %v", path, report.Files)
+			}
+			if report.Files[0].Reapplied != (tc.Policy == DriftPolicyReapply) {
+				t.Errorf("expected reapplied %t, found %t", tc.Policy == DriftPolicyReapply, report.Files[0].Reapplied)
+			}
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tc.ExpectedContent {
+				t.Errorf("expected content %q, found %q", tc.ExpectedContent, content)
+			}
+		})
+	}
+}
+
+func TestApplyFileDriftRenderError(t *testing.T) {
+	root := t.TempDir()
+	a := NewApplyinator(filepath.Join(root, "work"), false, "", "", nil, Options{
+		FileDriftCheckInterval: time.Minute,
+	})
+	checkedAt := time.Now().Format(time.UnixDate)
+	existingFileDrift, err := json.Marshal(FileDriftReport{CheckedAt: checkedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := ApplyInput{
+		CalculatedPlan: CalculatedPlan{
+			Plan: planapi.Plan{
+				Files: []planapi.File{
+					{Path: filepath.Join(root, "config.yaml"), Content: base64.StdEncoding.EncodeToString([]byte("{{ .Missing }}")), UID: -1, GID: -1},
+				},
+				PeriodicInstructions: []planapi.PeriodicInstruction{{
+					CommonInstruction: planapi.CommonInstruction{Name: "periodic", Command: "/bin/sh", Args: []string{"-c", "echo ran"}},
+				}},
+			},
+			Extensions: PlanExtensions{Files: []FileExtensions{{Template: true}}},
+			Checksum:   "checksum",
+		},
+		ExistingFileDrift: existingFileDrift,
+	}
+
+	// The files are not rendered before a drift check is due.
+	output, err := a.Apply(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output.FileDrift) != string(existingFileDrift) {
+		t.Errorf("expected drift report to be unchanged before the check interval elapsed, found %s", output.FileDrift)
+	}
+	assertPeriodicRan(t, output)
+
+	// A render error is reported as drift, and the periodic instructions keep running.
+	input.ExistingFileDrift, err = json.Marshal(FileDriftReport{CheckedAt: time.Now().Add(-time.Hour).Format(time.UnixDate)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err = a.Apply(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := decodeDriftReport(t, output.FileDrift); report.Error == "" {
+		t.Errorf("expected the render error to be reported, found %+v", report)
+	}
+	assertPeriodicRan(t, output)
+}
+
+func assertPeriodicRan(t *testing.T, output ApplyOutput) {
+	t.Helper()
+	if !output.PeriodicApplySucceeded {
+		t.Error("expected periodic instructions to succeed")
+	}
+	periodicOutputs, err := DecodePeriodicOutput(output.PeriodicOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout := string(periodicOutputs["periodic"].Stdout); stdout != "ran\n" {
+		t.Errorf("expected periodic instruction to run, found output %q", stdout)
+	}
+}
+
+func decodeDriftReport(t *testing.T, data []byte) FileDriftReport {
+	t.Helper()
+	var report FileDriftReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("unable to decode drift report %s: %v", data, err)
+	}
+	return report
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// setProcessGroupTermination places the command in its own process group so that, when the command context is done,
+// the whole group is sent SIGTERM and then SIGKILL once the grace period has elapsed. The returned function must be
+// called once cmd.Wait has returned, so that SIGKILL is not sent to a process group that may have reused the ID.
+func setProcessGroupTermination(cmd *exec.Cmd, gracePeriod time.Duration) func() {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// cmd.Wait does not return before cmd.Cancel has, so the timer is set by the time it is stopped.
+	var kill *time.Timer
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		logrus.Infof("[Applyinator] Sending SIGTERM to process group %d, SIGKILL will follow in %s", pgid, gracePeriod.String())
+		kill = time.AfterFunc(gracePeriod, func() {
+			if err := syscall.Kill(-pgid, syscall.SIGKILL); err == nil {
+				logrus.Infof("[Applyinator] Sent SIGKILL to process group %d", pgid)
+			}
+		})
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+	return func() {
+		if kill != nil {
+			kill.Stop()
+		}
+	}
+}
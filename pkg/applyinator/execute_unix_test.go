@@ -0,0 +1,89 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestExecuteTimeout(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-execute-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	a := NewApplyinator(tempDir, true, "", "", nil, Options{
+		InstructionTimeout:     time.Minute,
+		TerminationGracePeriod: 500 * time.Millisecond,
+	})
+
+	testCases := []struct {
+		Name       string
+		Args       []string
+		Extensions InstructionExtensions
+
+		ExpectedExitCode int
+		ExpectedTimedOut bool
+	}{
+		{
+			Name: "completes",
+			Args: []string{"-c", "exit 3"},
+
+			ExpectedExitCode: 3,
+		},
+		{
+			// Lines longer than the read buffer are still drained, instead of blocking the instruction.
+			Name:       "long line",
+			Args:       []string{"-c", "head -c 1000000 /dev/zero | tr '\\0' x; echo; exit 3"},
+			Extensions: InstructionExtensions{TimeoutSeconds: 10},
+
+			ExpectedExitCode: 3,
+		},
+		{
+			Name:       "timed out",
+			Args:       []string{"-c", "sleep 30"},
+			Extensions: InstructionExtensions{TimeoutSeconds: 1},
+
+			ExpectedExitCode: -1,
+			ExpectedTimedOut: true,
+		},
+		{
+			Name:       "timed out ignoring SIGTERM with child process",
+			Args:       []string{"-c", "trap '' TERM; sleep 30 & wait"},
+			Extensions: InstructionExtensions{TimeoutSeconds: 1},
+
+			ExpectedExitCode: -1,
+			ExpectedTimedOut: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			instruction := planapi.CommonInstruction{
+				Command: "/bin/sh",
+				Args:    tc.Args,
+			}
+			start := time.Now()
+			result, err := a.execute(context.Background(), tc.Name, filepath.Join(tempDir, tc.Name), instruction, tc.Extensions, true, 1, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("expected instruction to be terminated, took %s", elapsed)
+			}
+			if result.exitCode != tc.ExpectedExitCode {
+				t.Errorf("expected exit code %d, found %d", tc.ExpectedExitCode, result.exitCode)
+			}
+			if result.status.TimedOut != tc.ExpectedTimedOut {
+				t.Errorf("expected timed out %t, found %t", tc.ExpectedTimedOut, result.status.TimedOut)
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package applyinator
+
+import (
+	"os/exec"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// setProcessGroupTermination is a no op on Windows, where the process is killed directly when the command context is done.
+func setProcessGroupTermination(_ *exec.Cmd, gracePeriod time.Duration) func() {
+	logrus.Tracef("[Applyinator] process group termination is not supported on windows, ignoring grace period %s", gracePeriod.String())
+	return func() {}
+}
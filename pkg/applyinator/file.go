@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	planapi "github.com/rancher/rancher/pkg/plan"
 	"github.com/sirupsen/logrus"
@@ -14,24 +16,91 @@ import (
 
 const defaultDirectoryPermissions os.FileMode = 0755
 const defaultFilePermissions os.FileMode = 0600
+const linkFileAction = "link"
+const linkKindSymlink = "symlink"
+const linkKindHardlink = "hardlink"
 
 func writeBase64ContentToFile(file planapi.File) error {
 	content, err := base64.StdEncoding.DecodeString(file.Content)
 	if err != nil {
 		return err
 	}
-	var fileMode os.FileMode
+	fileMode, err := filePermissions(file)
+	if err != nil {
+		return err
+	}
+	return writeContentToFile(file.Path, file.UID, file.GID, fileMode, content)
+}
+
+// writeVerifiedContentToFile writes the content of a file with a digest, refusing to write content that does not have
+// the digest. An existing file is compared by its digest, so that it is not read into memory when it is unchanged.
+func writeVerifiedContentToFile(file planFile) error {
+	if file.Path == "" {
+		return fmt.Errorf("path was empty")
+	}
+	fileMode, err := filePermissions(file.File)
+	if err != nil {
+		return err
+	}
+	digest, err := parseContentDigest(file.Extensions.Digest)
+	if err != nil {
+		return err
+	}
+	if existing, err := digest.digestFile(file.Path); err == nil && existing == digest.hex {
+		logrus.Debugf("[Applyinator] File %s does not need to be written", file.Path)
+		return reconcileFilePermissions(file.Path, file.UID, file.GID, fileMode)
+	}
+	if err := verifyContentDigest(file); err != nil {
+		return err
+	}
+	content, err := base64.StdEncoding.DecodeString(file.Content)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file.Path), defaultDirectoryPermissions); err != nil {
+		return err
+	}
+	return WriteFileAtomic(file.Path, file.UID, file.GID, fileMode, content)
+}
+
+// writeSourceToFile writes the staged copy of the source of the file to its path, streaming it rather than reading it
+// into memory. A file whose content already has the digest of the source is not written.
+func writeSourceToFile(file planFile) error {
+	if file.Path == "" {
+		return fmt.Errorf("path was empty")
+	}
+	fileMode, err := filePermissions(file.File)
+	if err != nil {
+		return err
+	}
+	digest, err := parseContentDigest(file.Extensions.sourceDigest())
+	if err != nil {
+		return err
+	}
+	if existing, err := digest.digestFile(file.Path); err == nil && existing == digest.hex {
+		logrus.Debugf("[Applyinator] File %s does not need to be written", file.Path)
+		return reconcileFilePermissions(file.Path, file.UID, file.GID, fileMode)
+	}
+	src, err := os.Open(file.ContentFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := os.MkdirAll(filepath.Dir(file.Path), defaultDirectoryPermissions); err != nil {
+		return err
+	}
+	return writeFileAtomic(file.Path, file.UID, file.GID, fileMode, func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+func filePermissions(file planapi.File) (os.FileMode, error) {
 	if file.Permissions == "" {
 		logrus.Debugf("[Applyinator] Requested file permission for %s was %s, defaulting to %d", file.Path, file.Permissions, defaultFilePermissions)
-		fileMode = defaultFilePermissions
-	} else {
-		parsedPerm, err := parsePerm(file.Permissions)
-		if err != nil {
-			return err
-		}
-		fileMode = parsedPerm
+		return defaultFilePermissions, nil
 	}
-	return writeContentToFile(file.Path, file.UID, file.GID, fileMode, content)
+	return parsePerm(file.Permissions)
 }
 
 func writeContentToFile(path string, uid int, gid int, perm os.FileMode, content []byte) error {
@@ -42,16 +111,62 @@ func writeContentToFile(path string, uid int, gid int, perm os.FileMode, content
 	existing, err := os.ReadFile(path)
 	if err == nil && bytes.Equal(existing, content) {
 		logrus.Debugf("[Applyinator] File %s does not need to be written", path)
-	} else {
-		dir := filepath.Dir(path)
-		if err := os.MkdirAll(dir, defaultDirectoryPermissions); err != nil {
-			return err
-		}
-		if err := os.WriteFile(path, content, perm); err != nil {
-			return err
+		return reconcileFilePermissions(path, uid, gid, perm)
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, defaultDirectoryPermissions); err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, uid, gid, perm, content)
+}
+
+// WriteFileAtomic replaces the file at path with content, so that the file has either its old or its new content
+// after a crash. The content is written to a temporary file in the same directory, which is synced and given its mode
+// and owner before it is renamed over path. The directory is synced afterwards to persist the rename. A uid or gid of
+// -1 is left unchanged. When path is a symlink, its target is replaced instead of the symlink.
+func WriteFileAtomic(path string, uid int, gid int, perm os.FileMode, content []byte) error {
+	return writeFileAtomic(path, uid, gid, perm, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// writeFileAtomic is WriteFileAtomic with the content written by write.
+func writeFileAtomic(path string, uid int, gid int, perm os.FileMode, write func(io.Writer) error) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		// The temporary file no longer exists once it has been renamed.
+		if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("error removing temporary file %s: %v", tmpPath, err)
 		}
+	}()
+
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := reconcileFilePermissions(tmpPath, uid, gid, perm); err != nil {
+		return err
 	}
-	return reconcileFilePermissions(path, uid, gid, perm)
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDirectory(dir)
 }
 
 func createDirectory(file planapi.File) error {
@@ -92,6 +207,152 @@ func removeFile(file planapi.File) error {
 	return nil
 }
 
+// reconcileFiles creates, writes, links and removes the files of a plan in order, stopping at the first error.
+func reconcileFiles(files []planFile) error {
+	for _, file := range files {
+		if file.Action == deleteFileAction {
+			if err := removeFile(file.File); err != nil {
+				return err
+			}
+		} else if file.Action == linkFileAction {
+			logrus.Debugf("[Applyinator] Linking %s to %s", file.Path, file.Extensions.LinkTarget)
+			if err := createLink(file); err != nil {
+				return err
+			}
+		} else if file.Directory {
+			logrus.Debugf("[Applyinator] Creating directory %s", file.Path)
+			if err := createDirectory(file.File); err != nil {
+				return err
+			}
+		} else if file.ContentFile != "" {
+			logrus.Debugf("[Applyinator] Writing file %s from %s in image %s", file.Path, file.Extensions.Source.Path, file.Extensions.Source.Image)
+			if err := writeSourceToFile(file); err != nil {
+				return err
+			}
+		} else if file.Extensions.Digest != "" {
+			logrus.Debugf("[Applyinator] Writing file %s with digest %s", file.Path, file.Extensions.Digest)
+			if err := writeVerifiedContentToFile(file); err != nil {
+				return err
+			}
+		} else {
+			logrus.Debugf("[Applyinator] Writing file %s", file.Path)
+			if err := writeBase64ContentToFile(file.File); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createLink makes the path of the file a symlink or hardlink to its target. A link to the correct target is left
+// alone and a link to another target is replaced, but a regular file is only replaced when forced. Directories are
+// never replaced.
+func createLink(file planFile) error {
+	if file.Path == "" {
+		return fmt.Errorf("path was empty")
+	}
+	target := file.Extensions.LinkTarget
+	if target == "" {
+		return fmt.Errorf("link %s does not have a target", file.Path)
+	}
+	kind := file.Extensions.linkKind()
+	if kind != linkKindSymlink && kind != linkKindHardlink {
+		return fmt.Errorf("link %s has unknown kind %s", file.Path, kind)
+	}
+
+	linked, err := isLinkedTo(file.Path, target, kind)
+	if err != nil {
+		return err
+	}
+	if linked {
+		logrus.Debugf("[Applyinator] %s is already a %s to %s", file.Path, kind, target)
+		return nil
+	}
+
+	existing, err := os.Lstat(file.Path)
+	if err == nil {
+		switch {
+		case existing.IsDir():
+			return fmt.Errorf("refusing to replace directory %s with a %s", file.Path, kind)
+		case existing.Mode().IsRegular() && !file.Extensions.Force:
+			return fmt.Errorf("refusing to replace regular file %s with a %s without force", file.Path, kind)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir := filepath.Dir(file.Path)
+	if err := os.MkdirAll(dir, defaultDirectoryPermissions); err != nil {
+		return err
+	}
+	// Create the link next to the path and rename it over the path, so that the path always exists.
+	tmpPath := filepath.Join(dir, fmt.Sprintf(".%s.tmp-%d", filepath.Base(file.Path), time.Now().UnixNano()))
+	if kind == linkKindHardlink {
+		err = os.Link(target, tmpPath)
+	} else {
+		err = os.Symlink(target, tmpPath)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, file.Path); err != nil {
+		if err := os.Remove(tmpPath); err != nil {
+			logrus.Errorf("error removing temporary link %s: %v", tmpPath, err)
+		}
+		return err
+	}
+	return syncDirectory(dir)
+}
+
+// isLinkedTo returns true if path is a symlink to target, or a hardlink to the same file as target.
+func isLinkedTo(path, target, kind string) (bool, error) {
+	existing, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if kind == linkKindSymlink {
+		if existing.Mode()&os.ModeSymlink == 0 {
+			return false, nil
+		}
+		existingTarget, err := os.Readlink(path)
+		if err != nil {
+			return false, err
+		}
+		return existingTarget == target, nil
+	}
+	if !existing.Mode().IsRegular() {
+		return false, nil
+	}
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(existing, targetInfo), nil
+}
+
+// cleanWorkDir removes the contents of the work directory except for the file snapshots and staged sources.
+func cleanWorkDir(workDir string) error {
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == snapshotsDirName || entry.Name() == sourcesDirName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(workDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func parsePerm(perm string) (os.FileMode, error) {
 	parsedPerm, err := strconv.ParseInt(perm, 8, 32)
 	if err != nil {
@@ -380,3 +380,171 @@ func TestFileActionDelete(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "test-atomic")
+	if err := os.WriteFile(path, []byte("old content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(tempDir, "test-atomic-link")
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink(path, link); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		link = path
+	}
+
+	if err := WriteFileAtomic(link, -1, -1, 0600, []byte("new content")); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "new content" {
+		t.Errorf("expected new content, found %s", content)
+	}
+	if runtime.GOOS != "windows" {
+		if fileInfo, err := os.Lstat(link); err != nil || fileInfo.Mode()&fs.ModeSymlink == 0 {
+			t.Errorf("expected %s to remain a symlink: %v", link, err)
+		}
+		permissions, err := getPermissions(path)
+		if err != nil {
+			t.Error(err)
+		}
+		if permissions != 0600 {
+			t.Errorf("expected permissions %v, found %v", os.FileMode(0600), permissions)
+		}
+	}
+
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(path) && entry.Name() != filepath.Base(link) {
+			t.Errorf("expected temporary files to be removed, found %s", entry.Name())
+		}
+	}
+}
+
+func TestCreateLink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires privileges on Windows")
+	}
+	tempDir, err := os.MkdirTemp("", "test-link-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	target := filepath.Join(tempDir, "kubectl-v1.30")
+	otherTarget := filepath.Join(tempDir, "kubectl-v1.29")
+	for _, path := range []string{target, otherTarget} {
+		if err := os.WriteFile(path, []byte(filepath.Base(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		Name  string
+		Setup func(path string) error
+		Kind  string
+		Force bool
+
+		ExpectedErr bool
+	}{
+		{
+			Name:  "new symlink",
+			Setup: func(_ string) error { return nil },
+		},
+		{
+			Name:  "existing symlink",
+			Setup: func(path string) error { return os.Symlink(target, path) },
+		},
+		{
+			Name:  "symlink to other target",
+			Setup: func(path string) error { return os.Symlink(otherTarget, path) },
+		},
+		{
+			Name:  "regular file",
+			Setup: func(path string) error { return os.WriteFile(path, []byte("t"), defaultFilePermissions) },
+
+			ExpectedErr: true,
+		},
+		{
+			Name:  "forced regular file",
+			Setup: func(path string) error { return os.WriteFile(path, []byte("t"), defaultFilePermissions) },
+			Force: true,
+		},
+		{
+			Name:  "forced directory",
+			Setup: func(path string) error { return os.Mkdir(path, defaultDirectoryPermissions) },
+			Force: true,
+
+			ExpectedErr: true,
+		},
+		{
+			Name:  "new hardlink",
+			Setup: func(_ string) error { return nil },
+			Kind:  linkKindHardlink,
+		},
+		{
+			Name:  "hardlink replacing symlink",
+			Setup: func(path string) error { return os.Symlink(otherTarget, path) },
+			Kind:  linkKindHardlink,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := filepath.Join(tempDir, "bin", filepath.Base(tc.Name))
+			if err := os.MkdirAll(filepath.Dir(path), defaultDirectoryPermissions); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.Setup(path); err != nil {
+				t.Fatalf("Setup failed for %s: %v", tc.Name, err)
+			}
+			file := planFile{
+				File:       planapi.File{Path: path, Action: linkFileAction},
+				Extensions: FileExtensions{LinkTarget: target, LinkKind: tc.Kind, Force: tc.Force},
+			}
+
+			err := createLink(file)
+			if tc.ExpectedErr {
+				if err == nil {
+					t.Fatal("expected error, returned successfully")
+				}
+				if linked, _ := isLinkedTo(path, target, file.Extensions.linkKind()); linked {
+					t.Errorf("expected %s not to be replaced", path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if linked, err := isLinkedTo(path, target, file.Extensions.linkKind()); err != nil || !linked {
+				t.Errorf("expected %s to be a %s to %s: %v", path, file.Extensions.linkKind(), target, err)
+			}
+
+			// Deleting the link must leave its target in place.
+			if err := removeFile(planapi.File{Path: path, Action: deleteFileAction}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be deleted: %v", path, err)
+			}
+			if _, err := os.Stat(target); err != nil {
+				t.Errorf("expected target %s to remain: %v", target, err)
+			}
+		})
+	}
+}
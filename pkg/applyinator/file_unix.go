@@ -4,6 +4,7 @@ package applyinator
 
 import (
 	"os"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 )
@@ -11,10 +12,30 @@ import (
 // reconcileFilePermissions abstracts out the file permissions checks that only works on Linux.
 func reconcileFilePermissions(path string, uid int, gid int, perm os.FileMode) error {
 	logrus.Debugf("[Applyinator] Reconciling file permissions for %s to %d:%d %d", path, uid, gid, perm)
-	if err := os.Chmod(path, perm); err != nil {
+	// The owner is changed first, as changing it clears the setuid and setgid bits of the mode.
+	if err := os.Chown(path, uid, gid); err != nil {
 		return err
 	}
-	return os.Chown(path, uid, gid)
+	return os.Chmod(path, perm)
+}
+
+// syncDirectory flushes the entries of the directory, such as a rename into it, to disk.
+func syncDirectory(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// fileOwner returns the uid and gid that own the file.
+func fileOwner(fileInfo os.FileInfo) (int, int, bool) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
 }
 
 //nolint:unused // used in tests
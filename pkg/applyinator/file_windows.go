@@ -21,6 +21,17 @@ func reconcileFilePermissions(path string, uid int, gid int, perm os.FileMode) e
 	return acl.Chmod(path, perm)
 }
 
+// syncDirectory is a no-op on Windows, where directories cannot be opened for syncing and renames are persisted by
+// the file system.
+func syncDirectory(_ string) error {
+	return nil
+}
+
+// fileOwner is not implemented on Windows, where the owner of plan files is not reconciled.
+func fileOwner(_ os.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
 func getPermissions(path string) (os.FileMode, error) {
 	logrus.Debugf("getting windows file permissions for %s is not implemented", path)
 	return 0000, nil
@@ -0,0 +1,139 @@
+package applyinator
+
+import (
+	"fmt"
+	"sort"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+	"github.com/sirupsen/logrus"
+)
+
+// instructionGraph is the dependency graph of the one-time instructions of a plan, by instruction index.
+type instructionGraph struct {
+	dependencies map[int]int   // number of instructions each instruction depends on
+	dependents   map[int][]int // instructions that depend on each instruction
+}
+
+// newInstructionGraph builds the dependency graph of the instructions. Every instruction must have a unique name, every
+// dependency must name another instruction of the plan, and the dependencies must not contain a cycle.
+func newInstructionGraph(instructions []planapi.OneTimeInstruction, extensions []InstructionExtensions) (*instructionGraph, error) {
+	indexes := map[string]int{}
+	for index, instruction := range instructions {
+		if instruction.Name == "" {
+			return nil, fmt.Errorf("instruction %d does not have a name set, all instructions must be named when dependencies are declared", index)
+		}
+		if _, ok := indexes[instruction.Name]; ok {
+			return nil, fmt.Errorf("instruction name %s is not unique", instruction.Name)
+		}
+		indexes[instruction.Name] = index
+	}
+
+	g := &instructionGraph{
+		dependencies: map[int]int{},
+		dependents:   map[int][]int{},
+	}
+	for index := range instructions {
+		g.dependencies[index] = 0
+		if index >= len(extensions) {
+			continue
+		}
+		for _, dependency := range extensions[index].DependsOn {
+			dependencyIndex, ok := indexes[dependency]
+			if !ok {
+				return nil, fmt.Errorf("instruction %s depends on unknown instruction %s", instructions[index].Name, dependency)
+			}
+			if dependencyIndex == index {
+				return nil, fmt.Errorf("instruction %s depends on itself", instructions[index].Name)
+			}
+			g.dependencies[index]++
+			g.dependents[dependencyIndex] = append(g.dependents[dependencyIndex], index)
+		}
+	}
+
+	// Walk the graph once without running anything to make sure that every instruction can be reached.
+	remaining := g.initialDependencies()
+	ready := g.ready(remaining)
+	visited := 0
+	for len(ready) > 0 {
+		index := ready[0]
+		ready = ready[1:]
+		visited++
+		ready = append(ready, g.complete(index, remaining)...)
+	}
+	if visited != len(instructions) {
+		return nil, fmt.Errorf("instruction dependencies contain a cycle")
+	}
+	return g, nil
+}
+
+func (g *instructionGraph) initialDependencies() map[int]int {
+	remaining := make(map[int]int, len(g.dependencies))
+	for index, count := range g.dependencies {
+		remaining[index] = count
+	}
+	return remaining
+}
+
+// ready returns the instructions without remaining dependencies in index order.
+func (g *instructionGraph) ready(remaining map[int]int) []int {
+	var ready []int
+	for index, count := range remaining {
+		if count == 0 {
+			ready = append(ready, index)
+		}
+	}
+	sort.Ints(ready)
+	return ready
+}
+
+// complete marks the instruction as done and returns the dependents that became ready in index order.
+func (g *instructionGraph) complete(index int, remaining map[int]int) []int {
+	var ready []int
+	for _, dependent := range g.dependents[index] {
+		remaining[dependent]--
+		if remaining[dependent] == 0 {
+			ready = append(ready, dependent)
+		}
+	}
+	sort.Ints(ready)
+	return ready
+}
+
+// run calls runInstruction for every instruction once its dependencies have succeeded, with at most workers
+// instructions running at once. Once an instruction fails, no further instructions are started and run returns false
+// after the running instructions have finished.
+func (g *instructionGraph) run(workers int, runInstruction func(index int) bool) bool {
+	type result struct {
+		index     int
+		succeeded bool
+	}
+
+	remaining := g.initialDependencies()
+	ready := g.ready(remaining)
+	results := make(chan result)
+	running := 0
+	succeeded := true
+
+	for {
+		for succeeded && running < workers && len(ready) > 0 {
+			index := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				results <- result{index: index, succeeded: runInstruction(index)}
+			}()
+		}
+		if running == 0 {
+			return succeeded
+		}
+		r := <-results
+		running--
+		if !r.succeeded {
+			logrus.Debugf("[Applyinator] Instruction %d failed, not starting any further instructions", r.index)
+			succeeded = false
+			continue
+		}
+		ready = append(ready, g.complete(r.index, remaining)...)
+		sort.Ints(ready)
+	}
+}
@@ -0,0 +1,185 @@
+package applyinator
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestNewInstructionGraph(t *testing.T) {
+	getInstructions := func(names ...string) []planapi.OneTimeInstruction {
+		var instructions []planapi.OneTimeInstruction
+		for _, name := range names {
+			instructions = append(instructions, planapi.OneTimeInstruction{CommonInstruction: planapi.CommonInstruction{Name: name}})
+		}
+		return instructions
+	}
+
+	testCases := []struct {
+		Name         string
+		Instructions []planapi.OneTimeInstruction
+		DependsOn    [][]string
+
+		ExpectedErr bool
+	}{
+		{
+			Name:         "valid",
+			Instructions: getInstructions("a", "b", "c"),
+			DependsOn:    [][]string{nil, {"a"}, {"a", "b"}},
+		},
+		{
+			Name:         "fewer extensions than instructions",
+			Instructions: getInstructions("a", "b"),
+			DependsOn:    [][]string{{}},
+		},
+		{
+			Name:         "unnamed instruction",
+			Instructions: getInstructions("a", ""),
+			DependsOn:    [][]string{nil, {"a"}},
+			ExpectedErr:  true,
+		},
+		{
+			Name:         "duplicate name",
+			Instructions: getInstructions("a", "a"),
+			DependsOn:    [][]string{nil, {}},
+			ExpectedErr:  true,
+		},
+		{
+			Name:         "unknown dependency",
+			Instructions: getInstructions("a", "b"),
+			DependsOn:    [][]string{nil, {"c"}},
+			ExpectedErr:  true,
+		},
+		{
+			Name:         "self dependency",
+			Instructions: getInstructions("a"),
+			DependsOn:    [][]string{{"a"}},
+			ExpectedErr:  true,
+		},
+		{
+			Name:         "cycle",
+			Instructions: getInstructions("a", "b", "c"),
+			DependsOn:    [][]string{{"c"}, {"a"}, {"b"}},
+			ExpectedErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var extensions []InstructionExtensions
+			for _, dependsOn := range tc.DependsOn {
+				extensions = append(extensions, InstructionExtensions{DependsOn: dependsOn})
+			}
+			_, err := newInstructionGraph(tc.Instructions, extensions)
+			if tc.ExpectedErr && err == nil {
+				t.Error("expected error, returned successfully")
+			} else if !tc.ExpectedErr && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestInstructionGraphRun(t *testing.T) {
+	instructions := []planapi.OneTimeInstruction{
+		{CommonInstruction: planapi.CommonInstruction{Name: "stage-a"}},
+		{CommonInstruction: planapi.CommonInstruction{Name: "stage-b"}},
+		{CommonInstruction: planapi.CommonInstruction{Name: "stage-c"}},
+		{CommonInstruction: planapi.CommonInstruction{Name: "install"}},
+	}
+	extensions := []InstructionExtensions{
+		{DependsOn: []string{}},
+		{DependsOn: []string{}},
+		{DependsOn: []string{}},
+		{DependsOn: []string{"stage-a", "stage-b", "stage-c"}},
+	}
+	graph, err := newInstructionGraph(instructions, extensions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Name    string
+		Workers int
+		Failing int
+
+		ExpectedSucceeded  bool
+		ExpectedRun        []bool
+		ExpectedMaxRunning int
+	}{
+		{
+			Name:    "sequential",
+			Workers: 1,
+			Failing: -1,
+
+			ExpectedSucceeded:  true,
+			ExpectedRun:        []bool{true, true, true, true},
+			ExpectedMaxRunning: 1,
+		},
+		{
+			Name:    "concurrent",
+			Workers: 2,
+			Failing: -1,
+
+			ExpectedSucceeded:  true,
+			ExpectedRun:        []bool{true, true, true, true},
+			ExpectedMaxRunning: 2,
+		},
+		{
+			Name:    "dependency failed",
+			Workers: 3,
+			Failing: 1,
+
+			ExpectedSucceeded:  false,
+			ExpectedRun:        []bool{true, true, true, false},
+			ExpectedMaxRunning: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var (
+				mu         sync.Mutex
+				running    int
+				maxRunning int
+				run        = make([]bool, len(instructions))
+			)
+			succeeded := graph.run(tc.Workers, func(index int) bool {
+				mu.Lock()
+				if index == 3 {
+					for dependency := 0; dependency < 3; dependency++ {
+						if !run[dependency] {
+							t.Errorf("instruction %d was run before its dependency %d", index, dependency)
+						}
+					}
+				}
+				run[index] = true
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+
+				time.Sleep(50 * time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return index != tc.Failing
+			})
+			if succeeded != tc.ExpectedSucceeded {
+				t.Errorf("expected succeeded %t, found %t", tc.ExpectedSucceeded, succeeded)
+			}
+			for index := range run {
+				if run[index] != tc.ExpectedRun[index] {
+					t.Errorf("expected instruction %d run %t, found %t", index, tc.ExpectedRun[index], run[index])
+				}
+			}
+			if maxRunning != tc.ExpectedMaxRunning {
+				t.Errorf("expected at most %d instructions running at once, found %d", tc.ExpectedMaxRunning, maxRunning)
+			}
+		})
+	}
+}
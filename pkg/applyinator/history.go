@@ -0,0 +1,100 @@
+package applyinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PlanOutcome is the outcome of applying a plan.
+type PlanOutcome string
+
+const (
+	PlanOutcomeSucceeded PlanOutcome = "succeeded"
+	PlanOutcomeFailed    PlanOutcome = "failed"
+)
+
+// AppliedAt returns the time the plan was applied at, which is the zero time if the ID of the record is not a time.
+func (p AppliedPlan) AppliedAt() time.Time {
+	appliedAt, err := time.ParseInLocation(applyinatorDateCodeLayout, p.ID, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	return appliedAt
+}
+
+// planOutcome returns the outcome of applying a plan, which fails when it returns an error or when its one-time
+// instructions did not succeed.
+func planOutcome(input ApplyInput, output ApplyOutput, applyErr error) PlanOutcome {
+	if applyErr != nil || (input.RunOneTimeInstructions && !output.OneTimeApplySucceeded) {
+		return PlanOutcomeFailed
+	}
+	return PlanOutcomeSucceeded
+}
+
+// recordPlanOutcome rewrites the record of an applied plan in the applied plan directory with the outcome of applying
+// it.
+func (a *Applyinator) recordPlanOutcome(file string, record *AppliedPlan, input ApplyInput, output ApplyOutput, applyErr error, redactor *redactor) {
+	record.Outcome = planOutcome(input, output, applyErr)
+	if applyErr != nil {
+		record.Error = redactor.redactString(applyErr.Error())
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		logrus.Errorf("error marshalling applied plan: %v", err)
+		return
+	}
+	if err := writeContentToFile(filepath.Join(a.appliedPlanDir, file), os.Getuid(), os.Getgid(), 0600, data); err != nil {
+		logrus.Errorf("error writing outcome of applied plan to disk: %v", err)
+	}
+}
+
+// ListAppliedPlans returns the records of the applied plans in the applied plan directory, oldest first.
+func ListAppliedPlans(appliedPlanDir string) ([]AppliedPlan, error) {
+	entries, err := os.ReadDir(appliedPlanDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var plans []AppliedPlan
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), appliedPlanFileSuffix) {
+			continue
+		}
+		plan, err := ReadAppliedPlan(appliedPlanDir, strings.TrimSuffix(entry.Name(), appliedPlanFileSuffix))
+		if err != nil {
+			logrus.Warnf("[Applyinator] Skipping applied plan %s: %v", entry.Name(), err)
+			continue
+		}
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].ID < plans[j].ID
+	})
+	return plans, nil
+}
+
+// ReadAppliedPlan returns the record of the applied plan with the ID in the applied plan directory.
+func ReadAppliedPlan(appliedPlanDir, id string) (AppliedPlan, error) {
+	var plan AppliedPlan
+	if id == "" || filepath.Base(id) != id {
+		return plan, fmt.Errorf("invalid applied plan ID %q", id)
+	}
+	data, err := os.ReadFile(filepath.Join(appliedPlanDir, id+appliedPlanFileSuffix))
+	if err != nil {
+		return plan, err
+	}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return plan, fmt.Errorf("unable to parse applied plan %s: %w", id, err)
+	}
+	plan.ID = id
+	return plan, nil
+}
@@ -0,0 +1,177 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestAppliedPlanOutcome(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-history-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	testCases := []struct {
+		Name        string
+		Instruction string
+
+		ExpectedOutcome PlanOutcome
+	}{
+		{
+			Name:        "succeeded",
+			Instruction: "/bin/true",
+
+			ExpectedOutcome: PlanOutcomeSucceeded,
+		},
+		{
+			Name:        "failed",
+			Instruction: "/bin/false",
+
+			ExpectedOutcome: PlanOutcomeFailed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			appliedPlanDir := filepath.Join(tempDir, tc.Name, "applied")
+			a := NewApplyinator(filepath.Join(tempDir, tc.Name, "work"), false, appliedPlanDir, "", nil, Options{})
+			input := ApplyInput{
+				CalculatedPlan: CalculatedPlan{
+					Plan: planapi.Plan{OneTimeInstructions: []planapi.OneTimeInstruction{
+						{CommonInstruction: planapi.CommonInstruction{Name: "instruction", Command: tc.Instruction}},
+					}},
+					Checksum: "checksum",
+				},
+				ReconcileFiles:         true,
+				RunOneTimeInstructions: true,
+			}
+			if _, err := a.Apply(context.Background(), input); err != nil {
+				t.Fatal(err)
+			}
+
+			// Applying the same plan again replaces the outcome of its record.
+			if _, err := a.Apply(context.Background(), input); err != nil {
+				t.Fatal(err)
+			}
+
+			// Checking an applied plan does not record it again.
+			input.ReconcileFiles = false
+			input.RunOneTimeInstructions = false
+			if _, err := a.Apply(context.Background(), input); err != nil {
+				t.Fatal(err)
+			}
+
+			plans, err := ListAppliedPlans(appliedPlanDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plans) != 1 {
+				t.Fatalf("expected 1 applied plan, found %d", len(plans))
+			}
+			if plans[0].Outcome != tc.ExpectedOutcome {
+				t.Errorf("expected outcome %s, found %s", tc.ExpectedOutcome, plans[0].Outcome)
+			}
+			if plans[0].Checksum != "checksum" || plans[0].Plan.OneTimeInstructions[0].Name != "instruction" {
+				t.Errorf("unexpected applied plan %v", plans[0])
+			}
+			if plans[0].AppliedAt().IsZero() {
+				t.Errorf("expected applied time of %s to be parsed", plans[0].ID)
+			}
+		})
+	}
+}
+
+func TestAppliedPlanRetentionPolicy(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-history-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	now := time.Now()
+	ages := []time.Duration{72 * time.Hour, 48 * time.Hour, 24 * time.Hour, time.Hour, 0}
+
+	testCases := []struct {
+		Name      string
+		Retention int
+		MaxAge    time.Duration
+		// Later is how long after the newest applied plan the retention policy is applied.
+		Later time.Duration
+
+		ExpectedRemaining int
+	}{
+		{
+			Name:      "count",
+			Retention: 3,
+
+			ExpectedRemaining: 3,
+		},
+		{
+			Name:      "age",
+			Retention: 64,
+			MaxAge:    36 * time.Hour,
+
+			ExpectedRemaining: 3,
+		},
+		{
+			Name:      "count and age",
+			Retention: 2,
+			MaxAge:    36 * time.Hour,
+
+			ExpectedRemaining: 2,
+		},
+		{
+			Name:      "short age",
+			Retention: 64,
+			MaxAge:    time.Minute,
+
+			ExpectedRemaining: 1,
+		},
+		{
+			Name:      "newest is kept",
+			Retention: 64,
+			MaxAge:    time.Minute,
+			Later:     time.Hour,
+
+			ExpectedRemaining: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			appliedPlanDir := filepath.Join(tempDir, filepath.Base(tc.Name))
+			if err := os.MkdirAll(appliedPlanDir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			for _, age := range ages {
+				file := filepath.Join(appliedPlanDir, now.Add(-age).Format(applyinatorDateCodeLayout)+appliedPlanFileSuffix)
+				if err := os.WriteFile(file, []byte("{}"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			a := NewApplyinator(filepath.Join(tempDir, "work"), false, appliedPlanDir, "", nil, Options{})
+			if err := a.appliedPlanRetentionPolicy(now.Add(tc.Later), tc.Retention, tc.MaxAge); err != nil {
+				t.Fatal(err)
+			}
+			plans, err := ListAppliedPlans(appliedPlanDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plans) != tc.ExpectedRemaining {
+				t.Fatalf("expected %d applied plans to remain, found %d", tc.ExpectedRemaining, len(plans))
+			}
+			if newest := now.Format(applyinatorDateCodeLayout); plans[len(plans)-1].ID != newest {
+				t.Errorf("expected newest applied plan %s to remain, found %s", newest, plans[len(plans)-1].ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package applyinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HookPhase is the phase of applying a plan that a hook is run in.
+type HookPhase string
+
+const (
+	HookPhasePre  HookPhase = "pre-apply"
+	HookPhasePost HookPhase = "post-apply"
+)
+
+const cattleAgentHookPhaseEnvKey = "CATTLE_AGENT_HOOK_PHASE"
+const cattleAgentPlanChecksumEnvKey = "CATTLE_AGENT_PLAN_CHECKSUM"
+const cattleAgentPlanOutcomeEnvKey = "CATTLE_AGENT_PLAN_OUTCOME"
+const cattleAgentPlanErrorEnvKey = "CATTLE_AGENT_PLAN_ERROR"
+const defaultHookTimeout = 5 * time.Minute
+const hookOutputMaxBytes = 4096
+
+// HookError is the failure of a pre-apply hook, which aborts applying the plan.
+type HookError struct {
+	Phase    HookPhase `json:"phase"`
+	Hook     string    `json:"hook"`
+	ExitCode int       `json:"exitCode"`
+	TimedOut bool      `json:"timedOut,omitempty"`
+	// StartError is the reason the hook could not be started, in which case it has no exit code.
+	StartError string `json:"startError,omitempty"`
+	// Output is the combined stdout and stderr of the hook, truncated to its head and tail when it is long.
+	Output string `json:"output,omitempty"`
+}
+
+func (e *HookError) Error() string {
+	reason := fmt.Sprintf("exit code %d", e.ExitCode)
+	if e.TimedOut {
+		reason = "timed out"
+	}
+	if e.StartError != "" {
+		return fmt.Sprintf("%s hook %s could not be started: %s", e.Phase, e.Hook, e.StartError)
+	}
+	return fmt.Sprintf("%s hook %s failed with %s", e.Phase, e.Hook, reason)
+}
+
+// hooks returns the paths of the executable hooks of the phase in the hooks directory, in lexical order. Hidden files
+// and files that are not executable are skipped.
+func (a *Applyinator) hooks(phase HookPhase) ([]string, error) {
+	if a.options.HooksDir == "" {
+		return nil, nil
+	}
+	dir := filepath.Join(a.options.HooksDir, string(phase)+".d")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var hooks []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			logrus.Debugf("[Applyinator] Skipping %s in hooks directory %s as it is not an executable file", entry.Name(), dir)
+			continue
+		}
+		hooks = append(hooks, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(hooks)
+	return hooks, nil
+}
+
+// runHooks runs the hooks of the phase one after another, passing them the outcome and error of applying the plan in
+// the post-apply phase. Pre-apply hooks stop at the first failure, which is returned as a *HookError, while the failure
+// of a post-apply hook is only logged so that every post-apply hook is run.
+func (a *Applyinator) runHooks(ctx context.Context, phase HookPhase, checksum string, outcome PlanOutcome, applyErr string) error {
+	hooks, err := a.hooks(phase)
+	if err != nil {
+		return fmt.Errorf("unable to list %s hooks: %w", phase, err)
+	}
+	env := append(os.Environ(),
+		cattleAgentHookPhaseEnvKey+"="+string(phase),
+		cattleAgentPlanChecksumEnvKey+"="+checksum,
+	)
+	if phase == HookPhasePost {
+		env = append(env, cattleAgentPlanOutcomeEnvKey+"="+string(outcome))
+		if applyErr != "" {
+			env = append(env, cattleAgentPlanErrorEnvKey+"="+applyErr)
+		}
+	}
+	for _, hook := range hooks {
+		logrus.Infof("[Applyinator] Running %s hook %s for plan %s", phase, hook, checksum)
+		if err := a.runHook(ctx, phase, hook, env); err != nil {
+			if phase == HookPhasePre {
+				return err
+			}
+			logrus.Errorf("error running %s hook %s: %v", phase, hook, err)
+		}
+	}
+	return nil
+}
+
+func (a *Applyinator) runHook(ctx context.Context, phase HookPhase, hook string, env []string) error {
+	hookCtx, cancel := context.WithTimeout(ctx, a.options.HookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(hookCtx, hook)
+	cmd.Env = env
+	cmd.Dir = filepath.Dir(hook)
+	stopTermination := setProcessGroupTermination(cmd, a.options.TerminationGracePeriod)
+	hookErr := &HookError{
+		Phase:    phase,
+		Hook:     filepath.Base(hook),
+		ExitCode: -1,
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		hookErr.StartError = err.Error()
+		return hookErr
+	}
+	// The hook writes stdout and stderr to the same pipe, so that its output is in order.
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		hookErr.StartError = err.Error()
+		return hookErr
+	}
+	output := outputBuffer{limit: hookOutputMaxBytes}
+	if err := readLines(stdout, func(line []byte) {
+		logrus.Infof("[%s:%s]: %s", phase, filepath.Base(hook), line)
+		output.Write(append(line, '\n'))
+	}); err != nil {
+		logrus.Errorf("error reading output of %s hook %s: %v", phase, hook, err)
+	}
+	err = cmd.Wait()
+	// The process group of the hook is gone once it exits, so it must not be killed after that.
+	stopTermination()
+	if err == nil {
+		return nil
+	}
+	hookErr.Output = string(output.Bytes())
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		hookErr.ExitCode = exitErr.ExitCode()
+	}
+	hookErr.TimedOut = errors.Is(hookCtx.Err(), context.DeadlineExceeded)
+	return hookErr
+}
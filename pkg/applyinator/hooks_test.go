@@ -0,0 +1,142 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestApplyHooks(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-hooks-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	testCases := []struct {
+		Name    string
+		PreHook string
+		// PreHookInterpreter is the interpreter of the pre-apply hook, which is /bin/sh by default.
+		PreHookInterpreter string
+
+		ExpectedHookErr *HookError
+		ExpectedRecord  string
+	}{
+		{
+			Name:    "succeeded",
+			PreHook: "exit 0",
+
+			ExpectedRecord: "pre-apply checksum\ninstruction\npost-apply checksum succeeded\n",
+		},
+		{
+			Name:    "failed",
+			PreHook: "echo backup agent is busy; exit 3",
+
+			ExpectedHookErr: &HookError{Phase: HookPhasePre, Hook: "20-check", ExitCode: 3, Output: "backup agent is busy\n"},
+			ExpectedRecord:  "pre-apply checksum\npost-apply checksum failed\n",
+		},
+		{
+			Name:               "unstartable",
+			PreHook:            "exit 0",
+			PreHookInterpreter: "/nonexistent/sh",
+
+			ExpectedHookErr: &HookError{Phase: HookPhasePre, Hook: "20-check", ExitCode: -1, StartError: "no such file or directory"},
+			ExpectedRecord:  "pre-apply checksum\npost-apply checksum failed\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			root := filepath.Join(tempDir, tc.Name)
+			record := filepath.Join(root, "record")
+			hooksDir := filepath.Join(root, "hooks")
+			hooks := map[string]string{
+				"pre-apply.d/10-record":  `echo "$CATTLE_AGENT_HOOK_PHASE $CATTLE_AGENT_PLAN_CHECKSUM" >> ` + record,
+				"pre-apply.d/20-check":   tc.PreHook,
+				"post-apply.d/10-record": `echo "$CATTLE_AGENT_HOOK_PHASE $CATTLE_AGENT_PLAN_CHECKSUM $CATTLE_AGENT_PLAN_OUTCOME" >> ` + record,
+			}
+			for path, script := range hooks {
+				if err := os.MkdirAll(filepath.Dir(filepath.Join(hooksDir, path)), 0755); err != nil {
+					t.Fatal(err)
+				}
+				interpreter := "/bin/sh"
+				if path == "pre-apply.d/20-check" && tc.PreHookInterpreter != "" {
+					interpreter = tc.PreHookInterpreter
+				}
+				if err := os.WriteFile(filepath.Join(hooksDir, path), []byte("#!"+interpreter+"\n"+script+"\n"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Files that are not executable are not run.
+			if err := os.WriteFile(filepath.Join(hooksDir, "pre-apply.d", "30-disabled"), []byte("#!/bin/sh\nexit 1\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			interlockDir := filepath.Join(root, "interlock")
+			if err := os.MkdirAll(interlockDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			appliedPlanDir := filepath.Join(root, "applied")
+			a := NewApplyinator(filepath.Join(root, "work"), false, appliedPlanDir, interlockDir, nil, Options{HooksDir: hooksDir})
+			input := ApplyInput{
+				CalculatedPlan: CalculatedPlan{
+					Plan: planapi.Plan{
+						Files: []planapi.File{{Path: filepath.Join(root, "files", "config"), Content: "Y29uZmln"}},
+						OneTimeInstructions: []planapi.OneTimeInstruction{
+							{CommonInstruction: planapi.CommonInstruction{Name: "instruction", Command: "/bin/sh", Args: []string{"-c", "echo instruction >> " + record}}},
+						},
+					},
+					Checksum: "checksum",
+				},
+				ReconcileFiles:         true,
+				RunOneTimeInstructions: true,
+			}
+			output, err := a.Apply(context.Background(), input)
+			var hookErr *HookError
+			if errors.As(err, &hookErr) != (tc.ExpectedHookErr != nil) {
+				t.Fatalf("expected hook error %+v, found %v", tc.ExpectedHookErr, err)
+			}
+			if expected := tc.ExpectedHookErr; expected != nil {
+				if hookErr.Phase != expected.Phase || hookErr.Hook != expected.Hook || hookErr.ExitCode != expected.ExitCode || hookErr.Output != expected.Output || !strings.Contains(hookErr.StartError, expected.StartError) {
+					t.Errorf("unexpected hook error %+v", hookErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			// An apply that the pre-apply hooks abort neither snapshots the files nor records the plan.
+			history, err := ListAppliedPlans(appliedPlanDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if aborted := tc.ExpectedHookErr != nil; aborted != (len(history) == 0) || aborted != (output.SnapshotID == "") {
+				t.Errorf("expected the apply to be recorded %t, found %d records and snapshot %q", !aborted, len(history), output.SnapshotID)
+			}
+
+			recorded, err := os.ReadFile(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(recorded) != tc.ExpectedRecord {
+				t.Errorf("expected record %q, found %q", tc.ExpectedRecord, recorded)
+			}
+
+			// Hooks are not run when checking an applied plan.
+			input.ReconcileFiles = false
+			input.RunOneTimeInstructions = false
+			if _, err := a.Apply(context.Background(), input); err != nil {
+				t.Fatal(err)
+			}
+			if again, err := os.ReadFile(record); err != nil || string(again) != string(recorded) {
+				t.Errorf("expected hooks not to be run again, found %q: %v", again, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package applyinator
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ImageDigestPolicy determines whether instructions may reference their image by tag alone.
+type ImageDigestPolicy string
+
+const (
+	// ImageDigestPolicyRequireDigest refuses images that are referenced by tag without a digest.
+	ImageDigestPolicyRequireDigest ImageDigestPolicy = "require-digest"
+	// ImageDigestPolicyRequireListed refuses images that are referenced by tag unless the instruction lists the digests
+	// that the tag may resolve to in imageDigests.
+	ImageDigestPolicyRequireListed ImageDigestPolicy = "require-listed"
+)
+
+// ImageDigestError is the failure of an instruction whose image reference is not allowed by the image digest policy,
+// or whose tag resolved to a digest that the instruction does not list.
+type ImageDigestError struct {
+	Image string
+	// Digest is the digest that the tag resolved to, which is empty when the reference was refused before resolving it.
+	Digest string
+	// IndexDigest is the digest of the index of the multi-platform image that the tag resolved to, if it was resolved.
+	IndexDigest string
+	Reason      string
+}
+
+func (e *ImageDigestError) Error() string {
+	if e.IndexDigest != "" {
+		return fmt.Sprintf("image %s resolved to digest %s of index %s: %s", e.Image, e.Digest, e.IndexDigest, e.Reason)
+	}
+	if e.Digest != "" {
+		return fmt.Sprintf("image %s resolved to digest %s: %s", e.Image, e.Digest, e.Reason)
+	}
+	return fmt.Sprintf("image %s: %s", e.Image, e.Reason)
+}
+
+// checkImageReference refuses an image reference that the image digest policy does not allow, before the image is
+// pulled. References that are pinned to a digest are always allowed.
+func (a *Applyinator) checkImageReference(image string, listed []string) error {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return err
+	}
+	if _, ok := ref.(name.Digest); ok {
+		return nil
+	}
+	switch a.options.ImageDigestPolicy {
+	case ImageDigestPolicyRequireDigest:
+		return &ImageDigestError{Image: image, Reason: "image is referenced by tag, but the image digest policy requires a digest"}
+	case ImageDigestPolicyRequireListed:
+		if len(listed) == 0 {
+			return &ImageDigestError{Image: image, Reason: "image is referenced by tag without imageDigests, but the image digest policy requires them"}
+		}
+	}
+	return nil
+}
+
+// checkImageDigest ensures that an image referenced by tag resolved to one of the digests listed by the instruction,
+// if it lists any. Either the digest of the platform image or of the index of a multi-platform image may be listed.
+func checkImageDigest(image, digest, indexDigest string, listed []string) error {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return err
+	}
+	if _, ok := ref.(name.Digest); ok || len(listed) == 0 || slices.Contains(listed, digest) {
+		return nil
+	}
+	if indexDigest != "" && slices.Contains(listed, indexDigest) {
+		return nil
+	}
+	return &ImageDigestError{Image: image, Digest: digest, IndexDigest: indexDigest, Reason: "digest is not listed in imageDigests"}
+}
@@ -0,0 +1,208 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	planapi "github.com/rancher/rancher/pkg/plan"
+
+	"github.com/rancher/system-agent/pkg/image"
+)
+
+func TestApplyImageDigest(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-image-digest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const imageName = "example.com/rancher/installer:v1"
+	imagesDir := filepath.Join(tempDir, "images")
+	writeTestImage(t, imagesDir, imageName, map[string][]byte{"run.sh": []byte("#!/bin/sh\necho installed\n")})
+	imageUtil := image.NewUtility(imagesDir, "", "", filepath.Join(tempDir, "registries.yaml"), image.Options{})
+	tag, err := name.NewTag(imageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := tarball.ImageFromPath(filepath.Join(imagesDir, "files.tar"), &tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := hash.String()
+	otherDigest := "sha256:" + strings.Repeat("0", 64)
+
+	testCases := []struct {
+		Name         string
+		Policy       ImageDigestPolicy
+		Image        string
+		ImageDigests []string
+
+		ExpectSucceeded bool
+		ExpectDigest    string
+	}{
+		{
+			Name:            "tag",
+			Image:           imageName,
+			ExpectSucceeded: true,
+			ExpectDigest:    digest,
+		},
+		{
+			Name:            "tag with listed digest",
+			Image:           imageName,
+			ImageDigests:    []string{otherDigest, digest},
+			ExpectSucceeded: true,
+			ExpectDigest:    digest,
+		},
+		{
+			Name:         "tag with other listed digest",
+			Image:        imageName,
+			ImageDigests: []string{otherDigest},
+			ExpectDigest: digest,
+		},
+		{
+			Name:   "tag refused",
+			Policy: ImageDigestPolicyRequireDigest,
+			Image:  imageName,
+		},
+		{
+			Name:            "digest required",
+			Policy:          ImageDigestPolicyRequireDigest,
+			Image:           imageName + "@" + digest,
+			ExpectSucceeded: true,
+			ExpectDigest:    digest,
+		},
+		{
+			Name:   "tag without listed digests refused",
+			Policy: ImageDigestPolicyRequireListed,
+			Image:  imageName,
+		},
+		{
+			Name:            "listed digest required",
+			Policy:          ImageDigestPolicyRequireListed,
+			Image:           imageName,
+			ImageDigests:    []string{digest},
+			ExpectSucceeded: true,
+			ExpectDigest:    digest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			a := NewApplyinator(filepath.Join(tempDir, "work"), false, "", "", imageUtil, Options{ImageDigestPolicy: tc.Policy})
+			input := ApplyInput{
+				CalculatedPlan: CalculatedPlan{
+					Plan: planapi.Plan{OneTimeInstructions: []planapi.OneTimeInstruction{
+						{CommonInstruction: planapi.CommonInstruction{Name: "install", Image: tc.Image}, SaveOutput: true},
+					}},
+					Extensions: PlanExtensions{OneTimeInstructions: []InstructionExtensions{{ImageDigests: tc.ImageDigests}}},
+					Checksum:   "checksum",
+				},
+				RunOneTimeInstructions:     true,
+				OneTimeInstructionAttempts: 1,
+			}
+
+			output, err := a.Apply(context.Background(), input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output.OneTimeApplySucceeded != tc.ExpectSucceeded {
+				t.Errorf("expected one-time apply succeeded %t", tc.ExpectSucceeded)
+			}
+			buffer, err := generateByteBufferFromBytes(output.OneTimeInstructionStatus)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var statuses map[string]OneTimeInstructionStatus
+			if err := json.Unmarshal(buffer.Bytes(), &statuses); err != nil {
+				t.Fatal(err)
+			}
+			if statuses["install"].ImageDigest != tc.ExpectDigest {
+				t.Errorf("expected image digest %q, found %q", tc.ExpectDigest, statuses["install"].ImageDigest)
+			}
+			buffer, err = generateByteBufferFromBytes(output.OneTimeOutput)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var outputs map[string][]byte
+			if err := json.Unmarshal(buffer.Bytes(), &outputs); err != nil {
+				t.Fatal(err)
+			}
+			if ran := string(outputs["install"]) == "installed\n"; ran != tc.ExpectSucceeded {
+				t.Errorf("expected instruction to run %t, found output %q", tc.ExpectSucceeded, outputs["install"])
+			}
+		})
+	}
+}
+
+func TestCheckImageDigest(t *testing.T) {
+	const imageName = "example.com/rancher/installer:v1"
+	digest := "sha256:" + strings.Repeat("1", 64)
+	indexDigest := "sha256:" + strings.Repeat("2", 64)
+	otherDigest := "sha256:" + strings.Repeat("0", 64)
+
+	testCases := []struct {
+		Name         string
+		Image        string
+		IndexDigest  string
+		ImageDigests []string
+		ExpectError  string
+	}{
+		{
+			Name:         "platform digest listed",
+			Image:        imageName,
+			IndexDigest:  indexDigest,
+			ImageDigests: []string{digest},
+		},
+		{
+			Name:         "index digest listed",
+			Image:        imageName,
+			IndexDigest:  indexDigest,
+			ImageDigests: []string{otherDigest, indexDigest},
+		},
+		{
+			Name:         "other digest listed",
+			Image:        imageName,
+			IndexDigest:  indexDigest,
+			ImageDigests: []string{otherDigest},
+			ExpectError:  "resolved to digest " + digest + " of index " + indexDigest,
+		},
+		{
+			Name:         "index not resolved",
+			Image:        imageName,
+			ImageDigests: []string{indexDigest},
+			ExpectError:  "resolved to digest " + digest + ": digest is not listed",
+		},
+		{
+			Name:         "pinned",
+			Image:        imageName + "@" + otherDigest,
+			ImageDigests: []string{indexDigest},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := checkImageDigest(tc.Image, digest, tc.IndexDigest, tc.ImageDigests)
+			if tc.ExpectError == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.ExpectError) {
+				t.Fatalf("expected error containing %q, found %v", tc.ExpectError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package applyinator
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxLineBytes is the length at which readLines splits long lines into chunks.
+const maxLineBytes = 64 * 1024
+
+// outputBuffer captures the output of an instruction. When limit is greater than zero and the output exceeds it, only
+// the head and the tail of the output are kept, each up to about half of the limit, separated by a marker that notes
+// how much of the output was truncated. Output is truncated at line boundaries where possible.
+type outputBuffer struct {
+	limit int
+
+	head     bytes.Buffer
+	headFull bool
+	// tail[start:] is the retained tail of the output. Dropped bytes are only compacted away once they make up half of
+	// tail, so that chatty instructions do not copy the tail for every line.
+	tail      []byte
+	start     int
+	truncated int64
+}
+
+func (b *outputBuffer) Write(p []byte) {
+	if b.limit <= 0 || (!b.headFull && b.head.Len()+len(p) <= b.limit/2) {
+		b.head.Write(p)
+		return
+	}
+	b.headFull = true
+	b.tail = append(b.tail, p...)
+	excess := len(b.tail) - b.start - (b.limit - b.head.Len())
+	if excess <= 0 {
+		return
+	}
+	cut := b.start + excess
+	if i := bytes.IndexByte(b.tail[cut:], '\n'); b.tail[cut-1] != '\n' && i >= 0 && cut+i+1 < len(b.tail) {
+		cut += i + 1
+	}
+	b.truncated += int64(cut - b.start)
+	b.start = cut
+	if b.start > len(b.tail)/2 {
+		b.tail = b.tail[:copy(b.tail, b.tail[b.start:])]
+		b.start = 0
+	}
+}
+
+// Bytes returns the captured output, with a truncation marker between its head and tail if it was truncated.
+func (b *outputBuffer) Bytes() []byte {
+	if len(b.tail) == b.start {
+		return b.head.Bytes()
+	}
+	output := append([]byte{}, b.head.Bytes()...)
+	if b.truncated > 0 {
+		output = append(output, truncationMarker(b.truncated)...)
+	}
+	return append(output, b.tail[b.start:]...)
+}
+
+// readLines reads the reader until EOF and calls fn with every line, without its line ending. Lines longer than
+// maxLineBytes are passed to fn in chunks, so that output without line breaks is still drained. fn owns the line.
+func readLines(reader io.Reader, fn func(line []byte)) error {
+	r := bufio.NewReaderSize(reader, maxLineBytes)
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			fn(append([]byte{}, chunk...))
+			continue
+		}
+		if len(chunk) > 0 {
+			line := bytes.TrimSuffix(bytes.TrimSuffix(chunk, []byte("\n")), []byte("\r"))
+			fn(append([]byte{}, line...))
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func truncationMarker(truncated int64) string {
+	return fmt.Sprintf("[output truncated: %d bytes omitted]\n", truncated)
+}
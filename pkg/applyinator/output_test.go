@@ -0,0 +1,116 @@
+package applyinator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestReadLines(t *testing.T) {
+	long := strings.Repeat("x", maxLineBytes)
+
+	testCases := []struct {
+		Name  string
+		Input string
+
+		ExpectedLines []string
+	}{
+		{
+			Name:  "lines",
+			Input: "line 01\r\n\nline 02\n",
+
+			ExpectedLines: []string{"line 01", "", "line 02"},
+		},
+		{
+			Name:  "without trailing line ending",
+			Input: "line 01\nline 02",
+
+			ExpectedLines: []string{"line 01", "line 02"},
+		},
+		{
+			Name:  "long line",
+			Input: long + long + "xx\nline 01\n",
+
+			ExpectedLines: []string{long, long, "xx", "line 01"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var lines []string
+			if err := readLines(strings.NewReader(tc.Input), func(line []byte) {
+				lines = append(lines, string(line))
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(lines, "|") != strings.Join(tc.ExpectedLines, "|") || len(lines) != len(tc.ExpectedLines) {
+				t.Errorf("expected %d lines, found %d: %.80q", len(tc.ExpectedLines), len(lines), lines)
+			}
+		})
+	}
+}
+
+func TestOutputBuffer(t *testing.T) {
+	lines := func(from, to int) []string {
+		var lines []string
+		for i := from; i <= to; i++ {
+			lines = append(lines, fmt.Sprintf("line %02d\n", i))
+		}
+		return lines
+	}
+
+	testCases := []struct {
+		Name  string
+		Limit int
+		Lines []string
+
+		ExpectedOutput string
+	}{
+		{
+			Name:  "unlimited",
+			Lines: lines(1, 20),
+
+			ExpectedOutput: strings.Join(lines(1, 20), ""),
+		},
+		{
+			Name:  "within limit",
+			Limit: 80,
+			Lines: lines(1, 10),
+
+			ExpectedOutput: strings.Join(lines(1, 10), ""),
+		},
+		{
+			Name:  "head and tail",
+			Limit: 40,
+			Lines: lines(1, 20),
+
+			ExpectedOutput: "line 01\nline 02\n" + truncationMarker(120) + "line 18\nline 19\nline 20\n",
+		},
+		{
+			Name:  "long last line",
+			Limit: 20,
+			Lines: []string{"line 01\n", strings.Repeat("x", 30) + "\n"},
+
+			ExpectedOutput: "line 01\n" + truncationMarker(19) + strings.Repeat("x", 11) + "\n",
+		},
+		{
+			Name:  "long line",
+			Limit: 20,
+			Lines: []string{"line 01\n", strings.Repeat("x", 30) + "\n", "line 02\n"},
+
+			ExpectedOutput: "line 01\n" + truncationMarker(31) + "line 02\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			b := outputBuffer{limit: tc.Limit}
+			for _, line := range tc.Lines {
+				b.Write([]byte(line))
+			}
+			if output := string(b.Bytes()); output != tc.ExpectedOutput {
+				t.Errorf("expected output %q, found %q", tc.ExpectedOutput, output)
+			}
+		})
+	}
+}
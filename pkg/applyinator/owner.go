@@ -0,0 +1,72 @@
+package applyinator
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// ownerResolver resolves user and group names to numeric ids through the user database of the node, caching the
+// results for the files of a plan.
+type ownerResolver struct {
+	users  map[string]int
+	groups map[string]int
+}
+
+func newOwnerResolver() *ownerResolver {
+	return &ownerResolver{
+		users:  map[string]int{},
+		groups: map[string]int{},
+	}
+}
+
+// resolve sets the UID and GID of the file from its user and group names, if set.
+func (r *ownerResolver) resolve(file *planFile) error {
+	if file.Extensions.User != "" {
+		uid, err := r.lookupUser(file.Extensions.User)
+		if err != nil {
+			return fmt.Errorf("unable to resolve user of file %s: %w", file.Path, err)
+		}
+		file.UID = uid
+	}
+	if file.Extensions.Group != "" {
+		gid, err := r.lookupGroup(file.Extensions.Group)
+		if err != nil {
+			return fmt.Errorf("unable to resolve group of file %s: %w", file.Path, err)
+		}
+		file.GID = gid
+	}
+	return nil
+}
+
+func (r *ownerResolver) lookupUser(name string) (int, error) {
+	if uid, ok := r.users[name]; ok {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return -1, fmt.Errorf("user %s does not have a numeric id: %s", name, u.Uid)
+	}
+	r.users[name] = uid
+	return uid, nil
+}
+
+func (r *ownerResolver) lookupGroup(name string) (int, error) {
+	if gid, ok := r.groups[name]; ok {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return -1, fmt.Errorf("group %s does not have a numeric id: %s", name, g.Gid)
+	}
+	r.groups[name] = gid
+	return gid, nil
+}
@@ -0,0 +1,82 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"os/user"
+	"strconv"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestOwnerResolver(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("unable to look up current user: %v", err)
+	}
+	group, err := user.LookupGroupId(current.Gid)
+	if err != nil {
+		t.Skipf("unable to look up group of current user: %v", err)
+	}
+	uid, _ := strconv.Atoi(current.Uid)
+	gid, _ := strconv.Atoi(group.Gid)
+
+	testCases := []struct {
+		Name       string
+		Extensions FileExtensions
+
+		ExpectedUID int
+		ExpectedGID int
+		ExpectedErr bool
+	}{
+		{
+			Name: "numeric ids",
+
+			ExpectedUID: 1234,
+			ExpectedGID: 5678,
+		},
+		{
+			Name:       "user and group names",
+			Extensions: FileExtensions{User: current.Username, Group: group.Name},
+
+			ExpectedUID: uid,
+			ExpectedGID: gid,
+		},
+		{
+			Name:       "unknown user",
+			Extensions: FileExtensions{User: "system-agent-test-missing-user"},
+
+			ExpectedErr: true,
+		},
+		{
+			Name:       "unknown group",
+			Extensions: FileExtensions{Group: "system-agent-test-missing-group"},
+
+			ExpectedErr: true,
+		},
+	}
+
+	r := newOwnerResolver()
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			file := planFile{
+				File:       planapi.File{Path: "/etc/test", UID: 1234, GID: 5678},
+				Extensions: tc.Extensions,
+			}
+			err := r.resolve(&file)
+			if tc.ExpectedErr {
+				if err == nil {
+					t.Error("expected error, returned successfully")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.UID != tc.ExpectedUID || file.GID != tc.ExpectedGID {
+				t.Errorf("expected %d:%d, found %d:%d", tc.ExpectedUID, tc.ExpectedGID, file.UID, file.GID)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package applyinator
+
+import (
+	"encoding/json"
+	"fmt"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+// PlanExtensions holds agent-specific plan fields that are not part of planapi.Plan. They are decoded from the same
+// raw plan, so the entries line up by index with the instructions of the plan.
+type PlanExtensions struct {
+	Files                []FileExtensions        `json:"files,omitempty"`
+	OneTimeInstructions  []InstructionExtensions `json:"instructions,omitempty"`
+	PeriodicInstructions []InstructionExtensions `json:"periodicInstructions,omitempty"`
+	// Redaction declares the sensitive values of the instructions of the plan.
+	Redaction Redaction `json:"redaction,omitempty"`
+	// PrefetchImagesWhileBlocked prefetches the images of the instructions of the plan while a pending restart of the
+	// agent blocks applying it, when the agent prefetches images.
+	PrefetchImagesWhileBlocked bool `json:"prefetchImagesWhileBlocked,omitempty"`
+}
+
+// InstructionExtensions holds the agent-specific fields of a single instruction.
+type InstructionExtensions struct {
+	// TimeoutSeconds overrides the default instruction timeout of the agent when greater than zero.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+	// SecurityContext overrides the fields of the default instruction security context of the agent that it sets.
+	SecurityContext SecurityContext `json:"securityContext,omitempty"`
+	// DependsOn lists the names of the one-time instructions that must succeed before this instruction is run. When any
+	// instruction of a plan declares dependencies, independent instructions are run concurrently.
+	DependsOn []string `json:"dependsOn,omitempty"`
+	// OutputMaxBytes overrides the maximum size of the output of the instruction that is kept when greater than zero.
+	OutputMaxBytes int `json:"outputMaxBytes,omitempty"`
+	// ImageDigests lists the digests that the image of the instruction may resolve to when it is referenced by tag,
+	// which are the digests of either the platform images or the indexes of multi-platform images. An image that
+	// resolves to another digest is not run.
+	ImageDigests []string `json:"imageDigests,omitempty"`
+}
+
+// FileExtensions holds the agent-specific fields of a single file.
+type FileExtensions struct {
+	// Template renders the decoded content of the file as a Go text/template with the NodeFacts of the node before it
+	// is written.
+	Template bool `json:"template,omitempty"`
+	// LinkTarget is the target of a file with the link action.
+	LinkTarget string `json:"linkTarget,omitempty"`
+	// LinkKind is either symlink, the default, or hardlink.
+	LinkKind string `json:"linkKind,omitempty"`
+	// Force allows a link to replace an existing regular file.
+	Force bool `json:"force,omitempty"`
+	// User and Group are the names of the owner of the file or directory, which are resolved on the node and take
+	// precedence over the numeric UID and GID.
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Source copies the content of the file from a file in an image instead of the inline content.
+	Source *FileSource `json:"source,omitempty"`
+	// Digest is the expected digest of the content of the file as it is written, either sha256:<hex> or sha512:<hex>.
+	// A file whose content does not have the digest fails the plan before any file is written.
+	Digest string `json:"digest,omitempty"`
+}
+
+// sourceDigest returns the digest that the source of the file is verified against.
+func (f FileExtensions) sourceDigest() string {
+	if f.Source != nil && f.Source.Digest != "" {
+		return f.Source.Digest
+	}
+	return f.Digest
+}
+
+func (f FileExtensions) linkKind() string {
+	if f.LinkKind == "" {
+		return linkKindSymlink
+	}
+	return f.LinkKind
+}
+
+// planFile is a file of a plan together with its agent-specific fields.
+type planFile struct {
+	planapi.File
+	Extensions FileExtensions
+	// ContentFile is the staged copy of the source of the file, which is written instead of Content when it is set.
+	ContentFile string
+}
+
+func parsePlanExtensions(rawPlan []byte) (PlanExtensions, error) {
+	var extensions PlanExtensions
+	if err := json.Unmarshal(rawPlan, &extensions); err != nil {
+		return PlanExtensions{}, fmt.Errorf("failed to parse plan extensions: %w", err)
+	}
+	return extensions, nil
+}
+
+// hasInstructionDependencies returns true if any one-time instruction declares dependencies, including an empty list.
+func (p PlanExtensions) hasInstructionDependencies() bool {
+	for _, instruction := range p.OneTimeInstructions {
+		if instruction.DependsOn != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (p PlanExtensions) file(index int) FileExtensions {
+	if index < 0 || index >= len(p.Files) {
+		return FileExtensions{}
+	}
+	return p.Files[index]
+}
+
+func (p PlanExtensions) oneTimeInstruction(index int) InstructionExtensions {
+	if index < 0 || index >= len(p.OneTimeInstructions) {
+		return InstructionExtensions{}
+	}
+	return p.OneTimeInstructions[index]
+}
+
+func (p PlanExtensions) periodicInstruction(index int) InstructionExtensions {
+	if index < 0 || index >= len(p.PeriodicInstructions) {
+		return InstructionExtensions{}
+	}
+	return p.PeriodicInstructions[index]
+}
@@ -0,0 +1,89 @@
+package applyinator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// imagePrefetch records the plan whose images were last prefetched, so that the images of a plan are prefetched once
+// however often the plan is applied.
+type imagePrefetch struct {
+	mu       sync.Mutex
+	checksum string
+}
+
+// prefetchImages starts prefetching the images of the instructions of a plan that is being applied in the background,
+// unless they were already prefetched for the plan. Images that the image digest policy refuses are not prefetched.
+func (a *Applyinator) prefetchImages(ctx context.Context, input ApplyInput) {
+	if !a.options.ImagePrefetch || a.imageUtil == nil || !input.RunOneTimeInstructions || input.DryRun {
+		return
+	}
+	checksum := input.CalculatedPlan.Checksum
+	a.prefetch.mu.Lock()
+	defer a.prefetch.mu.Unlock()
+	if a.prefetch.checksum == checksum {
+		return
+	}
+	a.prefetch.checksum = checksum
+
+	images := planImages(input.CalculatedPlan, a.checkImageReference)
+	if len(images) == 0 {
+		return
+	}
+	logrus.Infof("[Applyinator] Prefetching %d images of plan %s with up to %d workers", len(images), checksum, a.options.ImagePrefetchConcurrency)
+	wait, err := a.imageUtil.Prefetch(ctx, images, a.options.ImagePrefetchConcurrency)
+	if err != nil {
+		logrus.Errorf("[Applyinator] Unable to prefetch the images of plan %s: %v", checksum, err)
+		return
+	}
+	go func() {
+		if err := wait(); err != nil {
+			logrus.Warnf("[Applyinator] Some images of plan %s could not be prefetched and are pulled when their instructions are run", checksum)
+			return
+		}
+		logrus.Infof("[Applyinator] Prefetched the images of plan %s", checksum)
+	}()
+}
+
+// planImages returns the images of the one-time and periodic instructions of the plan in the order they are run,
+// without the images that check refuses.
+func planImages(plan CalculatedPlan, check func(image string, listed []string) error) []string {
+	var images []string
+	seen := map[string]bool{}
+	add := func(image string, extensions InstructionExtensions) {
+		if image == "" || seen[image] {
+			return
+		}
+		if err := check(image, extensions.ImageDigests); err != nil {
+			logrus.Debugf("[Applyinator] Not prefetching image: %v", err)
+			return
+		}
+		seen[image] = true
+		images = append(images, image)
+	}
+	for i, instruction := range plan.Plan.OneTimeInstructions {
+		add(instruction.Image, plan.Extensions.oneTimeInstruction(i))
+	}
+	for i, instruction := range plan.Plan.PeriodicInstructions {
+		add(instruction.Image, plan.Extensions.periodicInstruction(i))
+	}
+	return images
+}
+
+// restartPending returns true if a pending restart of the agent may block applying plans.
+func (a *Applyinator) restartPending() bool {
+	if a.interlockDir == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(a.interlockDir, restartPendingInterlockFile))
+	return err == nil
+}
+
+// prefetchWhileBlocked returns true if the images of the plan are prefetched while a pending restart blocks it.
+func (a *Applyinator) prefetchWhileBlocked(plan CalculatedPlan) bool {
+	return a.options.ImagePrefetchWhileBlocked || plan.Extensions.PrefetchImagesWhileBlocked
+}
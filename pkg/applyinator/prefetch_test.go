@@ -0,0 +1,124 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+
+	"github.com/rancher/system-agent/pkg/image"
+)
+
+func TestApplyImagePrefetch(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-image-prefetch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const imageName = "example.com/rancher/installer:v1"
+	imagesDir := filepath.Join(tempDir, "images")
+	writeTestImage(t, imagesDir, imageName, map[string][]byte{"run.sh": []byte("#!/bin/sh\necho installed\n")})
+
+	testCases := []struct {
+		Name            string
+		RestartPending  bool
+		Options         Options
+		WhileBlocked    bool
+		ExpectPrefetch  bool
+		ExpectSucceeded bool
+	}{
+		{
+			Name:            "disabled",
+			ExpectSucceeded: true,
+		},
+		{
+			Name:            "enabled",
+			Options:         Options{ImagePrefetch: true},
+			ExpectPrefetch:  true,
+			ExpectSucceeded: true,
+		},
+		{
+			Name:           "blocked",
+			RestartPending: true,
+			Options:        Options{ImagePrefetch: true},
+		},
+		{
+			Name:           "blocked with agent config",
+			RestartPending: true,
+			Options:        Options{ImagePrefetch: true, ImagePrefetchWhileBlocked: true},
+			ExpectPrefetch: true,
+		},
+		{
+			Name:           "blocked with plan flag",
+			RestartPending: true,
+			Options:        Options{ImagePrefetch: true},
+			WhileBlocked:   true,
+			ExpectPrefetch: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			root := t.TempDir()
+			interlockDir := filepath.Join(root, "interlock")
+			if err := os.MkdirAll(interlockDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tc.RestartPending {
+				if err := os.WriteFile(filepath.Join(interlockDir, restartPendingInterlockFile), []byte(time.Now().Format(time.UnixDate)), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cacheDir := filepath.Join(root, "cache")
+			imageUtil := image.NewUtility(imagesDir, "", "", filepath.Join(root, "registries.yaml"), image.Options{CacheDir: cacheDir})
+			a := NewApplyinator(filepath.Join(root, "work"), false, "", interlockDir, imageUtil, tc.Options)
+			input := ApplyInput{
+				CalculatedPlan: CalculatedPlan{
+					Plan: planapi.Plan{OneTimeInstructions: []planapi.OneTimeInstruction{
+						{CommonInstruction: planapi.CommonInstruction{Name: "install", Image: imageName}},
+					}},
+					Extensions: PlanExtensions{PrefetchImagesWhileBlocked: tc.WhileBlocked},
+					Checksum:   "checksum",
+				},
+				RunOneTimeInstructions:     true,
+				OneTimeInstructionAttempts: 1,
+			}
+
+			output, err := a.Apply(context.Background(), input)
+			if tc.RestartPending != (err != nil) {
+				t.Fatalf("expected apply to be blocked %t, found error %v", tc.RestartPending, err)
+			}
+			if output.OneTimeApplySucceeded != tc.ExpectSucceeded {
+				t.Errorf("expected one-time apply succeeded %t", tc.ExpectSucceeded)
+			}
+			if prefetched := a.prefetch.checksum == "checksum"; prefetched != tc.ExpectPrefetch {
+				t.Fatalf("expected images to be prefetched %t", tc.ExpectPrefetch)
+			}
+			if !tc.ExpectPrefetch {
+				return
+			}
+
+			// The image is prefetched in the background, even when the apply is blocked.
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				entries, err := image.ListCache(cacheDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) == 1 && entries[0].Image == imageName {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("expected image %s to be prefetched into the image cache, found %+v", imageName, entries)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package applyinator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+// FileChange is the kind of change a plan would make to a file.
+type FileChange string
+
+const (
+	FileChangeNone        FileChange = "none"
+	FileChangeCreate      FileChange = "create"
+	FileChangeModify      FileChange = "change"
+	FileChangeDelete      FileChange = "delete"
+	FileChangePermissions FileChange = "permissions"
+)
+
+// PlanPreview describes what applying a plan would do to the node without doing it.
+type PlanPreview struct {
+	Checksum             string               `json:"checksum"`
+	ReconcileFiles       bool                 `json:"reconcileFiles"`
+	Files                []FilePreview        `json:"files,omitempty"`
+	OneTimeInstructions  []InstructionPreview `json:"oneTimeInstructions,omitempty"`
+	PeriodicInstructions []InstructionPreview `json:"periodicInstructions,omitempty"`
+}
+
+// FilePreview describes the change that would be made to a single plan file.
+type FilePreview struct {
+	Path   string     `json:"path"`
+	Change FileChange `json:"change"`
+	// Details lists the differences in mode or ownership.
+	Details []string `json:"details,omitempty"`
+	// Diff is a unified diff of the file content against the content on disk.
+	Diff string `json:"diff,omitempty"`
+}
+
+// InstructionPreview describes whether an instruction would be run.
+type InstructionPreview struct {
+	Index   int      `json:"index"`
+	Name    string   `json:"name,omitempty"`
+	Image   string   `json:"image,omitempty"`
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	Run     bool     `json:"run"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+// preview computes the changes that applying the input would make. It does not execute or write anything.
+func (a *Applyinator) preview(now time.Time, input ApplyInput, redactor *redactor) (*PlanPreview, error) {
+	preview := &PlanPreview{
+		Checksum:       input.CalculatedPlan.Checksum,
+		ReconcileFiles: input.ReconcileFiles,
+	}
+
+	if input.ReconcileFiles {
+		files, err := a.renderFiles(input.CalculatedPlan)
+		if err != nil {
+			return preview, err
+		}
+		for _, file := range files {
+			filePreview, err := previewFile(file, true)
+			if err != nil {
+				return preview, fmt.Errorf("unable to preview file %s: %w", file.Path, err)
+			}
+			preview.Files = append(preview.Files, filePreview)
+		}
+	}
+
+	for index, instruction := range input.CalculatedPlan.Plan.OneTimeInstructions {
+		instructionPreview := newInstructionPreview(index, redactor.redactInstruction(instruction.CommonInstruction))
+		instructionPreview.Run = input.RunOneTimeInstructions
+		if !input.RunOneTimeInstructions {
+			instructionPreview.Reason = "plan has already been applied"
+		}
+		preview.OneTimeInstructions = append(preview.OneTimeInstructions, instructionPreview)
+	}
+
+	periodicOutputs, err := DecodePeriodicOutput(input.ExistingPeriodicOutput)
+	if err != nil {
+		return preview, err
+	}
+	for index, instruction := range input.CalculatedPlan.Plan.PeriodicInstructions {
+		instructionPreview := newInstructionPreview(index, redactor.redactInstruction(instruction.CommonInstruction))
+		if instruction.Name == "" {
+			instructionPreview.Reason = "periodic instruction does not have a name"
+		} else {
+			po, ok := periodicOutputs[instruction.Name]
+			schedule := schedulePeriodicInstruction(now, instruction, po, ok, input.RunOneTimeInstructions)
+			instructionPreview.Run = schedule.due
+			instructionPreview.Reason = schedule.reason
+		}
+		preview.PeriodicInstructions = append(preview.PeriodicInstructions, instructionPreview)
+	}
+
+	return preview, nil
+}
+
+func newInstructionPreview(index int, instruction planapi.CommonInstruction) InstructionPreview {
+	return InstructionPreview{
+		Index:   index,
+		Name:    instruction.Name,
+		Image:   instruction.Image,
+		Command: instruction.Command,
+		Args:    instruction.Args,
+	}
+}
+
+// previewFile compares a plan file against the disk. A content change is described by a unified diff when diff is set,
+// and by the checksums of the contents otherwise.
+func previewFile(file planFile, diff bool) (FilePreview, error) {
+	preview := FilePreview{
+		Path:   file.Path,
+		Change: FileChangeNone,
+	}
+	existing, err := os.Lstat(file.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return preview, err
+	}
+	exists := err == nil
+
+	if file.Action == deleteFileAction {
+		if exists {
+			preview.Change = FileChangeDelete
+		}
+		return preview, nil
+	}
+
+	if file.Action == linkFileAction {
+		kind := file.Extensions.linkKind()
+		linked, err := isLinkedTo(file.Path, file.Extensions.LinkTarget, kind)
+		if err != nil || linked {
+			return preview, err
+		}
+		preview.Change = FileChangeCreate
+		if exists {
+			preview.Change = FileChangeModify
+		}
+		preview.Details = []string{fmt.Sprintf("%s to %s", kind, file.Extensions.LinkTarget)}
+		return preview, nil
+	}
+
+	defaultPermissions := defaultFilePermissions
+	if file.Directory {
+		defaultPermissions = defaultDirectoryPermissions
+	}
+	perm := defaultPermissions
+	if file.Permissions != "" {
+		perm, err = parsePerm(file.Permissions)
+		if err != nil {
+			return preview, err
+		}
+	}
+
+	var content []byte
+	if !file.Directory && file.ContentFile == "" {
+		content, err = base64.StdEncoding.DecodeString(file.Content)
+		if err != nil {
+			return preview, err
+		}
+	}
+
+	if !exists {
+		preview.Change = FileChangeCreate
+		if !file.Directory && file.ContentFile == "" && diff {
+			preview.Diff, err = unifiedDiff(file.Path, nil, content)
+		}
+		return preview, err
+	}
+
+	if file.Directory != existing.IsDir() {
+		return preview, fmt.Errorf("%s exists but directory is %t", file.Path, existing.IsDir())
+	}
+
+	if file.ContentFile != "" || (!diff && !file.Directory && file.Extensions.Digest != "") {
+		// Content copied from an image, or with a digest when no diff is needed, is compared by its digest, as it may be
+		// too large to read into memory.
+		digest, err := parseContentDigest(file.Extensions.sourceDigest())
+		if err != nil {
+			return preview, err
+		}
+		existingDigest, err := digest.digestFile(file.Path)
+		if err != nil {
+			return preview, err
+		}
+		if existingDigest != digest.hex {
+			preview.Change = FileChangeModify
+			preview.Details = append(preview.Details, fmt.Sprintf("content %s %s -> %s", digest.algorithm, existingDigest, digest.hex))
+		}
+	} else if !file.Directory {
+		existingContent, err := os.ReadFile(file.Path)
+		if err != nil {
+			return preview, err
+		}
+		if !bytes.Equal(existingContent, content) {
+			preview.Change = FileChangeModify
+			if diff {
+				preview.Diff, err = unifiedDiff(file.Path, existingContent, content)
+				if err != nil {
+					return preview, err
+				}
+			} else {
+				preview.Details = append(preview.Details, fmt.Sprintf("content sha256 %x -> %x", sha256.Sum256(existingContent), sha256.Sum256(content)))
+			}
+		}
+	}
+
+	preview.Details = append(preview.Details, permissionDifferences(existing, file.UID, file.GID, perm)...)
+	if len(preview.Details) > 0 && preview.Change == FileChangeNone {
+		preview.Change = FileChangePermissions
+	}
+	return preview, nil
+}
+
+// permissionDifferences lists how the mode and ownership of an existing file differ from the desired ones. A uid or gid
+// of -1 is left unchanged by reconciliation and therefore never differs.
+func permissionDifferences(existing os.FileInfo, uid, gid int, perm os.FileMode) []string {
+	var details []string
+	if existing.Mode().Perm() != perm.Perm() {
+		details = append(details, fmt.Sprintf("mode %#o -> %#o", existing.Mode().Perm(), perm.Perm()))
+	}
+	if existingUID, existingGID, ok := fileOwner(existing); ok {
+		if uid != -1 && existingUID != uid {
+			details = append(details, fmt.Sprintf("uid %d -> %d", existingUID, uid))
+		}
+		if gid != -1 && existingGID != gid {
+			details = append(details, fmt.Sprintf("gid %d -> %d", existingGID, gid))
+		}
+	}
+	return details
+}
+
+func unifiedDiff(path string, from, to []byte) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(from)),
+		B:        difflib.SplitLines(string(to)),
+		FromFile: path + " (current)",
+		ToFile:   path + " (plan)",
+		Context:  3,
+	})
+}
@@ -0,0 +1,107 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestPreviewFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-preview-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := os.WriteFile(filepath.Join(tempDir, "existing"), []byte("a\nb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(tempDir, "existing-dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Name string
+		File planapi.File
+
+		ExpectedChange  FileChange
+		ExpectedDetails []string
+		ExpectedDiff    string
+	}{
+		{
+			Name: "create",
+			File: planapi.File{Path: "missing", Content: base64.StdEncoding.EncodeToString([]byte("new\n")), UID: -1, GID: -1},
+
+			ExpectedChange: FileChangeCreate,
+			ExpectedDiff:   "+new",
+		},
+		{
+			Name: "unchanged",
+			File: planapi.File{Path: "existing", Content: base64.StdEncoding.EncodeToString([]byte("a\nb\n")), UID: -1, GID: -1},
+
+			ExpectedChange: FileChangeNone,
+		},
+		{
+			Name: "change",
+			File: planapi.File{Path: "existing", Content: base64.StdEncoding.EncodeToString([]byte("a\nc\n")), UID: -1, GID: -1},
+
+			ExpectedChange: FileChangeModify,
+			ExpectedDiff:   "-b\n+c",
+		},
+		{
+			Name: "permissions",
+			File: planapi.File{Path: "existing", Content: base64.StdEncoding.EncodeToString([]byte("a\nb\n")), Permissions: "0644", UID: -1, GID: -1},
+
+			ExpectedChange:  FileChangePermissions,
+			ExpectedDetails: []string{"mode 0600 -> 0644"},
+		},
+		{
+			Name: "existing directory",
+			File: planapi.File{Path: "existing-dir", Directory: true, UID: -1, GID: -1},
+
+			ExpectedChange: FileChangeNone,
+		},
+		{
+			Name: "delete",
+			File: planapi.File{Path: "existing", Action: deleteFileAction},
+
+			ExpectedChange: FileChangeDelete,
+		},
+		{
+			Name: "delete missing",
+			File: planapi.File{Path: "missing", Action: deleteFileAction},
+
+			ExpectedChange: FileChangeNone,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			tc.File.Path = filepath.Join(tempDir, tc.File.Path)
+			preview, err := previewFile(planFile{File: tc.File}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if preview.Change != tc.ExpectedChange {
+				t.Errorf("expected change %s, found %s", tc.ExpectedChange, preview.Change)
+			}
+			if !reflect.DeepEqual(preview.Details, tc.ExpectedDetails) {
+				t.Errorf("expected details %v, found %v", tc.ExpectedDetails, preview.Details)
+			}
+			if !strings.Contains(preview.Diff, tc.ExpectedDiff) {
+				t.Errorf("expected diff to contain %q, found %q", tc.ExpectedDiff, preview.Diff)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(tempDir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected preview not to create files, stat returned %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package applyinator
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+	"github.com/sirupsen/logrus"
+)
+
+const redactedValue = "[REDACTED]"
+
+// Redaction declares the sensitive values of the instructions of a plan, which are masked in logs, in the saved output
+// of instructions and in applied plans.
+type Redaction struct {
+	// Env lists the names of environment variables whose values are sensitive.
+	Env []string `json:"env,omitempty"`
+	// Args lists the flags whose values are sensitive, such as --token. The value is either the argument following the
+	// flag or follows it after an equals sign.
+	Args []string `json:"args,omitempty"`
+	// Patterns are regular expressions that match sensitive values. Only the capture groups of a pattern are masked when
+	// it has any, and the whole match otherwise.
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// merge returns the union of both redactions.
+func (r Redaction) merge(other Redaction) Redaction {
+	return Redaction{
+		Env:      append(append([]string{}, r.Env...), other.Env...),
+		Args:     append(append([]string{}, r.Args...), other.Args...),
+		Patterns: append(append([]string{}, r.Patterns...), other.Patterns...),
+	}
+}
+
+// redactor masks the sensitive values of a plan. A nil redactor masks nothing.
+type redactor struct {
+	env  map[string]bool
+	args []string
+	// values are the sensitive values found in the instructions of the plan, longest first so that a value that
+	// contains another is masked in full.
+	values   [][]byte
+	patterns []*regexp.Regexp
+}
+
+// newRedactor returns the redactor of the plan. Patterns that do not compile are returned as an error and skipped, so
+// that the redactor can still be used.
+func newRedactor(plan planapi.Plan, redaction Redaction) (*redactor, error) {
+	r := &redactor{
+		env:  map[string]bool{},
+		args: redaction.Args,
+	}
+	seen := map[string]bool{}
+	addValue := func(value string) {
+		if value != "" && !seen[value] {
+			seen[value] = true
+			r.values = append(r.values, []byte(value))
+		}
+	}
+	for _, key := range redaction.Env {
+		r.env[key] = true
+		// Instructions inherit the environment of the agent, so its value of the variable is sensitive as well.
+		addValue(os.Getenv(key))
+	}
+	var errs []error
+	for _, pattern := range redaction.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid redaction pattern %q: %w", pattern, err))
+			continue
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	var instructions []planapi.CommonInstruction
+	for _, instruction := range plan.OneTimeInstructions {
+		instructions = append(instructions, instruction.CommonInstruction)
+	}
+	for _, instruction := range plan.PeriodicInstructions {
+		instructions = append(instructions, instruction.CommonInstruction)
+	}
+	for _, instruction := range instructions {
+		for _, env := range instruction.Env {
+			if key, value, ok := strings.Cut(env, "="); ok && r.env[key] {
+				addValue(value)
+			}
+		}
+		for i, arg := range instruction.Args {
+			for _, flag := range r.args {
+				if arg == flag && i+1 < len(instruction.Args) {
+					addValue(instruction.Args[i+1])
+				} else if value, ok := strings.CutPrefix(arg, flag+"="); ok {
+					addValue(value)
+				}
+			}
+		}
+	}
+	sort.SliceStable(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+	return r, errors.Join(errs...)
+}
+
+// redact masks the sensitive values and the matches of the patterns in data.
+func (r *redactor) redact(data []byte) []byte {
+	if r == nil {
+		return data
+	}
+	for _, value := range r.values {
+		if bytes.Contains(data, value) {
+			data = bytes.ReplaceAll(data, value, []byte(redactedValue))
+		}
+	}
+	for _, re := range r.patterns {
+		data = redactPattern(re, data)
+	}
+	return data
+}
+
+func (r *redactor) redactString(s string) string {
+	if r == nil {
+		return s
+	}
+	return string(r.redact([]byte(s)))
+}
+
+// redactPattern masks the capture groups of every match of the pattern in data, or the whole match if the pattern has
+// no capture groups.
+func redactPattern(re *regexp.Regexp, data []byte) []byte {
+	matches := re.FindAllSubmatchIndex(data, -1)
+	if len(matches) == 0 {
+		return data
+	}
+	var result []byte
+	last := 0
+	for _, match := range matches {
+		spans := [][]int{match[:2]}
+		if len(match) > 2 {
+			spans = nil
+			for i := 2; i < len(match); i += 2 {
+				spans = append(spans, match[i:i+2])
+			}
+		}
+		for _, span := range spans {
+			// Unmatched groups are -1, and nested groups are masked with their parent.
+			if span[0] < last || span[1] <= span[0] {
+				continue
+			}
+			result = append(result, data[last:span[0]]...)
+			result = append(result, redactedValue...)
+			last = span[1]
+		}
+	}
+	return append(result, data[last:]...)
+}
+
+// redactArgs returns the arguments with the values of sensitive flags and any other sensitive value masked.
+func (r *redactor) redactArgs(args []string) []string {
+	if r == nil || args == nil {
+		return args
+	}
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = r.redactString(arg)
+		for _, flag := range r.args {
+			if i > 0 && args[i-1] == flag {
+				redacted[i] = redactedValue
+			} else if strings.HasPrefix(arg, flag+"=") {
+				redacted[i] = flag + "=" + redactedValue
+			}
+		}
+	}
+	return redacted
+}
+
+// redactEnv returns the environment with the values of sensitive variables and any other sensitive value masked.
+func (r *redactor) redactEnv(env []string) []string {
+	if r == nil || env == nil {
+		return env
+	}
+	redacted := make([]string, len(env))
+	for i, entry := range env {
+		if key, _, ok := strings.Cut(entry, "="); ok && r.env[key] {
+			redacted[i] = key + "=" + redactedValue
+			continue
+		}
+		redacted[i] = r.redactString(entry)
+	}
+	return redacted
+}
+
+func (r *redactor) redactInstruction(instruction planapi.CommonInstruction) planapi.CommonInstruction {
+	instruction.Command = r.redactString(instruction.Command)
+	instruction.Args = r.redactArgs(instruction.Args)
+	instruction.Env = r.redactEnv(instruction.Env)
+	return instruction
+}
+
+// redactPlan returns a copy of the plan whose instructions and file contents have their sensitive values masked.
+func (r *redactor) redactPlan(plan planapi.Plan) planapi.Plan {
+	if r == nil {
+		return plan
+	}
+	files := make([]planapi.File, len(plan.Files))
+	for i, file := range plan.Files {
+		file.Content = r.redactContent(file.Content)
+		files[i] = file
+	}
+	oneTime := make([]planapi.OneTimeInstruction, len(plan.OneTimeInstructions))
+	for i, instruction := range plan.OneTimeInstructions {
+		instruction.CommonInstruction = r.redactInstruction(instruction.CommonInstruction)
+		oneTime[i] = instruction
+	}
+	periodic := make([]planapi.PeriodicInstruction, len(plan.PeriodicInstructions))
+	for i, instruction := range plan.PeriodicInstructions {
+		instruction.CommonInstruction = r.redactInstruction(instruction.CommonInstruction)
+		periodic[i] = instruction
+	}
+	if plan.Files != nil {
+		plan.Files = files
+	}
+	if plan.OneTimeInstructions != nil {
+		plan.OneTimeInstructions = oneTime
+	}
+	if plan.PeriodicInstructions != nil {
+		plan.PeriodicInstructions = periodic
+	}
+	return plan
+}
+
+// redactContent masks the sensitive values in the base64 encoded content of a file. Content that cannot be decoded is
+// returned as is.
+func (r *redactor) redactContent(content string) string {
+	decoded, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return content
+	}
+	redacted := r.redact(decoded)
+	if bytes.Equal(redacted, decoded) {
+		return content
+	}
+	return base64.StdEncoding.EncodeToString(redacted)
+}
+
+// newRedactor returns the redactor of the plan, which masks the sensitive values declared by the agent and the plan.
+func (a *Applyinator) newRedactor(cp CalculatedPlan) (*redactor, error) {
+	return newRedactor(cp.Plan, a.options.Redaction.merge(cp.Extensions.Redaction))
+}
+
+// RedactPlan returns a copy of the calculated plan whose instructions have their sensitive values masked, for logging
+// it.
+func (a *Applyinator) RedactPlan(cp CalculatedPlan) CalculatedPlan {
+	r, err := a.newRedactor(cp)
+	if err != nil {
+		logrus.Errorf("error in redaction of plan %s: %v", cp.Checksum, err)
+	}
+	cp.Plan = r.redactPlan(cp.Plan)
+	return cp
+}
@@ -0,0 +1,222 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestRedactor(t *testing.T) {
+	plan := planapi.Plan{
+		OneTimeInstructions: []planapi.OneTimeInstruction{{CommonInstruction: planapi.CommonInstruction{
+			Env:  []string{"TOKEN=envsecret", "PATH=/bin"},
+			Args: []string{"--token", "argsecret", "--password=eqsecret", "--name", "node"},
+		}}},
+	}
+	r, err := newRedactor(plan, Redaction{
+		Env:      []string{"TOKEN"},
+		Args:     []string{"--token", "--password"},
+		Patterns: []string{`key=(\w+)`, `AKIA[0-9A-Z]{4}`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Name  string
+		Input string
+
+		ExpectedOutput string
+	}{
+		{
+			Name:  "env value",
+			Input: "using envsecret",
+
+			ExpectedOutput: "using [REDACTED]",
+		},
+		{
+			Name:  "arg values",
+			Input: "argsecret and eqsecret",
+
+			ExpectedOutput: "[REDACTED] and [REDACTED]",
+		},
+		{
+			Name:  "pattern with group",
+			Input: "key=abc other key=def",
+
+			ExpectedOutput: "key=[REDACTED] other key=[REDACTED]",
+		},
+		{
+			Name:  "pattern without group",
+			Input: "id AKIA1234 used",
+
+			ExpectedOutput: "id [REDACTED] used",
+		},
+		{
+			Name:  "nothing sensitive",
+			Input: "node /bin",
+
+			ExpectedOutput: "node /bin",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if output := r.redactString(tc.Input); output != tc.ExpectedOutput {
+				t.Errorf("expected %q, found %q", tc.ExpectedOutput, output)
+			}
+		})
+	}
+
+	instruction := r.redactInstruction(plan.OneTimeInstructions[0].CommonInstruction)
+	if expected := []string{"TOKEN=[REDACTED]", "PATH=/bin"}; !reflect.DeepEqual(instruction.Env, expected) {
+		t.Errorf("expected env %v, found %v", expected, instruction.Env)
+	}
+	if expected := []string{"--token", "[REDACTED]", "--password=[REDACTED]", "--name", "node"}; !reflect.DeepEqual(instruction.Args, expected) {
+		t.Errorf("expected args %v, found %v", expected, instruction.Args)
+	}
+	if plan.OneTimeInstructions[0].Args[1] != "argsecret" {
+		t.Error("expected the plan not to be modified")
+	}
+
+	if _, err := newRedactor(plan, Redaction{Patterns: []string{"("}}); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
+
+func TestApplyRedaction(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-redact-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	appliedPlanDir := filepath.Join(tempDir, "applied")
+	logDir := filepath.Join(tempDir, "logs")
+	secretFile := filepath.Join(tempDir, "secret")
+	a := NewApplyinator(filepath.Join(tempDir, "work"), false, appliedPlanDir, "", nil, Options{
+		InstructionLogDir: logDir,
+		Redaction:         Redaction{Env: []string{"TOKEN"}},
+	})
+	input := ApplyInput{
+		CalculatedPlan: CalculatedPlan{
+			Plan: planapi.Plan{
+				Files: []planapi.File{
+					{Path: secretFile, Content: base64.StdEncoding.EncodeToString([]byte("token: supersecret\n")), UID: -1, GID: -1},
+				},
+				OneTimeInstructions: []planapi.OneTimeInstruction{{
+					CommonInstruction: planapi.CommonInstruction{Name: "one-time", Command: "/bin/sh", Args: []string{"-c", "echo token $TOKEN"}, Env: []string{"TOKEN=supersecret"}},
+					SaveOutput:        true,
+				}, {
+					// The error of an instruction that cannot be started has its command.
+					CommonInstruction: planapi.CommonInstruction{Name: "missing", Command: "/nonexistent/supersecret"},
+				}},
+				PeriodicInstructions: []planapi.PeriodicInstruction{{
+					CommonInstruction: planapi.CommonInstruction{Name: "periodic", Command: "/bin/sh", Args: []string{"-c", "echo password hunter2 >&2", "--password", "hunter2"}},
+					SaveStderrOutput:  true,
+				}},
+			},
+			Extensions: PlanExtensions{Redaction: Redaction{Args: []string{"--password"}}},
+			Checksum:   "checksum",
+		},
+		ReconcileFiles:         true,
+		RunOneTimeInstructions: true,
+	}
+	output, err := a.Apply(context.Background(), input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oneTimeOutput, err := generateByteBufferFromBytes(output.OneTimeOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var oneTimeOutputs map[string][]byte
+	if err := json.Unmarshal(oneTimeOutput.Bytes(), &oneTimeOutputs); err != nil {
+		t.Fatal(err)
+	}
+	if string(oneTimeOutputs["one-time"]) != "token [REDACTED]\n" {
+		t.Errorf("unexpected one-time output %q", oneTimeOutputs["one-time"])
+	}
+	periodicOutputs, err := DecodePeriodicOutput(output.PeriodicOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stderr := string(periodicOutputs["periodic"].Stderr); stderr != "password [REDACTED]\n" {
+		t.Errorf("unexpected periodic output %q", stderr)
+	}
+
+	plans, err := ListAppliedPlans(appliedPlanDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plans) != 1 {
+		t.Fatalf("expected 1 applied plan, found %d", len(plans))
+	}
+	recorded, err := json.Marshal(plans[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(recorded), "supersecret") || strings.Contains(string(recorded), "hunter2") {
+		t.Errorf("expected applied plan to be redacted, found %s", recorded)
+	}
+	if content, err := base64.StdEncoding.DecodeString(plans[0].Plan.Files[0].Content); err != nil || string(content) != "token: [REDACTED]\n" {
+		t.Errorf("expected file content of applied plan to be redacted, found %q: %v", content, err)
+	}
+	if content, err := os.ReadFile(secretFile); err != nil || string(content) != "token: supersecret\n" {
+		t.Errorf("expected file to be written unredacted, found %q: %v", content, err)
+	}
+
+	runs, err := ListRuns(logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recordedErrors int
+	for _, run := range runs {
+		for _, instruction := range run.Runs {
+			if instruction.Error != "" {
+				recordedErrors++
+			}
+			if strings.Contains(instruction.Error, "supersecret") {
+				t.Errorf("expected instruction error to be redacted, found %s", instruction.Error)
+			}
+			content, err := ReadRunLog(logDir, run.ID, instruction.LogFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(content), "supersecret") || strings.Contains(string(content), "hunter2") {
+				t.Errorf("expected instruction log to be redacted, found %s", content)
+			}
+		}
+	}
+	if recordedErrors == 0 {
+		t.Error("expected the error of the missing instruction to be recorded")
+	}
+
+	// A plan with an invalid pattern is still applied, and redacted with the patterns that compile.
+	input.CalculatedPlan.Extensions.Redaction.Patterns = []string{"(", "token"}
+	input.CalculatedPlan.Checksum = "invalid-pattern"
+	output, err = a.Apply(context.Background(), input)
+	if err != nil {
+		t.Fatalf("expected plan with an invalid redaction pattern to be applied, found %v", err)
+	}
+	oneTimeOutput, err = generateByteBufferFromBytes(output.OneTimeOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(oneTimeOutput.Bytes(), &oneTimeOutputs); err != nil {
+		t.Fatal(err)
+	}
+	if string(oneTimeOutputs["one-time"]) != "[REDACTED] [REDACTED]\n" {
+		t.Errorf("unexpected one-time output %q", oneTimeOutputs["one-time"])
+	}
+}
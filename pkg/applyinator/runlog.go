@@ -0,0 +1,409 @@
+package applyinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+	"github.com/sirupsen/logrus"
+)
+
+const runManifestFile = "manifest.json"
+const defaultInstructionLogMaxBytes = 10 * 1024 * 1024
+const defaultInstructionLogMaxFiles = 3
+
+// RunManifest is the record of the instructions that were run while applying a plan once, which is kept in the
+// instruction log directory together with their logs.
+type RunManifest struct {
+	Checksum   string           `json:"checksum"`
+	StartedAt  time.Time        `json:"startedAt"`
+	FinishedAt *time.Time       `json:"finishedAt,omitempty"`
+	Runs       []InstructionRun `json:"instructions"`
+
+	// ID is the name of the directory of the run in the instruction log directory, which is the time the run started
+	// at followed by the checksum of the plan. It is set when the manifest is read.
+	ID string `json:"-"`
+}
+
+// InstructionRun is the record of a single run of an instruction.
+type InstructionRun struct {
+	Name string `json:"name,omitempty"`
+	// Index is the index of the instruction in the one-time or periodic instructions of the plan.
+	Index            int        `json:"index"`
+	Periodic         bool       `json:"periodic,omitempty"`
+	Attempt          int        `json:"attempt"`
+	Image            string     `json:"image,omitempty"`
+	ImageDigest      string     `json:"imageDigest,omitempty"`
+	ImageIndexDigest string     `json:"imageIndexDigest,omitempty"`
+	StartedAt        time.Time  `json:"startedAt"`
+	FinishedAt       *time.Time `json:"finishedAt,omitempty"`
+	ExitCode         int        `json:"exitCode"`
+	TimedOut         bool       `json:"timedOut,omitempty"`
+	Error            string     `json:"error,omitempty"`
+	// LogFile is the name of the log file of the instruction in the directory of the run.
+	LogFile string `json:"logFile"`
+}
+
+// runLog writes the logs and manifest of the instructions run by a single apply. Its directory is only created once an
+// instruction is run. A nil runLog discards everything.
+type runLog struct {
+	root      string
+	dir       string
+	maxBytes  int64
+	maxFiles  int
+	retention int
+	// redactor masks the sensitive values of the plan in the recorded errors of its instructions.
+	redactor *redactor
+
+	mu       sync.Mutex
+	manifest RunManifest
+	started  bool
+}
+
+// instructionLog is the log of a single instruction run.
+type instructionLog struct {
+	run   *runLog
+	index int
+	file  *rotatingFile
+}
+
+// newRunLog returns the run log of an apply, or nil when no instruction log directory is configured.
+func (a *Applyinator) newRunLog(now time.Time, checksum string, redactor *redactor) *runLog {
+	if a.options.InstructionLogDir == "" {
+		return nil
+	}
+	return &runLog{
+		root:      a.options.InstructionLogDir,
+		dir:       filepath.Join(a.options.InstructionLogDir, now.Format(applyinatorDateCodeLayout)+"-"+checksum),
+		maxBytes:  a.options.InstructionLogMaxBytes,
+		maxFiles:  a.options.InstructionLogMaxFiles,
+		retention: a.options.InstructionLogRetentionCount,
+		redactor:  redactor,
+		manifest: RunManifest{
+			Checksum:  checksum,
+			StartedAt: now,
+		},
+	}
+}
+
+// start records that an instruction is run and returns the log that its output is written to.
+func (r *runLog) start(index int, periodic bool, instruction planapi.CommonInstruction, attempt int) *instructionLog {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.started {
+		if err := os.MkdirAll(r.dir, 0700); err != nil {
+			logrus.Errorf("error creating instruction log directory %s: %v", r.dir, err)
+			return nil
+		}
+		r.started = true
+	}
+	kind := "instruction"
+	if periodic {
+		kind = "periodic"
+	}
+	run := InstructionRun{
+		Name:      instruction.Name,
+		Index:     index,
+		Periodic:  periodic,
+		Attempt:   attempt,
+		Image:     instruction.Image,
+		StartedAt: time.Now(),
+		LogFile:   fmt.Sprintf("%s-%d.log", kind, index),
+	}
+	r.manifest.Runs = append(r.manifest.Runs, run)
+	r.writeManifest()
+	return &instructionLog{
+		run:   r,
+		index: len(r.manifest.Runs) - 1,
+		file:  &rotatingFile{path: filepath.Join(r.dir, run.LogFile), maxBytes: r.maxBytes, maxFiles: r.maxFiles},
+	}
+}
+
+// finish records the end of the run in the manifest and applies the retention policy of the instruction log directory.
+func (r *runLog) finish() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.started {
+		return
+	}
+	now := time.Now()
+	r.manifest.FinishedAt = &now
+	r.writeManifest()
+	if err := pruneRuns(r.root, r.retention); err != nil {
+		logrus.Errorf("error while applying instruction log retention policy: %v", err)
+	}
+}
+
+// pruneRuns removes all but the newest retention runs that ran one-time instructions, and separately all but the
+// newest retention runs that only ran periodic instructions, so that frequent periodic runs do not push out the logs of
+// the one-time instructions. Runs without a readable manifest count as periodic runs.
+func pruneRuns(root string, retention int) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var oneTime, periodic []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if manifest, err := readRunManifest(root, entry.Name()); err == nil && manifest.oneTime() {
+			oneTime = append(oneTime, entry.Name())
+		} else {
+			periodic = append(periodic, entry.Name())
+		}
+	}
+	for _, dirs := range [][]string{oneTime, periodic} {
+		if len(dirs) <= retention {
+			continue
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs[:len(dirs)-retention] {
+			logrus.Debugf("[Applyinator] Removing instruction log %s (retention policy count: %d)", dir, retention)
+			if err := os.RemoveAll(filepath.Join(root, dir)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// oneTime returns true if the run ran any one-time instruction.
+func (m RunManifest) oneTime() bool {
+	for _, run := range m.Runs {
+		if !run.Periodic {
+			return true
+		}
+	}
+	return false
+}
+
+// writeManifest writes the manifest to the directory of the run. The caller must hold the lock of the run log.
+func (r *runLog) writeManifest() {
+	data, err := json.MarshalIndent(r.manifest, "", "  ")
+	if err != nil {
+		logrus.Errorf("error marshalling instruction log manifest: %v", err)
+		return
+	}
+	if err := writeContentToFile(filepath.Join(r.dir, runManifestFile), os.Getuid(), os.Getgid(), 0600, data); err != nil {
+		logrus.Errorf("error writing instruction log manifest: %v", err)
+	}
+}
+
+// stream returns a writer that prefixes every line written to it with the time and the name of the stream before
+// writing it to the log.
+func (l *instructionLog) stream(name string) io.Writer {
+	if l == nil {
+		return io.Discard
+	}
+	return streamWriter{file: l.file, name: name}
+}
+
+// setImageDigest records the digest of the image of the instruction and of its index.
+func (l *instructionLog) setImageDigest(digest, indexDigest string) {
+	if l == nil {
+		return
+	}
+	l.run.mu.Lock()
+	defer l.run.mu.Unlock()
+	l.run.manifest.Runs[l.index].ImageDigest = digest
+	l.run.manifest.Runs[l.index].ImageIndexDigest = indexDigest
+}
+
+// finish closes the log and records the result of the instruction in the manifest.
+func (l *instructionLog) finish(result executionResult, err error) {
+	if l == nil {
+		return
+	}
+	if closeErr := l.file.Close(); closeErr != nil {
+		logrus.Errorf("error closing instruction log %s: %v", l.file.path, closeErr)
+	}
+	l.run.mu.Lock()
+	defer l.run.mu.Unlock()
+	now := time.Now()
+	run := &l.run.manifest.Runs[l.index]
+	run.FinishedAt = &now
+	run.ExitCode = result.exitCode
+	run.TimedOut = result.status.TimedOut
+	if err != nil {
+		run.Error = l.run.redactor.redactString(err.Error())
+	}
+	l.run.writeManifest()
+}
+
+type streamWriter struct {
+	file *rotatingFile
+	name string
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	if _, err := fmt.Fprintf(w.file, "%s %s: %s", time.Now().Format(time.RFC3339), w.name, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// rotatingFile is a file that is rotated once writing to it would make it larger than maxBytes. The current file is
+// renamed to path.1, path.1 to path.2 and so on, keeping at most maxFiles rotated files. A write that fails disables
+// the file, so that a full disk does not interrupt the instruction.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	failed bool
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed {
+		return len(p), nil
+	}
+	if err := f.write(p); err != nil {
+		logrus.Errorf("error writing instruction log %s, no further output is logged to it: %v", f.path, err)
+		f.failed = true
+	}
+	return len(p), nil
+}
+
+func (f *rotatingFile) write(p []byte) error {
+	if f.file != nil && f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+		f.file = nil
+		for i := f.maxFiles; i > 0; i-- {
+			src := f.path
+			if i > 1 {
+				src = f.path + "." + strconv.Itoa(i-1)
+			}
+			if err := os.Rename(src, f.path+"."+strconv.Itoa(i)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if f.maxFiles == 0 {
+			if err := os.Remove(f.path); err != nil {
+				return err
+			}
+		}
+		f.size = 0
+	}
+	if f.file == nil {
+		file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		f.file = file
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// ListRuns returns the manifests of the runs in the instruction log directory, oldest first.
+func ListRuns(logDir string) ([]RunManifest, error) {
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var runs []RunManifest
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		manifest, err := readRunManifest(logDir, entry.Name())
+		if err != nil {
+			logrus.Warnf("[Applyinator] Skipping instruction log %s: %v", entry.Name(), err)
+			continue
+		}
+		runs = append(runs, manifest)
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].ID < runs[j].ID
+	})
+	return runs, nil
+}
+
+func readRunManifest(logDir, id string) (RunManifest, error) {
+	var manifest RunManifest
+	data, err := os.ReadFile(filepath.Join(logDir, id, runManifestFile))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("unable to parse manifest: %w", err)
+	}
+	manifest.ID = id
+	return manifest, nil
+}
+
+// ReadRunLog returns the log of an instruction of a run, including the part of it that was rotated.
+func ReadRunLog(logDir, id, logFile string) ([]byte, error) {
+	for _, name := range []string{id, logFile} {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("invalid instruction log %s/%s", id, logFile)
+		}
+	}
+	path := filepath.Join(logDir, id, logFile)
+	rotated, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var suffixes []int
+	for _, file := range rotated {
+		if suffix, err := strconv.Atoi(strings.TrimPrefix(file, path+".")); err == nil {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+	// The rotated file with the highest suffix is the oldest.
+	sort.Sort(sort.Reverse(sort.IntSlice(suffixes)))
+	var content []byte
+	for _, suffix := range suffixes {
+		data, err := os.ReadFile(path + "." + strconv.Itoa(suffix))
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, data...)
+	}
+	// The log file is only created once the instruction writes output.
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(content, data...), nil
+}
@@ -0,0 +1,129 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestInstructionLogs(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-runlog-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	logDir := filepath.Join(tempDir, "logs")
+	a := NewApplyinator(filepath.Join(tempDir, "work"), false, "", "", nil, Options{
+		InstructionLogDir:            logDir,
+		InstructionLogMaxBytes:       64,
+		InstructionLogMaxFiles:       1,
+		InstructionLogRetentionCount: 2,
+	})
+
+	// Nothing is logged when no instruction is run.
+	if _, err := a.Apply(context.Background(), ApplyInput{CalculatedPlan: CalculatedPlan{Checksum: "empty"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(logDir); !os.IsNotExist(err) {
+		t.Fatalf("expected no instruction log directory, found: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		input := ApplyInput{
+			CalculatedPlan: CalculatedPlan{
+				Plan: planapi.Plan{OneTimeInstructions: []planapi.OneTimeInstruction{
+					{CommonInstruction: planapi.CommonInstruction{Name: "output", Command: "/bin/sh", Args: []string{"-c", "for i in 1 2 3 4 5 6; do echo line $i; done"}}},
+					{CommonInstruction: planapi.CommonInstruction{Name: "fail", Command: "/bin/sh", Args: []string{"-c", "echo error >&2; exit 1"}}},
+				}},
+				Checksum: fmt.Sprintf("checksum%d", i),
+			},
+			RunOneTimeInstructions:     true,
+			OneTimeInstructionAttempts: i + 1,
+		}
+		// The runs are named by the second they started in.
+		if err := os.MkdirAll(filepath.Join(logDir, fmt.Sprintf("20000101-00000%d-older", i)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Apply(context.Background(), input); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Runs of periodic instructions are retained separately, and do not push out the runs of one-time instructions.
+	for i := 0; i < 3; i++ {
+		input := ApplyInput{
+			CalculatedPlan: CalculatedPlan{
+				Plan: planapi.Plan{PeriodicInstructions: []planapi.PeriodicInstruction{
+					{CommonInstruction: planapi.CommonInstruction{Name: "periodic", Command: "/bin/true"}},
+				}},
+				Checksum: fmt.Sprintf("periodic%d", i),
+			},
+		}
+		if _, err := a.Apply(context.Background(), input); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runs, err := ListRuns(logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 4 {
+		t.Fatalf("expected 4 runs to be kept, found %d", len(runs))
+	}
+	var periodicRuns []RunManifest
+	for _, run := range runs {
+		if !run.oneTime() {
+			periodicRuns = append(periodicRuns, run)
+		}
+	}
+	if len(periodicRuns) != 2 || periodicRuns[1].Checksum != "periodic2" {
+		t.Fatalf("expected the 2 newest periodic runs to be kept, found %+v", periodicRuns)
+	}
+	runs = slices.DeleteFunc(runs, func(run RunManifest) bool {
+		return !run.oneTime()
+	})
+	run := runs[1]
+	if run.Checksum != "checksum2" || run.FinishedAt == nil || len(run.Runs) != 2 {
+		t.Fatalf("unexpected manifest %+v", run)
+	}
+	if output := run.Runs[0]; output.Name != "output" || output.Attempt != 3 || output.ExitCode != 0 || output.FinishedAt == nil {
+		t.Errorf("unexpected instruction run %+v", output)
+	}
+	if fail := run.Runs[1]; fail.Name != "fail" || fail.ExitCode != 1 || fail.LogFile != "instruction-1.log" {
+		t.Errorf("unexpected instruction run %+v", fail)
+	}
+
+	// The log is rotated once it exceeds its maximum size, keeping a single rotated file.
+	if _, err := os.Stat(filepath.Join(logDir, run.ID, "instruction-0.log.1")); err != nil {
+		t.Errorf("expected rotated log: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(logDir, run.ID, "instruction-0.log.2")); !os.IsNotExist(err) {
+		t.Errorf("expected a single rotated log: %v", err)
+	}
+	content, err := ReadRunLog(logDir, run.ID, run.Runs[0].LogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "stdout: line 6\n") {
+		t.Errorf("unexpected log %q", content)
+	}
+	if strings.Contains(string(content), "line 1\n") {
+		t.Errorf("expected the oldest output to be rotated out, found %q", content)
+	}
+	if content, err := ReadRunLog(logDir, run.ID, run.Runs[1].LogFile); err != nil || !strings.HasSuffix(string(content), " stderr: error\n") {
+		t.Errorf("unexpected log %q: %v", content, err)
+	}
+	if _, err := ReadRunLog(logDir, "..", "manifest.json"); err == nil {
+		t.Error("expected error reading log outside of the instruction log directory")
+	}
+}
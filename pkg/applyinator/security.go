@@ -0,0 +1,74 @@
+package applyinator
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// SecurityContext configures the user, groups and privileges an instruction is run with.
+type SecurityContext struct {
+	// UID and GID are the user and group the instruction is run as. Unset values default to root.
+	UID *int `json:"uid,omitempty"`
+	GID *int `json:"gid,omitempty"`
+	// SupplementalGroups replaces the supplementary groups of the instruction when UID or GID is set.
+	SupplementalGroups []int `json:"supplementalGroups,omitempty"`
+	// Capabilities is the set of Linux capabilities the instruction is allowed to hold, e.g. CAP_NET_BIND_SERVICE. When
+	// nil, the capabilities are left untouched, i.e. all for root and none for other users.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// NoNewPrivs sets no_new_privs for the instruction so that it cannot gain privileges through setuid binaries or
+	// file capabilities.
+	NoNewPrivs bool `json:"noNewPrivs,omitempty"`
+}
+
+// merge returns the security context with the fields that are set in override replaced.
+func (s SecurityContext) merge(override SecurityContext) SecurityContext {
+	if override.UID != nil {
+		s.UID = override.UID
+	}
+	if override.GID != nil {
+		s.GID = override.GID
+	}
+	if override.SupplementalGroups != nil {
+		s.SupplementalGroups = override.SupplementalGroups
+	}
+	if override.Capabilities != nil {
+		s.Capabilities = override.Capabilities
+	}
+	if override.NoNewPrivs {
+		s.NoNewPrivs = true
+	}
+	return s
+}
+
+// isSet returns true if the security context changes anything about how an instruction is run.
+func (s SecurityContext) isSet() bool {
+	return s.changesOwner() || s.Capabilities != nil || s.NoNewPrivs
+}
+
+// changesOwner returns true if the instruction is run as a user or group other than the agent's.
+func (s SecurityContext) changesOwner() bool {
+	return s.UID != nil || s.GID != nil
+}
+
+// owner returns the uid and gid the instruction is run as.
+func (s SecurityContext) owner() (int, int) {
+	uid, gid := 0, 0
+	if s.UID != nil {
+		uid = *s.UID
+	}
+	if s.GID != nil {
+		gid = *s.GID
+	}
+	return uid, gid
+}
+
+// chownRecursive changes the owner of path and everything below it without following symlinks.
+func chownRecursive(path string, uid, gid int) error {
+	return filepath.WalkDir(path, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
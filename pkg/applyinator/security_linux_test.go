@@ -0,0 +1,151 @@
+//go:build linux
+
+package applyinator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+
+	"github.com/rancher/system-agent/pkg/image"
+)
+
+func TestExecuteSecurityContext(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must be run as root to change the user of an instruction")
+	}
+
+	tempDir, err := os.MkdirTemp("", "test-security-context-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := os.Chmod(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	nobody := 65534
+	a := NewApplyinator(tempDir, true, "", "", nil, Options{
+		SecurityContext: SecurityContext{UID: &nobody, GID: &nobody},
+	})
+
+	testCases := []struct {
+		Name       string
+		Args       []string
+		Extensions InstructionExtensions
+
+		ExpectedOutput string
+	}{
+		{
+			Name: "default user",
+			Args: []string{"-c", "id -u; id -g"},
+
+			ExpectedOutput: "65534\n65534\n",
+		},
+		{
+			Name: "working directory owner",
+			Args: []string{"-c", "stat -c %u:%g ."},
+
+			ExpectedOutput: "65534:65534\n",
+		},
+		{
+			Name:       "no new privs",
+			Args:       []string{"-c", "grep NoNewPrivs /proc/self/status | cut -f2"},
+			Extensions: InstructionExtensions{SecurityContext: SecurityContext{NoNewPrivs: true}},
+
+			ExpectedOutput: "1\n",
+		},
+		{
+			Name:       "restricted capabilities as root",
+			Args:       []string{"-c", "grep CapBnd /proc/self/status | cut -f2"},
+			Extensions: InstructionExtensions{SecurityContext: SecurityContext{UID: new(int), Capabilities: []string{"CHOWN"}}},
+
+			ExpectedOutput: "0000000000000001\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			instruction := planapi.CommonInstruction{
+				Command: "/bin/sh",
+				Args:    tc.Args,
+			}
+			result, err := a.execute(context.Background(), tc.Name, filepath.Join(tempDir, strings.ReplaceAll(tc.Name, " ", "-")), instruction, tc.Extensions, false, 1, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.exitCode != 0 {
+				t.Fatalf("expected exit code 0, found %d: %s", result.exitCode, result.stderr)
+			}
+			if string(result.stdout) != tc.ExpectedOutput {
+				t.Errorf("expected output %q, found %q", tc.ExpectedOutput, result.stdout)
+			}
+		})
+	}
+}
+
+func TestExecuteSecurityContextImageCache(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must be run as root to change the user of an instruction")
+	}
+
+	tempDir, err := os.MkdirTemp("", "test-security-context-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	if err := os.Chmod(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	const imageName = "example.com/rancher/installer:v1"
+	imagesDir := filepath.Join(tempDir, "images")
+	writeTestImage(t, imagesDir, imageName, map[string][]byte{"run.sh": []byte("#!/bin/sh\necho installed\n")})
+	cacheDir := filepath.Join(tempDir, "cache")
+	imageUtil := image.NewUtility(imagesDir, "", "", filepath.Join(tempDir, "registries.yaml"), image.Options{CacheDir: cacheDir, CacheHardlink: true})
+
+	nobody := 65534
+	a := NewApplyinator(tempDir, true, "", "", imageUtil, Options{})
+	instruction := planapi.CommonInstruction{
+		Image:   imageName,
+		Command: "/bin/sh",
+		Args:    []string{"-c", "echo tampered > run.sh"},
+	}
+	extensions := InstructionExtensions{SecurityContext: SecurityContext{UID: &nobody, GID: &nobody}}
+	result, err := a.execute(context.Background(), "tamper", filepath.Join(tempDir, "tamper"), instruction, extensions, false, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.exitCode != 0 {
+		t.Fatalf("expected exit code 0, found %d: %s", result.exitCode, result.stderr)
+	}
+
+	// The files of the image are copied for an instruction that runs as another user, which cannot alter the cache.
+	entries, err := image.ListCache(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected a single cache entry, found %+v", entries)
+	}
+	cached := filepath.Join(cacheDir, strings.Replace(entries[0].Digest, ":", "-", 1), "rootfs", "run.sh")
+	content, err := os.ReadFile(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "#!/bin/sh\necho installed\n" {
+		t.Errorf("expected the cached file to be unchanged, found %q", content)
+	}
+	info, err := os.Stat(cached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 0 || stat.Gid != 0 {
+		t.Errorf("expected the cached file to be owned by root, found %d:%d", stat.Uid, stat.Gid)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package applyinator
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// applySecurityContext is only supported on Linux.
+func applySecurityContext(_ *exec.Cmd, sc SecurityContext) error {
+	if sc.isSet() {
+		return fmt.Errorf("instruction security contexts are only supported on linux")
+	}
+	return nil
+}
+
+func startCommand(cmd *exec.Cmd, _ SecurityContext) error {
+	return cmd.Start()
+}
@@ -0,0 +1,554 @@
+package applyinator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const snapshotsDirName = "snapshots"
+const snapshotManifestFile = "manifest.json"
+const snapshotRetentionCount = 8
+
+// snapshotEntryKind is the kind of a path when it was snapshotted.
+type snapshotEntryKind string
+
+const (
+	snapshotEntryAbsent    snapshotEntryKind = "absent"
+	snapshotEntryFile      snapshotEntryKind = "file"
+	snapshotEntryDirectory snapshotEntryKind = "directory"
+	snapshotEntrySymlink   snapshotEntryKind = "symlink"
+	// snapshotEntryUncaptured is a socket, named pipe or device, which is not captured and left alone on restore.
+	snapshotEntryUncaptured snapshotEntryKind = "uncaptured"
+)
+
+// snapshotModeMask is the part of the mode of a path that is snapshotted and restored.
+const snapshotModeMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// snapshotEntry is the state of a single path before the files of a plan were reconciled.
+type snapshotEntry struct {
+	Path string            `json:"path"`
+	Kind snapshotEntryKind `json:"kind"`
+	Mode os.FileMode       `json:"mode,omitempty"`
+	UID  int               `json:"uid"`
+	GID  int               `json:"gid"`
+	// Content is the name of the file in the snapshot directory that holds the previous content of a regular file.
+	Content string `json:"content,omitempty"`
+	// Target is the target of a symlink.
+	Target string `json:"target,omitempty"`
+}
+
+// fileSnapshot records the previous state of every path touched by the file reconciliation of a plan, so that the
+// reconciliation can be rolled back.
+type fileSnapshot struct {
+	ID string `json:"id"`
+	// Checksum is the checksum of the plan whose files were snapshotted.
+	Checksum string          `json:"checksum,omitempty"`
+	Entries  []snapshotEntry `json:"entries"`
+	// Written is the state of the snapshotted paths after the files of the plan were reconciled, which is empty if they
+	// were not.
+	Written []writtenEntry `json:"written,omitempty"`
+
+	dir  string
+	seen map[string]bool
+}
+
+// newFileSnapshot snapshots the paths that reconciling the files of the plan with the checksum would touch into a new
+// directory named id below root. If a snapshot named id already exists, such as one taken within the same second, the
+// ID of the new snapshot is suffixed with a counter instead of overwriting it.
+func newFileSnapshot(root, id, checksum string, files []planFile) (*fileSnapshot, error) {
+	s := &fileSnapshot{
+		ID:       id,
+		Checksum: checksum,
+		dir:      filepath.Join(root, id),
+		seen:     map[string]bool{},
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	for i := 1; ; i++ {
+		err := os.Mkdir(s.dir, 0700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		s.ID = id + "-" + strconv.Itoa(i)
+		s.dir = filepath.Join(root, s.ID)
+	}
+	for _, file := range files {
+		if err := s.add(file); err != nil {
+			return nil, fmt.Errorf("unable to snapshot %s: %w", file.Path, err)
+		}
+	}
+	if err := s.writeManifest(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSnapshot) writeManifest() error {
+	manifest, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, snapshotManifestFile), manifest, 0600)
+}
+
+// loadFileSnapshot reads the manifest of the snapshot named id below root.
+func loadFileSnapshot(root, id string) (*fileSnapshot, error) {
+	if id == "" || filepath.Base(id) != id || id == "." || id == ".." {
+		return nil, fmt.Errorf("invalid snapshot ID %q", id)
+	}
+	s := &fileSnapshot{
+		dir: filepath.Join(root, id),
+	}
+	manifest, err := os.ReadFile(filepath.Join(s.dir, snapshotManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(manifest, s); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest of snapshot %s: %w", id, err)
+	}
+	return s, nil
+}
+
+// add snapshots the paths that reconciling the file would touch. Deleting a directory touches everything below it, and
+// creating a file or directory may create its missing parent directories.
+func (s *fileSnapshot) add(file planFile) error {
+	if file.Path == "" {
+		return nil
+	}
+	if file.Action == deleteFileAction {
+		if file.Directory {
+			return s.addTree(file.Path)
+		}
+		return s.addPath(file.Path)
+	}
+
+	// Find the topmost parent directory that would be created, removing it on rollback removes everything below it.
+	missing := file.Path
+	for dir := filepath.Dir(file.Path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		missing = dir
+	}
+	if missing != file.Path {
+		return s.addPath(missing)
+	}
+
+	if err := s.addPath(file.Path); err != nil {
+		return err
+	}
+	// Writing through a symlink changes its target, so snapshot the target as well. Links replace the symlink instead.
+	if file.Action == linkFileAction {
+		return nil
+	}
+	if target, err := filepath.EvalSymlinks(file.Path); err == nil && target != file.Path {
+		return s.addPath(target)
+	}
+	return nil
+}
+
+func (s *fileSnapshot) addTree(root string) error {
+	err := filepath.WalkDir(root, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return s.addPath(path)
+	})
+	if os.IsNotExist(err) {
+		return s.addPath(root)
+	}
+	return err
+}
+
+func (s *fileSnapshot) addPath(path string) error {
+	if s.seen[path] {
+		return nil
+	}
+	s.seen[path] = true
+
+	entry := snapshotEntry{
+		Path: path,
+		Kind: snapshotEntryAbsent,
+		UID:  -1,
+		GID:  -1,
+	}
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		s.Entries = append(s.Entries, entry)
+		return nil
+	}
+
+	entry.Mode = fileInfo.Mode() & snapshotModeMask
+	if uid, gid, ok := fileOwner(fileInfo); ok {
+		entry.UID, entry.GID = uid, gid
+	}
+	switch {
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		entry.Kind = snapshotEntrySymlink
+		entry.Target, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	case fileInfo.IsDir():
+		entry.Kind = snapshotEntryDirectory
+	case fileInfo.Mode().IsRegular():
+		entry.Kind = snapshotEntryFile
+		entry.Content = strconv.Itoa(len(s.Entries))
+		if err := copyFileContent(path, filepath.Join(s.dir, entry.Content)); err != nil {
+			return err
+		}
+	default:
+		logrus.Warnf("[Applyinator] Not snapshotting %s, it is not a regular file, directory or symlink", path)
+		entry.Kind = snapshotEntryUncaptured
+	}
+	s.Entries = append(s.Entries, entry)
+	return nil
+}
+
+// copyFileContent streams the content of the regular file src to a new file dst, which only the owner can read.
+func copyFileContent(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// restore returns every snapshotted path to its previous state. Paths are restored in reverse order so that parent
+// directories are restored after their contents. Restoring continues past errors, which are all returned.
+func (s *fileSnapshot) restore() error {
+	logrus.Infof("[Applyinator] Rolling back files to snapshot %s", s.ID)
+	var errs []error
+	for i := len(s.Entries) - 1; i >= 0; i-- {
+		if err := s.restoreEntry(s.Entries[i], os.RemoveAll); err != nil {
+			errs = append(errs, fmt.Errorf("unable to restore %s: %w", s.Entries[i].Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restoreBackup restores the snapshot of a plan that was applied some time ago. Unlike restore, it leaves the paths
+// that changed since the plan wrote them alone and returns them as skipped, and only removes regular files, symlinks
+// and empty directories, unless force is set to remove directories along with everything below them. A snapshot that
+// does not record what its plan wrote is only restored with force, without skipping any path.
+func (s *fileSnapshot) restoreBackup(force bool) ([]string, error) {
+	if len(s.Written) == 0 && !force {
+		return nil, fmt.Errorf("backup %s does not record the files written by its plan, so changes made since cannot be detected", s.ID)
+	}
+	logrus.Infof("[Applyinator] Restoring files of backup %s", s.ID)
+	written := map[string]writtenEntry{}
+	for _, entry := range s.Written {
+		written[entry.Path] = entry
+	}
+	remove := func(path string) error {
+		return removePath(path, force)
+	}
+
+	var skipped []string
+	var errs []error
+	for i := len(s.Entries) - 1; i >= 0; i-- {
+		entry := s.Entries[i]
+		if entry.Kind == snapshotEntryUncaptured {
+			skipped = append(skipped, entry.Path)
+			logrus.Warnf("[Applyinator] Not restoring %s from backup %s, it was not captured", entry.Path, s.ID)
+			continue
+		}
+		if len(s.Written) > 0 {
+			var unchanged bool
+			var err error
+			if entry.Kind == snapshotEntryAbsent {
+				var skippedBelow []string
+				skippedBelow, err = removeWritten(entry.Path, written)
+				skipped = append(skipped, skippedBelow...)
+				unchanged = len(skippedBelow) == 0
+			} else {
+				unchanged, err = written[entry.Path].unchanged()
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to restore %s: %w", entry.Path, err))
+				continue
+			}
+			if !unchanged {
+				if entry.Kind != snapshotEntryAbsent {
+					skipped = append(skipped, entry.Path)
+				}
+				logrus.Warnf("[Applyinator] Not restoring %s from backup %s, it changed since the plan was applied", entry.Path, s.ID)
+				continue
+			}
+		}
+		if err := s.restoreEntry(entry, remove); err != nil {
+			errs = append(errs, fmt.Errorf("unable to restore %s: %w", entry.Path, err))
+		}
+	}
+	return skipped, errors.Join(errs...)
+}
+
+// restoreEntry returns the path of the entry to its snapshotted state, removing whatever is in the way with remove.
+func (s *fileSnapshot) restoreEntry(entry snapshotEntry, remove func(path string) error) error {
+	logrus.Debugf("[Applyinator] Restoring %s %s from snapshot %s", entry.Kind, entry.Path, s.ID)
+	existing, err := os.Lstat(entry.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+
+	switch entry.Kind {
+	case snapshotEntryAbsent:
+		return remove(entry.Path)
+	case snapshotEntryDirectory:
+		if exists && !existing.IsDir() {
+			if err := os.Remove(entry.Path); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(entry.Path, entry.Mode); err != nil {
+			return err
+		}
+		return reconcileFilePermissions(entry.Path, entry.UID, entry.GID, entry.Mode)
+	case snapshotEntryFile:
+		if exists && !existing.Mode().IsRegular() {
+			if err := remove(entry.Path); err != nil {
+				return err
+			}
+		}
+		content, err := os.Open(filepath.Join(s.dir, entry.Content))
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		if err := os.MkdirAll(filepath.Dir(entry.Path), defaultDirectoryPermissions); err != nil {
+			return err
+		}
+		return writeFileAtomic(entry.Path, entry.UID, entry.GID, entry.Mode, func(w io.Writer) error {
+			_, err := io.Copy(w, content)
+			return err
+		})
+	case snapshotEntrySymlink:
+		if exists {
+			if err := remove(entry.Path); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(entry.Path), defaultDirectoryPermissions); err != nil {
+			return err
+		}
+		if err := os.Symlink(entry.Target, entry.Path); err != nil {
+			return err
+		}
+		if entry.UID != -1 || entry.GID != -1 {
+			return os.Lchown(entry.Path, entry.UID, entry.GID)
+		}
+		return nil
+	case snapshotEntryUncaptured:
+		logrus.Warnf("[Applyinator] Not restoring %s from snapshot %s, it was not captured", entry.Path, s.ID)
+		return nil
+	default:
+		return fmt.Errorf("unknown snapshot entry kind %s", entry.Kind)
+	}
+}
+
+// writtenEntry is the state of a path after the files of a plan were reconciled.
+type writtenEntry struct {
+	Path string            `json:"path"`
+	Kind snapshotEntryKind `json:"kind"`
+	// Digest is the sha256 digest of the content of a regular file.
+	Digest string `json:"digest,omitempty"`
+	// Target is the target of a symlink.
+	Target string `json:"target,omitempty"`
+}
+
+// newWrittenEntry returns the current state of the path.
+func newWrittenEntry(path string) (writtenEntry, error) {
+	entry := writtenEntry{Path: path, Kind: snapshotEntryAbsent}
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entry, nil
+		}
+		return entry, err
+	}
+	switch {
+	case fileInfo.Mode()&os.ModeSymlink != 0:
+		entry.Kind = snapshotEntrySymlink
+		entry.Target, err = os.Readlink(path)
+	case fileInfo.IsDir():
+		entry.Kind = snapshotEntryDirectory
+	case fileInfo.Mode().IsRegular():
+		entry.Kind = snapshotEntryFile
+		d := contentDigest{algorithm: "sha256"}
+		var hex string
+		hex, err = d.digestFile(path)
+		entry.Digest = d.algorithm + ":" + hex
+	default:
+		entry.Kind = ""
+	}
+	return entry, err
+}
+
+// unchanged returns true if the path is still in the state it was written in.
+func (w writtenEntry) unchanged() (bool, error) {
+	if w.Path == "" {
+		return false, nil
+	}
+	current, err := newWrittenEntry(w.Path)
+	if err != nil {
+		return false, err
+	}
+	return current == w, nil
+}
+
+// recordWritten records the state of the snapshotted paths after the files of the plan were reconciled, including
+// everything below the directories that the plan created, so that restoring the snapshot as a backup can tell which
+// paths changed since.
+func (s *fileSnapshot) recordWritten() error {
+	s.Written = nil
+	seen := map[string]bool{}
+	record := func(path string) error {
+		if seen[path] {
+			return nil
+		}
+		seen[path] = true
+		entry, err := newWrittenEntry(path)
+		if err != nil {
+			return err
+		}
+		s.Written = append(s.Written, entry)
+		return nil
+	}
+	for _, entry := range s.Entries {
+		if entry.Kind != snapshotEntryAbsent {
+			if err := record(entry.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		err := filepath.WalkDir(entry.Path, func(path string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return record(path)
+		})
+		if os.IsNotExist(err) {
+			err = record(entry.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.writeManifest()
+}
+
+// removeWritten removes the files and symlinks at or below root that are still as the plan wrote them, and then the
+// directories that the plan created and that are empty. It returns the paths that changed since and were left alone.
+func removeWritten(root string, written map[string]writtenEntry) ([]string, error) {
+	var paths []string
+	for path := range written {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			paths = append(paths, path)
+		}
+	}
+	// Remove the contents of directories before the directories themselves.
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	var skipped []string
+	for _, path := range paths {
+		entry := written[path]
+		if entry.Kind == snapshotEntryAbsent {
+			continue
+		}
+		unchanged, err := entry.unchanged()
+		if err != nil {
+			return skipped, err
+		}
+		if !unchanged {
+			skipped = append(skipped, path)
+			continue
+		}
+		if err := os.Remove(path); err != nil && entry.Kind != snapshotEntryDirectory {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+// removePath removes a regular file, symlink or empty directory. A directory that is not empty is only removed, along
+// with everything below it, with force.
+func removePath(path string, force bool) error {
+	fileInfo, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fileInfo.IsDir() {
+		if force {
+			return os.RemoveAll(path)
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("directory %s is not empty, force is required to remove everything below it", path)
+		}
+	}
+	return os.Remove(path)
+}
+
+// pruneDirectories removes all but the newest retention directories below root, whose names sort by creation time.
+// kind describes the directories in log messages.
+func pruneDirectories(root string, retention int, kind string) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	if len(dirs) <= retention {
+		return nil
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs[:len(dirs)-retention] {
+		logrus.Debugf("[Applyinator] Removing %s %s (retention policy count: %d)", kind, dir, retention)
+		if err := os.RemoveAll(filepath.Join(root, dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestApplyRollback(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-rollback-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	testCases := []struct {
+		Name                     string
+		InvalidFile              bool
+		Instruction              string
+		RollbackOnInstructionErr bool
+
+		ExpectedErr        bool
+		ExpectedRolledBack bool
+	}{
+		{
+			Name:        "file failure",
+			InvalidFile: true,
+
+			ExpectedErr:        true,
+			ExpectedRolledBack: true,
+		},
+		{
+			Name:                     "instruction failure with rollback",
+			Instruction:              "/bin/false",
+			RollbackOnInstructionErr: true,
+
+			ExpectedRolledBack: true,
+		},
+		{
+			Name:        "instruction failure without rollback",
+			Instruction: "/bin/false",
+		},
+		{
+			Name:                     "success",
+			Instruction:              "/bin/true",
+			RollbackOnInstructionErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			root := filepath.Join(tempDir, filepath.Base(tc.Name))
+			existing := filepath.Join(root, "existing")
+			deleted := filepath.Join(root, "deleted")
+			nested := filepath.Join(root, "nested", "a", "b")
+			if err := os.MkdirAll(deleted, 0750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(existing, []byte("old"), 0640); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(deleted, "child"), []byte("child"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			files := []planapi.File{
+				{Path: existing, Content: base64.StdEncoding.EncodeToString([]byte("new")), Permissions: "0600", UID: -1, GID: -1},
+				{Path: deleted, Directory: true, Action: deleteFileAction},
+				{Path: nested, Content: base64.StdEncoding.EncodeToString([]byte("nested")), UID: -1, GID: -1},
+			}
+			if tc.InvalidFile {
+				files = append(files, planapi.File{Path: filepath.Join(root, "invalid"), Content: "!!!", UID: -1, GID: -1})
+			}
+			var instructions []planapi.OneTimeInstruction
+			if tc.Instruction != "" {
+				instructions = append(instructions, planapi.OneTimeInstruction{
+					CommonInstruction: planapi.CommonInstruction{Name: "instruction", Command: tc.Instruction},
+				})
+			}
+
+			a := NewApplyinator(filepath.Join(root, "work"), false, "", "", nil, Options{
+				RollbackFilesOnInstructionFailure: tc.RollbackOnInstructionErr,
+			})
+			output, err := a.Apply(context.Background(), ApplyInput{
+				CalculatedPlan: CalculatedPlan{
+					Plan:     planapi.Plan{Files: files, OneTimeInstructions: instructions},
+					Checksum: "checksum",
+				},
+				ReconcileFiles:         true,
+				RunOneTimeInstructions: true,
+			})
+			if tc.ExpectedErr != (err != nil) {
+				t.Fatalf("expected error %t, found %v", tc.ExpectedErr, err)
+			}
+			if output.SnapshotID == "" {
+				t.Errorf("expected snapshot ID to be set")
+			}
+			if output.FilesRolledBack != tc.ExpectedRolledBack {
+				t.Errorf("expected files rolled back %t, found %t", tc.ExpectedRolledBack, output.FilesRolledBack)
+			}
+
+			content, err := os.ReadFile(existing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, deletedErr := os.Stat(filepath.Join(deleted, "child"))
+			_, nestedErr := os.Stat(filepath.Join(root, "nested"))
+			if tc.ExpectedRolledBack {
+				if string(content) != "old" {
+					t.Errorf("expected %s to be restored, found %q", existing, content)
+				}
+				if perm, err := getPermissions(existing); err != nil || perm.Perm() != 0640 {
+					t.Errorf("expected %s to have restored mode 0640, found %#o (%v)", existing, perm.Perm(), err)
+				}
+				if deletedErr != nil {
+					t.Errorf("expected deleted directory to be restored: %v", deletedErr)
+				}
+				if !os.IsNotExist(nestedErr) {
+					t.Errorf("expected created directories to be removed: %v", nestedErr)
+				}
+			} else {
+				if string(content) != "new" {
+					t.Errorf("expected %s to be written, found %q", existing, content)
+				}
+				if !os.IsNotExist(deletedErr) {
+					t.Errorf("expected directory to be deleted: %v", deletedErr)
+				}
+				if nestedErr != nil {
+					t.Errorf("expected nested file to be written: %v", nestedErr)
+				}
+			}
+		})
+	}
+}
+
+func TestFileSnapshotID(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "files", "file")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := []planFile{{File: planapi.File{Path: path, Content: base64.StdEncoding.EncodeToString([]byte("content"))}}}
+
+	// Snapshots taken within the same second do not overwrite each other.
+	var ids []string
+	for i := 0; i < 3; i++ {
+		snapshot, err := newFileSnapshot(filepath.Join(root, "snapshots"), "20240102-030405-checksum", "checksum", files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, snapshot.ID)
+		if _, err := loadFileSnapshot(filepath.Join(root, "snapshots"), snapshot.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"20240102-030405-checksum", "20240102-030405-checksum-1", "20240102-030405-checksum-2"}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Errorf("expected snapshot IDs %v, found %v", expected, ids)
+			break
+		}
+	}
+}
+
+func TestFileSnapshotSpecialFiles(t *testing.T) {
+	root := t.TempDir()
+	deleted := filepath.Join(root, "deleted")
+	sticky := filepath.Join(deleted, "sticky")
+	setuid := filepath.Join(sticky, "setuid")
+	fifo := filepath.Join(sticky, "fifo")
+	if err := os.MkdirAll(sticky, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(setuid, []byte("setuid"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The mode is set explicitly as the umask does not apply to it.
+	if err := os.Chmod(sticky, 0777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(setuid, 0755|os.ModeSetuid|os.ModeSetgid); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []planFile{{File: planapi.File{Path: deleted, Directory: true, Action: deleteFileAction}}}
+	snapshot, err := newFileSnapshot(filepath.Join(root, "snapshots"), "snapshot", "checksum", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uncaptured []string
+	for _, entry := range snapshot.Entries {
+		if entry.Kind == snapshotEntryUncaptured {
+			uncaptured = append(uncaptured, entry.Path)
+		}
+	}
+	if len(uncaptured) != 1 || uncaptured[0] != fifo {
+		t.Errorf("expected only %s not to be captured, found %v", fifo, uncaptured)
+	}
+
+	if err := os.RemoveAll(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapshot.restore(); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]os.FileMode{
+		sticky: 0777 | os.ModeSticky,
+		setuid: 0755 | os.ModeSetuid | os.ModeSetgid,
+	} {
+		if mode, err := getPermissions(path); err != nil || mode&snapshotModeMask != expected {
+			t.Errorf("expected %s to have restored mode %v, found %v (%v)", path, expected, mode, err)
+		}
+	}
+	if content, err := os.ReadFile(setuid); err != nil || string(content) != "setuid" {
+		t.Errorf("expected %s to be restored, found %q (%v)", setuid, content, err)
+	}
+	if _, err := os.Lstat(fifo); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to be restored: %v", fifo, err)
+	}
+}
@@ -0,0 +1,117 @@
+package applyinator
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+const sourcesDirName = "sources"
+
+// FileSource is a file in the filesystem of an image that the content of a plan file is copied from, instead of being
+// inlined in the plan.
+type FileSource struct {
+	Image string `json:"image"`
+	Path  string `json:"path"`
+	// Digest is the digest of the content of the file, such as sha256:<hex>, which the content is verified against. It
+	// may be omitted when the file itself has a digest.
+	Digest string `json:"digest,omitempty"`
+}
+
+// stageSource copies the source file of a plan file out of its image into the sources directory of the work
+// directory, verifying its digest, and returns the path of the staged copy. Staged copies are named by their digest,
+// so a file that was already staged is not copied again.
+func (a *Applyinator) stageSource(file planFile) (string, error) {
+	source := file.Extensions.Source
+	if source.Image == "" || source.Path == "" {
+		return "", fmt.Errorf("source of file %s must have an image and a path", file.Path)
+	}
+	if file.Content != "" || file.Directory || file.Action != "" || file.Extensions.Template {
+		return "", fmt.Errorf("file %s with a source cannot have content, be a directory or template, or have an action", file.Path)
+	}
+	digest, err := parseContentDigest(file.Extensions.sourceDigest())
+	if err != nil {
+		return "", fmt.Errorf("invalid source of file %s: %w", file.Path, err)
+	}
+	if source.Digest != "" && file.Extensions.Digest != "" && source.Digest != file.Extensions.Digest {
+		return "", fmt.Errorf("source digest %s of file %s does not match its digest %s", source.Digest, file.Path, file.Extensions.Digest)
+	}
+
+	sourcesDir := filepath.Join(a.workDir, sourcesDirName)
+	staged := filepath.Join(sourcesDir, digest.algorithm+"-"+digest.hex)
+	if _, err := os.Stat(staged); err == nil {
+		logrus.Debugf("[Applyinator] Using staged copy %s of %s from image %s", staged, source.Path, source.Image)
+		return staged, nil
+	}
+	if a.imageUtil == nil {
+		return "", fmt.Errorf("unable to copy %s from image %s: no image utility", source.Path, source.Image)
+	}
+	if err := os.MkdirAll(sourcesDir, 0700); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(sourcesDir, ".stage-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		// The temporary file no longer exists once it has been renamed.
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("error removing temporary file %s: %v", tmp.Name(), err)
+		}
+	}()
+
+	logrus.Infof("[Applyinator] Copying %s from image %s for file %s", source.Path, source.Image, file.Path)
+	h := digest.newHash()
+	err = a.imageUtil.ExtractFile(source.Image, source.Path, io.MultiWriter(tmp, h))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to copy %s from image %s: %w", source.Path, source.Image, err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != digest.hex {
+		logrus.Errorf("[Applyinator] %s from image %s has digest %s:%s, expected %s", source.Path, source.Image, digest.algorithm, actual, digest)
+		return "", &DigestMismatchError{Files: []FileDigestMismatch{{
+			Path:     file.Path,
+			Expected: digest.String(),
+			Actual:   digest.algorithm + ":" + actual,
+		}}}
+	}
+	if err := os.Rename(tmp.Name(), staged); err != nil {
+		return "", err
+	}
+	return staged, nil
+}
+
+// pruneSources removes the staged copies of source files that are not used by the files.
+func pruneSources(workDir string, files []planFile) error {
+	sourcesDir := filepath.Join(workDir, sourcesDirName)
+	entries, err := os.ReadDir(sourcesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	used := map[string]bool{}
+	for _, file := range files {
+		if file.ContentFile != "" {
+			used[filepath.Base(file.ContentFile)] = true
+		}
+	}
+	for _, entry := range entries {
+		if used[entry.Name()] {
+			continue
+		}
+		logrus.Debugf("[Applyinator] Removing unused staged source %s", entry.Name())
+		if err := os.RemoveAll(filepath.Join(sourcesDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+//go:build !windows
+
+package applyinator
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	planapi "github.com/rancher/rancher/pkg/plan"
+
+	"github.com/rancher/system-agent/pkg/image"
+)
+
+func TestApplyFileSource(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-source-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const imageName = "example.com/rancher/files:v1"
+	content := []byte("#!/bin/sh\necho tool\n")
+	imagesDir := filepath.Join(tempDir, "images")
+	writeTestImage(t, imagesDir, imageName, map[string][]byte{"bin/tool": content})
+	imageUtil := image.NewUtility(imagesDir, "", "", filepath.Join(tempDir, "registries.yaml"), image.Options{})
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+
+	testCases := []struct {
+		Name   string
+		Source FileSource
+
+		ExpectedErr bool
+	}{
+		{
+			Name:   "matching digest",
+			Source: FileSource{Image: imageName, Path: "/bin/tool", Digest: digest},
+		},
+		{
+			Name:   "mismatched digest",
+			Source: FileSource{Image: imageName, Path: "/bin/tool", Digest: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))},
+
+			ExpectedErr: true,
+		},
+		{
+			Name:   "missing path",
+			Source: FileSource{Image: imageName, Path: "/bin/missing", Digest: digest},
+
+			ExpectedErr: true,
+		},
+		{
+			Name:   "invalid digest",
+			Source: FileSource{Image: imageName, Path: "/bin/tool", Digest: "md5:abc"},
+
+			ExpectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			root := filepath.Join(tempDir, filepath.Base(tc.Name))
+			path := filepath.Join(root, "bin", "tool")
+			a := NewApplyinator(filepath.Join(root, "work"), false, "", "", imageUtil, Options{})
+			source := tc.Source
+			input := ApplyInput{
+				CalculatedPlan: CalculatedPlan{
+					Plan: planapi.Plan{Files: []planapi.File{
+						{Path: path, Permissions: "0755", UID: -1, GID: -1},
+					}},
+					Extensions: PlanExtensions{Files: []FileExtensions{{Source: &source}}},
+					Checksum:   "checksum",
+				},
+				ReconcileFiles: true,
+			}
+
+			_, err := a.Apply(context.Background(), input)
+			if tc.ExpectedErr {
+				if err == nil {
+					t.Fatal("expected error, returned successfully")
+				}
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("expected %s not to be written: %v", path, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			written, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written, content) {
+				t.Errorf("expected content %q, found %q", content, written)
+			}
+
+			// The staged copy is reused, so the file is written again without the image.
+			if err := os.WriteFile(path, []byte("edited"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			a.imageUtil = nil
+			if _, err := a.Apply(context.Background(), input); err != nil {
+				t.Fatal(err)
+			}
+			written, err = os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written, content) {
+				t.Errorf("expected content %q after reapplying, found %q", content, written)
+			}
+		})
+	}
+}
+
+// writeTestImage writes a single layer image with the files to an image archive in the images directory.
+func writeTestImage(t *testing.T, imagesDir, imageName string, files map[string][]byte) {
+	t.Helper()
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	for path, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: path, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(layer.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(imageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarball.WriteToFile(filepath.Join(imagesDir, "files.tar"), tag, img); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,242 @@
+package applyinator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultNodeEnvFile = "/etc/systemd/system/rancher-system-agent.env"
+const machineIDFile = "/etc/machine-id"
+const cattleEnvPrefix = "CATTLE_"
+
+var osReleaseFiles = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// NodeFacts are the facts about the node that templated file content is rendered with.
+type NodeFacts struct {
+	Hostname  string
+	MachineID string
+	// OS and Arch are the operating system and architecture of the node, as in GOOS and GOARCH.
+	OS   string
+	Arch string
+	// OSRelease holds the fields of the os-release file, such as ID and VERSION_ID.
+	OSRelease map[string]string
+	// Interfaces are the network interfaces of the node that are up.
+	Interfaces []NodeInterface
+	// PrimaryIPv4 and PrimaryIPv6 are the first global unicast addresses of the interfaces that are not loopback.
+	PrimaryIPv4 string
+	PrimaryIPv6 string
+	// Env holds the CATTLE_* variables of the environment file of the agent service.
+	Env map[string]string
+}
+
+// NodeInterface is a network interface of the node.
+type NodeInterface struct {
+	Name string
+	MAC  string
+	// IPs are the addresses of the interface without their prefix length.
+	IPs []string
+}
+
+// renderFiles returns the files of the plan as they are written on this node, with their extensions, owner names
+// resolved, the sources of files staged and the content of templated files rendered. Node facts are only gathered when
+// the plan has templated files. An owner that cannot be resolved, a source that cannot be staged or a rendering error
+// fails the whole plan. The content of files with a digest is verified after rendering, and all files that do not
+// match their digest are returned in a DigestMismatchError.
+func (a *Applyinator) renderFiles(cp CalculatedPlan) ([]planFile, error) {
+	var facts *NodeFacts
+	var mismatches []FileDigestMismatch
+	owners := newOwnerResolver()
+	files := make([]planFile, len(cp.Plan.Files))
+	for index, file := range cp.Plan.Files {
+		files[index] = planFile{File: file, Extensions: cp.Extensions.file(index)}
+		if err := owners.resolve(&files[index]); err != nil {
+			return nil, err
+		}
+		if files[index].Extensions.Source != nil {
+			staged, err := a.stageSource(files[index])
+			if err != nil {
+				var mismatch *DigestMismatchError
+				if errors.As(err, &mismatch) {
+					mismatches = append(mismatches, mismatch.Files...)
+					continue
+				}
+				return nil, err
+			}
+			files[index].ContentFile = staged
+			continue
+		}
+		if file.Directory || file.Action != "" {
+			continue
+		}
+		if files[index].Extensions.Template {
+			if facts == nil {
+				gathered, err := gatherNodeFacts(a.options.NodeEnvFile)
+				if err != nil {
+					return nil, fmt.Errorf("unable to gather node facts: %w", err)
+				}
+				facts = &gathered
+			}
+			content, err := base64.StdEncoding.DecodeString(file.Content)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode template of file %s: %w", file.Path, err)
+			}
+			rendered, err := renderTemplate(file.Path, content, *facts)
+			if err != nil {
+				return nil, fmt.Errorf("unable to render template of file %s: %w", file.Path, err)
+			}
+			logrus.Debugf("[Applyinator] Rendered template of file %s", file.Path)
+			files[index].Content = base64.StdEncoding.EncodeToString(rendered)
+		}
+		if files[index].Extensions.Digest != "" {
+			if err := verifyContentDigest(files[index]); err != nil {
+				var mismatch *DigestMismatchError
+				if errors.As(err, &mismatch) {
+					mismatches = append(mismatches, mismatch.Files...)
+					continue
+				}
+				return nil, err
+			}
+		}
+	}
+	if len(mismatches) > 0 {
+		return nil, &DigestMismatchError{Files: mismatches}
+	}
+	return files, nil
+}
+
+// renderTemplate renders content as a Go text/template with the facts. Referencing a missing key is an error.
+func renderTemplate(name string, content []byte, facts NodeFacts) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, facts); err != nil {
+		return nil, err
+	}
+	return rendered.Bytes(), nil
+}
+
+// gatherNodeFacts collects the facts of the node. Files that do not exist, such as the os-release file on Windows,
+// leave their facts empty.
+func gatherNodeFacts(envFile string) (NodeFacts, error) {
+	facts := NodeFacts{
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		OSRelease: map[string]string{},
+		Env:       map[string]string{},
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return facts, err
+	}
+	facts.Hostname = hostname
+
+	machineID, err := os.ReadFile(machineIDFile)
+	if err != nil && !os.IsNotExist(err) {
+		return facts, err
+	}
+	facts.MachineID = strings.TrimSpace(string(machineID))
+
+	for _, osReleaseFile := range osReleaseFiles {
+		osRelease, err := readEnvFile(osReleaseFile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return facts, err
+		}
+		facts.OSRelease = osRelease
+		break
+	}
+
+	env, err := readEnvFile(envFile)
+	if err != nil && !os.IsNotExist(err) {
+		return facts, err
+	}
+	for key, value := range env {
+		if strings.HasPrefix(key, cattleEnvPrefix) {
+			facts.Env[key] = value
+		}
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return facts, err
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return facts, err
+		}
+		nodeInterface := NodeInterface{
+			Name: iface.Name,
+			MAC:  iface.HardwareAddr.String(),
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			nodeInterface.IPs = append(nodeInterface.IPs, ipNet.IP.String())
+			if iface.Flags&net.FlagLoopback != 0 || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				if facts.PrimaryIPv4 == "" {
+					facts.PrimaryIPv4 = ipNet.IP.String()
+				}
+			} else if facts.PrimaryIPv6 == "" {
+				facts.PrimaryIPv6 = ipNet.IP.String()
+			}
+		}
+		facts.Interfaces = append(facts.Interfaces, nodeInterface)
+	}
+	return facts, nil
+}
+
+// readEnvFile reads a file of KEY=VALUE lines, as used by os-release and systemd environment files. Empty lines and
+// comments are skipped, and values may be quoted.
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,110 @@
+package applyinator
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	planapi "github.com/rancher/rancher/pkg/plan"
+)
+
+func TestRenderFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-template-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	envFile := filepath.Join(tempDir, "rancher-system-agent.env")
+	envContent := "# comment\nCATTLE_SERVER=\"https://rancher.example.com\"\nCATTLE_ROLE_ETCD='true'\nHTTP_PROXY=http://proxy:3128\n"
+	if err := os.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewApplyinator(filepath.Join(tempDir, "work"), false, "", "", nil, Options{NodeEnvFile: envFile})
+
+	encode := func(content string) string {
+		return base64.StdEncoding.EncodeToString([]byte(content))
+	}
+
+	testCases := []struct {
+		Name     string
+		Content  string
+		Template bool
+
+		ExpectedContent string
+		ExpectedErr     bool
+	}{
+		{
+			Name:     "node facts",
+			Content:  "server: {{ .Env.CATTLE_SERVER }}\netcd: {{ .Env.CATTLE_ROLE_ETCD }}\nnode-name: {{ .Hostname }}\narch: {{ .Arch }}\n",
+			Template: true,
+
+			ExpectedContent: "server: https://rancher.example.com\netcd: true\nnode-name: " + hostname + "\narch: " + runtime.GOARCH + "\n",
+		},
+		{
+			Name:    "not templated",
+			Content: "node-name: {{ .Hostname }}\n",
+
+			ExpectedContent: "node-name: {{ .Hostname }}\n",
+		},
+		{
+			Name:     "only CATTLE variables",
+			Content:  "{{ .Env.HTTP_PROXY }}",
+			Template: true,
+
+			ExpectedErr: true,
+		},
+		{
+			Name:     "invalid template",
+			Content:  "{{ .Hostname ",
+			Template: true,
+
+			ExpectedErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := filepath.Join(tempDir, "config.yaml")
+			cp := CalculatedPlan{
+				Plan: planapi.Plan{Files: []planapi.File{
+					{Path: path, Content: encode(tc.Content), UID: -1, GID: -1},
+				}},
+				Extensions: PlanExtensions{Files: []FileExtensions{{Template: tc.Template}}},
+				Checksum:   "checksum",
+			}
+
+			files, err := a.renderFiles(cp)
+			if tc.ExpectedErr {
+				if err == nil {
+					t.Fatal("expected error, returned successfully")
+				}
+				// A rendering error must fail the plan before anything is written.
+				if _, err := a.Apply(context.Background(), ApplyInput{CalculatedPlan: cp, ReconcileFiles: true}); err == nil {
+					t.Error("expected apply to fail")
+				}
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("expected %s not to be written: %v", path, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files[0].Content != encode(tc.ExpectedContent) {
+				content, _ := base64.StdEncoding.DecodeString(files[0].Content)
+				t.Errorf("expected %q, found %q", tc.ExpectedContent, content)
+			}
+			if cp.Plan.Files[0].Content != encode(tc.Content) {
+				t.Errorf("expected the plan not to be modified")
+			}
+		})
+	}
+}
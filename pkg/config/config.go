@@ -24,6 +24,129 @@ type AgentConfig struct {
 	ImageCredentialProviderConfig string `json:"imageCredentialProviderConfig,omitempty"`
 	ImageCredentialProviderBinDir string `json:"imageCredentialProviderBinDirectory,omitempty"`
 	InterlockDir                  string `json:"interlockDirectory,omitempty"`
+	// InstructionTimeoutSeconds is the default maximum runtime of an instruction. Zero disables the timeout.
+	InstructionTimeoutSeconds int `json:"instructionTimeoutSeconds,omitempty"`
+	// InstructionTerminationGracePeriodSeconds is how long a timed out instruction is given to exit after SIGTERM
+	// before it is sent SIGKILL.
+	InstructionTerminationGracePeriodSeconds int `json:"instructionTerminationGracePeriodSeconds,omitempty"`
+	// InstructionCgroupsEnabled runs each instruction in its own transient cgroup v2 below InstructionCgroupRoot.
+	InstructionCgroupsEnabled bool   `json:"instructionCgroupsEnabled,omitempty"`
+	InstructionCgroupRoot     string `json:"instructionCgroupRoot,omitempty"`
+	// InstructionMemoryLimitBytes, InstructionCPULimitMillicores and InstructionPidsLimit are the resource limits of
+	// an instruction cgroup. A zero value leaves the resource unlimited.
+	InstructionMemoryLimitBytes   int64 `json:"instructionMemoryLimitBytes,omitempty"`
+	InstructionCPULimitMillicores int64 `json:"instructionCPULimitMillicores,omitempty"`
+	InstructionPidsLimit          int64 `json:"instructionPidsLimit,omitempty"`
+	// InstructionUID and InstructionGID are the default user and group instructions are run as.
+	InstructionUID                *int  `json:"instructionUID,omitempty"`
+	InstructionGID                *int  `json:"instructionGID,omitempty"`
+	InstructionSupplementalGroups []int `json:"instructionSupplementalGroups,omitempty"`
+	// InstructionCapabilities is the default set of Linux capabilities instructions are allowed to hold.
+	InstructionCapabilities []string `json:"instructionCapabilities,omitempty"`
+	InstructionNoNewPrivs   bool     `json:"instructionNoNewPrivs,omitempty"`
+	// InstructionConcurrency is the maximum number of one-time instructions run at once for plans that declare
+	// dependencies between their instructions.
+	InstructionConcurrency int `json:"instructionConcurrency,omitempty"`
+	// RollbackFilesOnInstructionFailure restores the files of a plan to their previous state when its one-time
+	// instructions fail.
+	RollbackFilesOnInstructionFailure bool `json:"rollbackFilesOnInstructionFailure,omitempty"`
+	// FileDriftCheckIntervalSeconds is how often the files of the applied plan are compared against the disk. Zero
+	// disables drift detection.
+	FileDriftCheckIntervalSeconds int `json:"fileDriftCheckIntervalSeconds,omitempty"`
+	// FileDriftPolicy is either report (the default), to only report drifted files, or reapply, to also write them again.
+	FileDriftPolicy string `json:"fileDriftPolicy,omitempty"`
+	// AppliedPlanRetentionCount is the number of applied plans that are kept in AppliedPlanDir, 64 by default.
+	AppliedPlanRetentionCount int `json:"appliedPlanRetentionCount,omitempty"`
+	// AppliedPlanRetentionMaxAgeSeconds removes applied plans older than it from AppliedPlanDir, except for the most
+	// recent one. Zero keeps applied plans regardless of their age.
+	AppliedPlanRetentionMaxAgeSeconds int `json:"appliedPlanRetentionMaxAgeSeconds,omitempty"`
+	// BackupDir keeps the previous state of the files of every applied plan as a backup, instead of in the work
+	// directory.
+	BackupDir string `json:"backupDirectory,omitempty"`
+	// BackupRetentionCount is the number of backups that are kept, 64 by default.
+	BackupRetentionCount int `json:"backupRetentionCount,omitempty"`
+	// InstructionOutputMaxBytes is the maximum size of each of the stdout and stderr of an instruction that are kept as
+	// its output in the plan status, 262144 by default. Larger output keeps its head and tail with a truncation marker
+	// in between. A negative size keeps all output.
+	InstructionOutputMaxBytes int `json:"instructionOutputMaxBytes,omitempty"`
+	// RedactEnv, RedactArgs and RedactPatterns declare sensitive values of instructions in addition to those declared by
+	// plans: the names of environment variables and flags whose values are sensitive, and regular expressions matching
+	// sensitive values. They are masked in logs, the saved output of instructions and applied plans.
+	RedactEnv      []string `json:"redactEnv,omitempty"`
+	RedactArgs     []string `json:"redactArgs,omitempty"`
+	RedactPatterns []string `json:"redactPatterns,omitempty"`
+	// HooksDir is the directory whose pre-apply.d and post-apply.d directories hold executables that are run before the
+	// files of a plan are reconciled and after its instructions were run. A failing pre-apply hook aborts the apply.
+	HooksDir string `json:"hooksDirectory,omitempty"`
+	// HookTimeoutSeconds is the maximum runtime of a hook, 300 by default.
+	HookTimeoutSeconds int `json:"hookTimeoutSeconds,omitempty"`
+	// ImageCacheDir is the directory that the extracted filesystems of instruction images are cached in, keyed by the
+	// digest of the image. Empty disables the cache.
+	ImageCacheDir string `json:"imageCacheDirectory,omitempty"`
+	// ImageCacheMaxBytes is the size of the image cache above which the least recently used images are evicted. Zero
+	// does not limit the size of the cache.
+	ImageCacheMaxBytes int64 `json:"imageCacheMaxBytes,omitempty"`
+	// ImageCacheHardlink stages the files of cached images as hard links instead of copies.
+	ImageCacheHardlink bool `json:"imageCacheHardlink,omitempty"`
+	// ImageSignaturePolicies are the policies, by registry or repository, that the cosign signatures of instruction
+	// images are verified with before the images are staged.
+	ImageSignaturePolicies []SignaturePolicy `json:"imageSignaturePolicies,omitempty"`
+	// ImageDigestPolicy is either require-digest, to refuse instruction images that are referenced by tag alone, or
+	// require-listed, to only allow them when the instruction lists the digests the tag may resolve to. Empty allows
+	// every reference.
+	ImageDigestPolicy string `json:"imageDigestPolicy,omitempty"`
+	// ImagePullAttempts is the number of times pulling an instruction image is attempted before the instruction fails.
+	// Zero or one does not retry.
+	ImagePullAttempts int `json:"imagePullAttempts,omitempty"`
+	// ImagePullBackoffSeconds is the delay before the first retry of an image pull, 5 by default, which doubles with
+	// every retry up to ImagePullMaxBackoffSeconds, 120 by default.
+	ImagePullBackoffSeconds    int `json:"imagePullBackoffSeconds,omitempty"`
+	ImagePullMaxBackoffSeconds int `json:"imagePullMaxBackoffSeconds,omitempty"`
+	// ImagePullTimeoutSeconds is the maximum runtime of a single attempt to pull an image. Zero does not limit it.
+	ImagePullTimeoutSeconds int `json:"imagePullTimeoutSeconds,omitempty"`
+	// ImagePrefetch pulls the images of the instructions of a plan into the image cache concurrently as soon as the plan
+	// is applied. It requires ImageCacheDir.
+	ImagePrefetch bool `json:"imagePrefetch,omitempty"`
+	// ImagePrefetchConcurrency is the maximum number of images that are prefetched at once, 4 by default.
+	ImagePrefetchConcurrency int `json:"imagePrefetchConcurrency,omitempty"`
+	// ImagePrefetchWhileBlocked also prefetches the images of a plan while a pending restart of the agent blocks
+	// applying it.
+	ImagePrefetchWhileBlocked bool `json:"imagePrefetchWhileBlocked,omitempty"`
+	// InstructionLogDir is the directory that the output of every instruction run is logged to, together with a
+	// manifest of the runs. Empty disables instruction logs.
+	InstructionLogDir string `json:"instructionLogDirectory,omitempty"`
+	// InstructionLogMaxBytes is the size at which the log of an instruction is rotated, 10 MiB by default.
+	InstructionLogMaxBytes int64 `json:"instructionLogMaxBytes,omitempty"`
+	// InstructionLogMaxFiles is the number of rotated files that are kept for the log of an instruction, 3 by default.
+	InstructionLogMaxFiles int `json:"instructionLogMaxFiles,omitempty"`
+	// InstructionLogRetentionCount is the number of runs of one-time instructions whose logs are kept, and separately of
+	// runs of only periodic instructions, 64 by default.
+	InstructionLogRetentionCount int `json:"instructionLogRetentionCount,omitempty"`
+}
+
+// SignaturePolicy declares how the cosign signatures of the instruction images in its scope are verified.
+type SignaturePolicy struct {
+	// Scope is the registry, repository or repository prefix the policy applies to, or * for every image.
+	Scope string `json:"scope"`
+	// Mode is either enforce, the default, or warn.
+	Mode string `json:"mode,omitempty"`
+	// PublicKeys are the paths of PEM encoded public keys that images are signed with.
+	PublicKeys []string `json:"publicKeys,omitempty"`
+	// Keyless verifies signatures made with short-lived certificates.
+	Keyless *KeylessPolicy `json:"keyless,omitempty"`
+}
+
+// KeylessPolicy declares the local trust root of signatures made with short-lived certificates.
+type KeylessPolicy struct {
+	TrustRoot                 string           `json:"trustRoot"`
+	TransparencyLogPublicKeys []string         `json:"transparencyLogPublicKeys"`
+	Identities                []SignerIdentity `json:"identities"`
+}
+
+// SignerIdentity is the subject and OIDC issuer of a trusted signer.
+type SignerIdentity struct {
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer"`
 }
 
 type ConnectionInfo struct {
@@ -0,0 +1,353 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const cacheEntryFile = "entry.json"
+const cacheRootfsDir = "rootfs"
+const cacheLockFile = ".lock"
+
+// CacheEntry is an image whose extracted filesystem is kept in the image cache.
+type CacheEntry struct {
+	// Digest is the digest of the image, which the entry is keyed by.
+	Digest string `json:"digest"`
+	// Image is the reference of the image that the entry was first extracted for.
+	Image string `json:"image"`
+	// Size is the size of the extracted files in bytes.
+	Size int64 `json:"size"`
+	// LastUsed is the time the entry was last staged from.
+	LastUsed time.Time `json:"-"`
+
+	dir string
+}
+
+// imageCache keeps the extracted filesystems of images in a directory, keyed by the digest of the image, so that
+// staging an image that was staged before neither pulls nor extracts it again.
+type imageCache struct {
+	dir      string
+	maxBytes int64
+	hardlink bool
+
+	// mu prevents entries from being evicted while they are staged from, and the lock of the cache directory prevents
+	// other processes, such as cache prune, from evicting them.
+	mu sync.RWMutex
+}
+
+// stage copies the extracted filesystem of the image from the cache to destDir, extracting it into the cache first if
+// it is not cached yet. Regular files are hard linked instead of copied when hardlink is set.
+func (c *imageCache) stage(img v1.Image, digest v1.Hash, imgString, destDir string, hardlink bool) error {
+	entry := c.entry(digest)
+	cached, err := c.copyEntry(entry, destDir, hardlink)
+	if err != nil || cached {
+		return err
+	}
+
+	logrus.Infof("Extracting image %s with digest %s to the image cache %s", imgString, digest, c.dir)
+	if err := c.add(img, digest, imgString, entry); err != nil {
+		return err
+	}
+	cached, err = c.copyEntry(entry, destDir, hardlink)
+	if err != nil {
+		return err
+	}
+	if !cached {
+		// The entry was evicted concurrently before it could be staged from.
+		logrus.Infof("Image %s with digest %s was evicted from the image cache before it was staged, extracting it", imgString, digest)
+		return extractFiles(img, destDir)
+	}
+	c.evict()
+	return nil
+}
+
+// prefetch extracts the image into the cache if it is not cached yet, without staging it anywhere.
+func (c *imageCache) prefetch(img v1.Image, digest v1.Hash, imgString string) error {
+	entry := c.entry(digest)
+	c.mu.RLock()
+	cached, err := c.use(entry)
+	c.mu.RUnlock()
+	if err != nil || cached {
+		return err
+	}
+
+	logrus.Infof("Prefetching image %s with digest %s to the image cache %s", imgString, digest, c.dir)
+	if err := c.add(img, digest, imgString, entry); err != nil {
+		return err
+	}
+	c.evict()
+	return nil
+}
+
+// entry returns the directory of the cache entry of the image with the digest.
+func (c *imageCache) entry(digest v1.Hash) string {
+	return filepath.Join(c.dir, digest.Algorithm+"-"+digest.Hex)
+}
+
+// copyEntry stages the cache entry to destDir and marks it as used, and returns false if the image is not cached.
+func (c *imageCache) copyEntry(entry, destDir string, hardlink bool) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return false, err
+	}
+	unlock, err := lockCache(c.dir, false)
+	if err != nil {
+		return false, fmt.Errorf("unable to lock image cache %s: %w", c.dir, err)
+	}
+	defer unlock()
+	cached, err := c.use(entry)
+	if err != nil || !cached {
+		return false, err
+	}
+	logrus.Debugf("Staging image cache entry %s to %s", entry, destDir)
+	return true, copyTree(filepath.Join(entry, cacheRootfsDir), destDir, hardlink)
+}
+
+// use marks the cache entry as used, and returns false if the image is not cached. The caller holds the read lock.
+func (c *imageCache) use(entry string) (bool, error) {
+	entryFile := filepath.Join(entry, cacheEntryFile)
+	if _, err := os.Stat(entryFile); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	now := time.Now()
+	if err := os.Chtimes(entryFile, now, now); err != nil {
+		logrus.Errorf("error marking image cache entry %s as used: %v", entry, err)
+	}
+	return true, nil
+}
+
+// evict removes the least recently used images until the cache fits its maximum size.
+func (c *imageCache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := PruneCache(c.dir, c.maxBytes); err != nil {
+		logrus.Errorf("error while evicting images from the image cache: %v", err)
+	}
+}
+
+// add extracts the image into a temporary directory of the cache, which is renamed to the entry once it is complete.
+func (c *imageCache) add(img v1.Image, digest v1.Hash, imgString, entry string) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(c.dir, ".extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	rootfs := filepath.Join(tmp, cacheRootfsDir)
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+	if err := extractFiles(img, rootfs); err != nil {
+		return err
+	}
+	size, err := treeSize(rootfs)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(CacheEntry{Digest: digest.String(), Image: imgString, Size: size})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, cacheEntryFile), data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, entry); err != nil {
+		// The image may have been cached concurrently.
+		if _, statErr := os.Stat(filepath.Join(entry, cacheEntryFile)); statErr == nil {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// ListCache returns the entries of the image cache, least recently used first.
+func ListCache(cacheDir string) ([]CacheEntry, error) {
+	dirEntries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var entries []CacheEntry
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() || strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+		dir := filepath.Join(cacheDir, dirEntry.Name())
+		entryFile := filepath.Join(dir, cacheEntryFile)
+		data, err := os.ReadFile(entryFile)
+		if err != nil {
+			logrus.Warnf("Skipping image cache entry %s: %v", dirEntry.Name(), err)
+			continue
+		}
+		var entry CacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			logrus.Warnf("Skipping image cache entry %s: %v", dirEntry.Name(), err)
+			continue
+		}
+		info, err := os.Stat(entryFile)
+		if err != nil {
+			return nil, err
+		}
+		entry.LastUsed = info.ModTime()
+		entry.dir = dir
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// PruneCache evicts the least recently used entries of the image cache until the cache is no larger than maxBytes, and
+// returns the evicted entries. A maxBytes of zero evicts every entry. Leftovers of interrupted extractions are removed
+// as well. The cache directory is locked while entries are evicted, so that entries are not evicted while an agent
+// stages from them.
+func PruneCache(cacheDir string, maxBytes int64) ([]CacheEntry, error) {
+	dirEntries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	unlock, err := lockCache(cacheDir, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock image cache %s: %w", cacheDir, err)
+	}
+	defer unlock()
+	for _, dirEntry := range dirEntries {
+		if strings.HasPrefix(dirEntry.Name(), ".extract-") {
+			info, err := dirEntry.Info()
+			// Extractions that are in progress are left alone.
+			if err == nil && time.Since(info.ModTime()) > time.Hour {
+				if err := os.RemoveAll(filepath.Join(cacheDir, dirEntry.Name())); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	entries, err := ListCache(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	var evicted []CacheEntry
+	for _, entry := range entries {
+		if total <= maxBytes && maxBytes > 0 {
+			break
+		}
+		logrus.Infof("Evicting image %s with digest %s from the image cache (%d bytes)", entry.Image, entry.Digest, entry.Size)
+		if err := os.RemoveAll(entry.dir); err != nil {
+			return evicted, err
+		}
+		total -= entry.Size
+		evicted = append(evicted, entry)
+	}
+	return evicted, nil
+}
+
+// copyTree copies the directories, regular files and symlinks below src to dst, preserving their modes. Regular files
+// are hard linked instead of copied when hardlink is set.
+func copyTree(src, dst string, hardlink bool) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_ = os.Remove(target)
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			_ = os.Remove(target)
+			if hardlink {
+				return os.Link(path, target)
+			}
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			logrus.Warnf("Skipping %s in image cache as it is not a directory, regular file or symlink", path)
+			return nil
+		}
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// treeSize returns the total size of the regular files below dir.
+func treeSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to compute size of %s: %w", dir, err)
+	}
+	return size, nil
+}
@@ -0,0 +1,186 @@
+//go:build !windows
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestStageCache(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-image-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	imagesDir := filepath.Join(tempDir, "images")
+	writeTestImage(t, imagesDir, "first.tar", "example.com/rancher/first:v1", "#!/bin/sh\necho first\n")
+	writeTestImage(t, imagesDir, "second.tar", "example.com/rancher/second:v1", "#!/bin/sh\necho second\n")
+	cacheDir := filepath.Join(tempDir, "cache")
+
+	testCases := []struct {
+		Name     string
+		Hardlink bool
+	}{
+		{
+			Name: "copy",
+		},
+		{
+			Name:     "hardlink",
+			Hardlink: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			defer os.RemoveAll(cacheDir)
+			// The cache only has room for a single image.
+			u := NewUtility(imagesDir, "", "", filepath.Join(tempDir, "registries.yaml"), Options{CacheDir: cacheDir, CacheMaxBytes: 30, CacheHardlink: tc.Hardlink})
+
+			dest := filepath.Join(tempDir, tc.Name, "1")
+			staged, err := u.Stage(context.Background(), dest, "example.com/rancher/first:v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertContent(t, filepath.Join(dest, "run.sh"), "#!/bin/sh\necho first\n")
+			entries, err := ListCache(cacheDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Digest != staged.Digest || entries[0].Image != "example.com/rancher/first:v1" || entries[0].Size != 21 {
+				t.Fatalf("unexpected cache entries %+v", entries)
+			}
+
+			// The image is staged from the cache rather than extracted again.
+			cached := filepath.Join(entries[0].dir, cacheRootfsDir, "run.sh")
+			if err := os.WriteFile(cached+".tmp", []byte("cached"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(cached+".tmp", cached); err != nil {
+				t.Fatal(err)
+			}
+			dest = filepath.Join(tempDir, tc.Name, "2")
+			if _, err := u.Stage(context.Background(), dest, "example.com/rancher/first:v1"); err != nil {
+				t.Fatal(err)
+			}
+			assertContent(t, filepath.Join(dest, "run.sh"), "cached")
+			if info, err := os.Stat(filepath.Join(dest, "run.sh")); err != nil || info.Mode().Perm() != 0755 {
+				t.Errorf("expected staged file to be executable: %v", err)
+			}
+			cachedInfo, err := os.Stat(cached)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stagedInfo, err := os.Stat(filepath.Join(dest, "run.sh"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if os.SameFile(cachedInfo, stagedInfo) != tc.Hardlink {
+				t.Errorf("expected staged file to be hard linked %t", tc.Hardlink)
+			}
+
+			// Caching another image evicts the least recently used one.
+			second, err := u.Stage(context.Background(), filepath.Join(tempDir, tc.Name, "3"), "example.com/rancher/second:v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err = ListCache(cacheDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Digest != second.Digest {
+				t.Fatalf("expected only the second image to be cached, found %+v", entries)
+			}
+
+			// Pruning waits for the entries that are staged from, by this or another process, to be staged.
+			unlock, err := lockCache(cacheDir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pruned := make(chan []CacheEntry)
+			go func() {
+				evicted, err := PruneCache(cacheDir, 0)
+				if err != nil {
+					t.Error(err)
+				}
+				pruned <- evicted
+			}()
+			select {
+			case <-pruned:
+				t.Fatal("expected pruning to wait for the lock of the cache")
+			case <-time.After(100 * time.Millisecond):
+			}
+			unlock()
+			evicted := <-pruned
+			if len(evicted) != 1 || evicted[0].Digest != second.Digest {
+				t.Errorf("unexpected evicted entries %+v", evicted)
+			}
+		})
+	}
+}
+
+func assertContent(t *testing.T, path, expected string) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != expected {
+		t.Errorf("expected %s to contain %q, found %q", path, expected, content)
+	}
+}
+
+// writeTestImage writes a single layer image with a run.sh to an image archive in the images directory.
+func writeTestImage(t *testing.T, imagesDir, archive, imageName, script string) {
+	t.Helper()
+	tag, err := name.NewTag(imageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarball.WriteToFile(filepath.Join(imagesDir, archive), tag, newTestImage(t, script)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestImage returns a single layer image with a run.sh.
+func newTestImage(t *testing.T, script string) v1.Image {
+	t.Helper()
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{Name: "run.sh", Mode: 0755, Size: int64(len(script)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(script)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(layer.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
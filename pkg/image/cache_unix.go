@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package image
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockCache takes the lock of the cache directory, shared by the agents staging images from the cache and exclusive to
+// evicting entries, so that entries are not removed by another process while they are staged from. The returned func
+// releases the lock.
+func lockCache(cacheDir string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(cacheDir, cacheLockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
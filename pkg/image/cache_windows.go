@@ -0,0 +1,34 @@
+//go:build windows
+// +build windows
+
+package image
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockCache takes the lock of the cache directory, shared by the agents staging images from the cache and exclusive to
+// evicting entries, so that entries are not removed by another process while they are staged from. The returned func
+// releases the lock.
+func lockCache(cacheDir string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(cacheDir, cacheLockFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	overlapped := new(windows.Overlapped)
+	if err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, overlapped); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, overlapped)
+		f.Close()
+	}, nil
+}
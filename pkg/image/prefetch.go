@@ -0,0 +1,108 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// Prefetch starts pulling the images and extracting them into the image cache in the background, with at most workers
+// images at once, and returns a function that waits until they are prefetched and returns the errors of the images
+// that could not be. Staging an image that is being prefetched waits for its prefetch instead of pulling it again.
+//
+// Every image is attempted once, bounded by the pull timeout, as staging it retries. Signatures are not verified, as
+// staging an image verifies its signature before it is staged from the cache.
+func (u *Utility) Prefetch(ctx context.Context, images []string, workers int) (func() error, error) {
+	if u.cache == nil {
+		return nil, errors.New("prefetching images requires an image cache")
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var queued []string
+	u.prefetchMu.Lock()
+	if u.prefetching == nil {
+		u.prefetching = map[string]chan struct{}{}
+	}
+	for _, imgString := range images {
+		if _, ok := u.prefetching[imgString]; ok {
+			continue
+		}
+		u.prefetching[imgString] = make(chan struct{})
+		queued = append(queued, imgString)
+	}
+	u.prefetchMu.Unlock()
+
+	var (
+		mu   sync.Mutex
+		errs []error
+		done = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		var eg errgroup.Group
+		eg.SetLimit(workers)
+		for _, imgString := range queued {
+			eg.Go(func() error {
+				defer u.finishPrefetch(imgString)
+				if err := u.prefetch(ctx, imgString); err != nil {
+					logrus.Warnf("Failed to prefetch image %s: %v", imgString, err)
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+				return nil
+			})
+		}
+		_ = eg.Wait()
+	}()
+
+	return func() error {
+		<-done
+		return errors.Join(errs...)
+	}, nil
+}
+
+func (u *Utility) prefetch(ctx context.Context, imgString string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return u.attempt(ctx, func(ctx context.Context) error {
+		img, err := u.getImage(ctx, imgString)
+		if err != nil {
+			return err
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			return fmt.Errorf("unable to compute digest of image %s: %w", imgString, err)
+		}
+		return u.cache.prefetch(img, digest, imgString)
+	})
+}
+
+func (u *Utility) finishPrefetch(imgString string) {
+	u.prefetchMu.Lock()
+	defer u.prefetchMu.Unlock()
+	close(u.prefetching[imgString])
+	delete(u.prefetching, imgString)
+}
+
+// awaitPrefetch waits until the image is no longer being prefetched, or the context is done.
+func (u *Utility) awaitPrefetch(ctx context.Context, imgString string) {
+	u.prefetchMu.Lock()
+	done, ok := u.prefetching[imgString]
+	u.prefetchMu.Unlock()
+	if !ok {
+		return
+	}
+	logrus.Infof("Waiting for the prefetch of image %s to complete before staging it", imgString)
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,92 @@
+//go:build !windows
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestPrefetch(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-image-prefetch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var blobs atomic.Int32
+	reg := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			blobs.Add(1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	scripts := map[string]string{
+		host + "/rancher/installer:v1": "#!/bin/sh\necho installer\n",
+		host + "/rancher/upgrader:v1":  "#!/bin/sh\necho upgrader\n",
+	}
+	var images []string
+	for imageName, script := range scripts {
+		ref, err := name.ParseReference(imageName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, newTestImage(t, script)); err != nil {
+			t.Fatal(err)
+		}
+		images = append(images, imageName)
+	}
+	blobs.Store(0)
+
+	registriesFile := filepath.Join(tempDir, "registries.yaml")
+	if _, err := NewUtility(filepath.Join(tempDir, "images"), "", "", registriesFile, Options{}).Prefetch(context.Background(), images, 2); err == nil {
+		t.Error("expected prefetch without an image cache to fail")
+	}
+
+	u := NewUtility(filepath.Join(tempDir, "images"), "", "", registriesFile, Options{CacheDir: filepath.Join(tempDir, "cache")})
+	wait, err := u.Prefetch(context.Background(), append(images, images[0]), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ListCache(filepath.Join(tempDir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(images) {
+		t.Fatalf("expected %d images in the image cache, found %+v", len(images), entries)
+	}
+	// The layer of every image is pulled once.
+	if n := blobs.Load(); n != int32(len(images)) {
+		t.Errorf("expected %d blobs to be pulled, found %d", len(images), n)
+	}
+
+	for i, imageName := range images {
+		destDir := filepath.Join(tempDir, fmt.Sprintf("stage-%d", i))
+		if _, err := u.Stage(context.Background(), destDir, imageName); err != nil {
+			t.Fatal(err)
+		}
+		assertContent(t, filepath.Join(destDir, "run.sh"), scripts[imageName])
+	}
+	// Staging a prefetched image only resolves its manifest.
+	if n := blobs.Load(); n != int32(len(images)) {
+		t.Errorf("expected no more blobs to be pulled when staging, found %d", n-int32(len(images)))
+	}
+}
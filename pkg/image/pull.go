@@ -0,0 +1,320 @@
+package image
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	allEndpointsFailed    = "all endpoints failed: "
+	defaultPullBackoff    = 5 * time.Second
+	defaultPullMaxBackoff = 2 * time.Minute
+)
+
+// EndpointError is the failure of pulling an image from a single registry endpoint.
+type EndpointError struct {
+	// Endpoint is the URL of the endpoint, which is empty if the endpoint that failed could not be determined.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Mirror is true for a mirror endpoint from registries.yaml, and false for the upstream registry.
+	Mirror bool   `json:"mirror"`
+	Error  string `json:"error"`
+}
+
+func (e EndpointError) kind() string {
+	if e.Mirror {
+		return "mirror"
+	}
+	return "upstream"
+}
+
+// PullError is the failure of pulling an image, with the failure of every registry endpoint that was tried in the last
+// attempt, in the order they were tried.
+type PullError struct {
+	Image     string          `json:"image"`
+	Attempts  int             `json:"attempts"`
+	Endpoints []EndpointError `json:"endpoints"`
+
+	err error
+}
+
+func (e *PullError) Error() string {
+	var chain []string
+	for _, endpoint := range e.Endpoints {
+		if endpoint.Endpoint == "" {
+			chain = append(chain, endpoint.Error)
+			continue
+		}
+		chain = append(chain, fmt.Sprintf("%s %s: %s", endpoint.kind(), endpoint.Endpoint, endpoint.Error))
+	}
+	attempts := ""
+	if e.Attempts > 1 {
+		attempts = fmt.Sprintf(" after %d attempts", e.Attempts)
+	}
+	return fmt.Sprintf("failed to get image %s%s: %s", e.Image, attempts, strings.Join(chain, "; "))
+}
+
+func (e *PullError) Unwrap() error {
+	return e.err
+}
+
+// permanentError is an error of staging an image that is not retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// withRetry runs pull until it succeeds, returns a permanent error, or has been attempted PullAttempts times, backing
+// off exponentially between attempts. Every attempt is bounded by PullTimeout and the context.
+func (u *Utility) withRetry(ctx context.Context, imgString string, pull func(ctx context.Context) error) error {
+	backoff := u.pullBackoff
+	for attempt := 1; ; attempt++ {
+		err := u.attempt(ctx, pull)
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		var pullErr *PullError
+		if errors.As(err, &pullErr) {
+			pullErr.Attempts = attempt
+		}
+		if attempt >= u.pullAttempts || ctx.Err() != nil {
+			if pullErr == nil && attempt > 1 {
+				return fmt.Errorf("failed to stage image %s after %d attempts: %w", imgString, attempt, err)
+			}
+			return err
+		}
+
+		logrus.Warnf("Attempt %d of %d to stage image %s failed, retrying in %s: %v", attempt, u.pullAttempts, imgString, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > u.pullMaxBackoff {
+			backoff = u.pullMaxBackoff
+		}
+	}
+}
+
+func (u *Utility) attempt(ctx context.Context, pull func(ctx context.Context) error) error {
+	if u.pullTimeout <= 0 {
+		return pull(ctx)
+	}
+	pullCtx, cancel := context.WithTimeout(ctx, u.pullTimeout)
+	defer cancel()
+	err := pull(pullCtx)
+	if err != nil && errors.Is(pullCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("timed out after %s: %w", u.pullTimeout, err)
+	}
+	return err
+}
+
+// registryEndpoint is an endpoint that an image is pulled from.
+type registryEndpoint struct {
+	url    string
+	mirror bool
+}
+
+// registryEndpoints returns the endpoints that the registries configuration tries for the image, in order: the mirror
+// endpoints of the first mirror entry that matches the registry of the image, followed by the upstream registry. This
+// follows the order of github.com/rancher/wharfie/pkg/registries.
+func registryEndpoints(config *registries.Registry, ref name.Reference) []registryEndpoint {
+	var endpoints []registryEndpoint
+	registry := ref.Context().RegistryStr()
+	keys := []string{registry}
+	if registry == name.DefaultRegistry {
+		keys = append(keys, "docker.io")
+	} else if _, _, err := net.SplitHostPort(registry); err != nil {
+		keys = append(keys, registry+":443", registry+":80")
+	}
+	keys = append(keys, "*")
+
+	if config != nil {
+		for _, key := range keys {
+			mirror, ok := config.Mirrors[key]
+			if !ok {
+				continue
+			}
+			for _, endpoint := range mirror.Endpoints {
+				if u, ok := endpointURL(endpoint); ok {
+					endpoints = append(endpoints, registryEndpoint{url: u, mirror: true})
+				}
+			}
+			break
+		}
+	}
+	upstream, _ := endpointURL(registry)
+	return append(endpoints, registryEndpoint{url: upstream})
+}
+
+// registryAuthenticator returns the authenticator of the credentials that registries.yaml configures for the upstream
+// registry of the reference, and the authenticator of the keychain otherwise, the way the registry is authenticated to
+// when pulling the image.
+func registryAuthenticator(config *registries.Registry, keychain authn.Keychain, ref name.Reference) (authn.Authenticator, error) {
+	registry := ref.Context().RegistryStr()
+	keys := []string{registry}
+	if registry == name.DefaultRegistry {
+		keys = append(keys, "docker.io")
+	}
+	keys = append(keys, "*")
+
+	if config != nil {
+		for _, key := range keys {
+			registryConfig, ok := config.Configs[key]
+			if !ok {
+				continue
+			}
+			if auth := registryConfig.Auth; auth != nil {
+				return authn.FromConfig(authn.AuthConfig{
+					Username:      auth.Username,
+					Password:      auth.Password,
+					Auth:          auth.Auth,
+					IdentityToken: auth.IdentityToken,
+				}), nil
+			}
+			break
+		}
+	}
+	if keychain == nil {
+		return authn.Anonymous, nil
+	}
+	return keychain.Resolve(ref.Context())
+}
+
+// registryTransport returns a transport that trusts the CA and presents the client certificate that registries.yaml
+// configures for the upstream registry of the reference, the way the registry is connected to when pulling the image.
+func registryTransport(config *registries.Registry, ref name.Reference) (http.RoundTripper, error) {
+	if config == nil {
+		return remote.DefaultTransport, nil
+	}
+	registry := ref.Context().RegistryStr()
+	keys := []string{registry}
+	if registry == name.DefaultRegistry {
+		keys = append(keys, "docker.io")
+	}
+	keys = append(keys, "*")
+
+	for _, key := range keys {
+		registryConfig, ok := config.Configs[key]
+		if !ok {
+			continue
+		}
+		if registryConfig.TLS == nil {
+			break
+		}
+		tlsConfig, err := registryTLSConfig(registryConfig.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration of registry %s: %w", key, err)
+		}
+		transport := remote.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		return transport, nil
+	}
+	return remote.DefaultTransport, nil
+}
+
+// registryTLSConfig loads the CA and client certificate of the TLS configuration of a registry.
+func registryTLSConfig(config *registries.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify, //nolint:gosec // configured in registries.yaml
+	}
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("cert file %q and key file %q must be set together", config.CertFile, config.KeyFile)
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load cert file: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load system cert pool: %w", err)
+		}
+		ca, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load CA file: %w", err)
+		}
+		pool.AppendCertsFromPEM(ca)
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// endpointURL returns the URL of an endpoint the way it is logged, and false if the endpoint is invalid and skipped.
+func endpointURL(endpoint string) (string, bool) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "//" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return endpoint, false
+	}
+	if u.Scheme == "" {
+		u.Scheme = "https"
+		// Localhost on other ports than 443 defaults to http.
+		if host := u.Hostname(); (host == "localhost" || net.ParseIP(host).IsLoopback()) && u.Port() != "" && u.Port() != "443" {
+			u.Scheme = "http"
+		}
+	}
+	return u.String(), true
+}
+
+// newPullError attributes the combined error of pulling the image from every endpoint to the endpoints in the order
+// they were tried. If the errors do not line up with the endpoints, they are reported without their endpoint.
+func newPullError(imgString string, endpoints []registryEndpoint, err error) *PullError {
+	// The errors of the endpoints are combined and wrapped with a message that is prefixed to the combined error.
+	cause := err
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if !strings.HasPrefix(e.Error(), allEndpointsFailed) {
+			cause = e
+			break
+		}
+	}
+	errs := []error{cause}
+	if multi, ok := cause.(interface{ Unwrap() []error }); ok {
+		errs = multi.Unwrap()
+	}
+
+	pullErr := &PullError{Image: imgString, err: err}
+	for i, e := range errs {
+		endpointErr := EndpointError{Error: e.Error()}
+		if len(errs) == len(endpoints) {
+			endpointErr.Endpoint = endpoints[i].url
+			endpointErr.Mirror = endpoints[i].mirror
+			logrus.Warnf("Failed to pull image %s from %s endpoint %s: %v", imgString, endpointErr.kind(), endpointErr.Endpoint, e)
+		}
+		pullErr.Endpoints = append(pullErr.Endpoints, endpointErr)
+	}
+	return pullErr
+}
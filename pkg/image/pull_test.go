@@ -0,0 +1,376 @@
+//go:build !windows
+
+package image
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/rancher/wharfie/pkg/registries"
+)
+
+func TestStagePull(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-image-pull-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The upstream registry fails the given number of manifest requests, or delays them, before serving them.
+	var failures atomic.Int32
+	var delay atomic.Int64
+	reg := registry.New()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			if failures.Add(-1) >= 0 {
+				http.Error(w, "denied", http.StatusForbidden)
+				return
+			}
+			select {
+			case <-time.After(time.Duration(delay.Load())):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	// The mirror is not listening.
+	mirror := httptest.NewServer(http.NotFoundHandler())
+	mirror.Close()
+
+	imageName := host + "/rancher/installer:v1"
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := newTestImage(t, "#!/bin/sh\necho installed\n")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registriesFile := filepath.Join(tempDir, "registries.yaml")
+	if err := os.WriteFile(registriesFile, []byte(fmt.Sprintf("mirrors:\n  %q:\n    endpoint:\n      - %s\n", host, mirror.URL)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Name     string
+		Failures int32
+		Delay    time.Duration
+		Options  Options
+
+		ExpectSucceeded bool
+		ExpectAttempts  int
+		ExpectError     string
+	}{
+		{
+			Name:            "no retries",
+			ExpectSucceeded: true,
+		},
+		{
+			Name:           "mirror and upstream fail",
+			Failures:       1,
+			ExpectAttempts: 1,
+			ExpectError:    "denied",
+		},
+		{
+			Name:           "retries exhausted",
+			Failures:       3,
+			Options:        Options{PullAttempts: 3, PullBackoff: time.Millisecond},
+			ExpectAttempts: 3,
+			ExpectError:    "denied",
+		},
+		{
+			Name:            "retry succeeds",
+			Failures:        2,
+			Options:         Options{PullAttempts: 3, PullBackoff: time.Millisecond},
+			ExpectSucceeded: true,
+		},
+		{
+			Name:           "timeout",
+			Delay:          time.Minute,
+			Options:        Options{PullAttempts: 2, PullBackoff: time.Millisecond, PullTimeout: 100 * time.Millisecond},
+			ExpectAttempts: 2,
+			ExpectError:    "timed out after 100ms",
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			failures.Store(tc.Failures)
+			delay.Store(int64(tc.Delay))
+			u := NewUtility(filepath.Join(tempDir, "images"), "", "", registriesFile, tc.Options)
+			destDir := filepath.Join(tempDir, fmt.Sprintf("stage-%d", i))
+
+			staged, err := u.Stage(context.Background(), destDir, imageName)
+			if tc.ExpectSucceeded {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if staged.Digest != digest.String() {
+					t.Errorf("expected digest %s, found %s", digest, staged.Digest)
+				}
+				assertContent(t, filepath.Join(destDir, "run.sh"), "#!/bin/sh\necho installed\n")
+				return
+			}
+
+			if err == nil {
+				t.Fatal("expected staging to fail")
+			}
+			if !strings.Contains(err.Error(), tc.ExpectError) {
+				t.Errorf("expected error to contain %q, found %v", tc.ExpectError, err)
+			}
+			if tc.Delay > 0 {
+				return
+			}
+			var pullErr *PullError
+			if !errors.As(err, &pullErr) {
+				t.Fatalf("expected a pull error, found %v", err)
+			}
+			if pullErr.Attempts != tc.ExpectAttempts {
+				t.Errorf("expected %d attempts, found %d", tc.ExpectAttempts, pullErr.Attempts)
+			}
+			if len(pullErr.Endpoints) != 2 {
+				t.Fatalf("expected the mirror and upstream endpoints, found %+v", pullErr.Endpoints)
+			}
+			if e := pullErr.Endpoints[0]; e.Endpoint != mirror.URL || !e.Mirror || !strings.Contains(e.Error, "connection refused") {
+				t.Errorf("expected mirror %s to be refused, found %+v", mirror.URL, e)
+			}
+			if e := pullErr.Endpoints[1]; e.Endpoint != upstream.URL || e.Mirror || !strings.Contains(e.Error, "denied") {
+				t.Errorf("expected upstream %s to be denied, found %+v", upstream.URL, e)
+			}
+		})
+	}
+}
+
+func TestStageLocalImagePinnedByIndex(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-image-pull-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The blobs pulled from the registry are counted, to tell the images staged from the images directory apart.
+	var blobs atomic.Int32
+	reg := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			blobs.Add(1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	imagesDir := filepath.Join(tempDir, "images")
+	img := newTestImage(t, "#!/bin/sh\necho installed\n")
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(host + "/rancher/installer:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(imagesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tarball.WriteToFile(filepath.Join(imagesDir, "installer.tar"), tag, img); err != nil {
+		t.Fatal(err)
+	}
+	indexDigest := writeTestIndex(t, tag, img)
+	other := newTestImage(t, "#!/bin/sh\necho other\n")
+	otherDigest, err := other.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIndexDigest := writeTestIndex(t, tag.Context().Tag("v2"), other)
+	blobs.Store(0)
+
+	u := NewUtility(imagesDir, "", "", filepath.Join(tempDir, "registries.yaml"), Options{})
+	dest := filepath.Join(tempDir, "stage")
+	staged, err := u.Stage(context.Background(), dest, tag.Name()+"@"+indexDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staged.Digest != digest.String() || staged.IndexDigest != indexDigest {
+		t.Errorf("expected digest %s of index %s, found %+v", digest, indexDigest, staged)
+	}
+	assertContent(t, filepath.Join(dest, "run.sh"), "#!/bin/sh\necho installed\n")
+	if n := blobs.Load(); n != 0 {
+		t.Errorf("expected the image to be staged from the images directory, found %d blobs pulled", n)
+	}
+
+	// The local image is not used for an index that does not hold it.
+	staged, err = u.Stage(context.Background(), filepath.Join(tempDir, "other"), tag.Name()+"@"+otherIndexDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staged.Digest != otherDigest.String() || staged.IndexDigest != otherIndexDigest {
+		t.Errorf("expected digest %s of index %s, found %+v", otherDigest, otherIndexDigest, staged)
+	}
+	assertContent(t, filepath.Join(tempDir, "other", "run.sh"), "#!/bin/sh\necho other\n")
+	if blobs.Load() == 0 {
+		t.Error("expected the image to be pulled from the registry")
+	}
+}
+
+// writeTestIndex pushes a multi-platform index holding the image for the platform of the test, and returns its digest.
+func writeTestIndex(t *testing.T, ref name.Reference, img v1.Image, options ...remote.Option) string {
+	t.Helper()
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add: img,
+		Descriptor: v1.Descriptor{
+			Platform: &v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH},
+		},
+	})
+	if err := remote.WriteIndex(ref, index, options...); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest.String()
+}
+
+func TestLookupIndexDigestTLS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-image-pull-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := httptest.NewTLSServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	caFile := filepath.Join(tempDir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img := newTestImage(t, "#!/bin/sh\necho installed\n")
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := name.NewTag(host + "/rancher/installer:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDigest := writeTestIndex(t, tag, img, remote.WithTransport(server.Client().Transport))
+
+	testCases := []struct {
+		Name   string
+		Config *registries.Registry
+
+		ExpectedIndexDigest string
+	}{
+		{
+			Name:   "trusted CA",
+			Config: &registries.Registry{Configs: map[string]registries.RegistryConfig{host: {TLS: &registries.TLSConfig{CAFile: caFile}}}},
+
+			ExpectedIndexDigest: indexDigest,
+		},
+		{
+			Name:   "insecure",
+			Config: &registries.Registry{Configs: map[string]registries.RegistryConfig{"*": {TLS: &registries.TLSConfig{InsecureSkipVerify: true}}}},
+
+			ExpectedIndexDigest: indexDigest,
+		},
+		{
+			Name:   "untrusted CA",
+			Config: &registries.Registry{},
+		},
+		{
+			Name:   "missing CA file",
+			Config: &registries.Registry{Configs: map[string]registries.RegistryConfig{host: {TLS: &registries.TLSConfig{CAFile: filepath.Join(tempDir, "missing.pem")}}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if found := lookupIndexDigest(context.Background(), tc.Config, nil, tag, digest); found != tc.ExpectedIndexDigest {
+				t.Errorf("expected index digest %q, found %q", tc.ExpectedIndexDigest, found)
+			}
+		})
+	}
+}
+
+func TestRegistryAuthenticator(t *testing.T) {
+	config := &registries.Registry{
+		Configs: map[string]registries.RegistryConfig{
+			"registry.example.com": {Auth: &registries.AuthConfig{Username: "user", Password: "password"}},
+			"docker.io":            {Auth: &registries.AuthConfig{Username: "hub", Password: "password"}},
+			"*":                    {},
+		},
+	}
+	keychain := staticKeychain{authn.FromConfig(authn.AuthConfig{Username: "keychain"})}
+
+	testCases := []struct {
+		Name       string
+		Image      string
+		Config     *registries.Registry
+		ExpectUser string
+	}{
+		{Name: "configured registry", Image: "registry.example.com/rancher/installer:v1", Config: config, ExpectUser: "user"},
+		{Name: "default registry", Image: "rancher/installer:v1", Config: config, ExpectUser: "hub"},
+		{Name: "wildcard without auth", Image: "other.example.com/rancher/installer:v1", Config: config, ExpectUser: "keychain"},
+		{Name: "no registries.yaml", Image: "registry.example.com/rancher/installer:v1", ExpectUser: "keychain"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			ref, err := name.ParseReference(tc.Image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth, err := registryAuthenticator(tc.Config, keychain, ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			authConfig, err := auth.Authorization()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if authConfig.Username != tc.ExpectUser {
+				t.Errorf("expected user %q, found %q", tc.ExpectUser, authConfig.Username)
+			}
+		})
+	}
+}
+
+// staticKeychain resolves every resource to the same authenticator.
+type staticKeychain struct {
+	auth authn.Authenticator
+}
+
+func (k staticKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return k.auth, nil
+}
@@ -0,0 +1,610 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// SignatureMode determines what happens when the signature of an image cannot be verified.
+type SignatureMode string
+
+const (
+	// SignatureModeEnforce refuses to stage images whose signature cannot be verified.
+	SignatureModeEnforce SignatureMode = "enforce"
+	// SignatureModeWarn stages images whose signature cannot be verified, and only logs and records the failure.
+	SignatureModeWarn SignatureMode = "warn"
+)
+
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+	cosignSignatureType         = "cosign container image signature"
+	maxSignaturePayloadBytes    = 1 << 20
+)
+
+var (
+	// oidIssuer and oidIssuerV2 are the extensions of a Fulcio certificate that hold the OIDC issuer of the signer.
+	oidIssuer   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// SignaturePolicy declares how the cosign signatures of the images in its scope are verified before they are staged.
+type SignaturePolicy struct {
+	// Scope is the registry, such as docker.io, or the repository or repository prefix, such as docker.io/rancher, that
+	// the policy applies to. The policy with the most specific scope that matches an image applies, and * matches every
+	// image.
+	Scope string `json:"scope"`
+	// Mode is either enforce, the default, or warn.
+	Mode SignatureMode `json:"mode,omitempty"`
+	// PublicKeys are the paths of PEM encoded public keys that images are signed with by cosign sign --key.
+	PublicKeys []string `json:"publicKeys,omitempty"`
+	// Keyless verifies signatures made with short-lived certificates, as by cosign sign without a key.
+	Keyless *KeylessPolicy `json:"keyless,omitempty"`
+}
+
+// KeylessPolicy declares the local trust root of signatures made with short-lived certificates.
+type KeylessPolicy struct {
+	// TrustRoot is the path of the PEM encoded root and intermediate certificates of the certificate authority, such
+	// as Fulcio.
+	TrustRoot string `json:"trustRoot"`
+	// TransparencyLogPublicKeys are the paths of the PEM encoded public keys of the transparency log, such as Rekor,
+	// whose signed entry timestamp proves that the certificate was valid when the image was signed.
+	TransparencyLogPublicKeys []string `json:"transparencyLogPublicKeys"`
+	// Identities are the signers that are trusted.
+	Identities []SignerIdentity `json:"identities"`
+}
+
+// SignerIdentity is the identity of a signer in a short-lived certificate.
+type SignerIdentity struct {
+	// Subject is the email address or URI of the signer.
+	Subject string `json:"subject"`
+	// Issuer is the OIDC issuer that authenticated the signer.
+	Issuer string `json:"issuer"`
+}
+
+// SignatureVerification is the result of verifying the signature of an image.
+type SignatureVerification struct {
+	// Digest is the digest whose signature was verified, which is the digest of the index of a multi-platform image
+	// signed as a whole, and the digest of the platform image otherwise.
+	Digest string `json:"digest"`
+	// Scope is the scope of the policy the image was verified with.
+	Scope    string        `json:"scope"`
+	Mode     SignatureMode `json:"mode"`
+	Verified bool          `json:"verified"`
+	// Signer is the path of the public key that verified the signature, or the subject of the certificate of a keyless
+	// signature.
+	Signer string `json:"signer,omitempty"`
+	// Issuer is the OIDC issuer of the certificate of a keyless signature.
+	Issuer string `json:"issuer,omitempty"`
+	// Error is the reason the signature could not be verified.
+	Error string `json:"error,omitempty"`
+}
+
+// ValidateSignaturePolicies checks that every policy is complete and that its keys and certificates can be loaded.
+func ValidateSignaturePolicies(policies []SignaturePolicy) error {
+	scopes := map[string]bool{}
+	for _, policy := range policies {
+		if policy.Scope == "" {
+			return fmt.Errorf("image signature policy has no scope")
+		}
+		scope := normalizeScope(policy.Scope)
+		if scopes[scope] {
+			return fmt.Errorf("duplicate image signature policy for scope %s", policy.Scope)
+		}
+		scopes[scope] = true
+		if _, err := newSignatureVerifier(policy); err != nil {
+			return fmt.Errorf("invalid image signature policy for scope %s: %w", policy.Scope, err)
+		}
+	}
+	return nil
+}
+
+// matchSignaturePolicy returns the policy with the most specific scope that matches the repository of the image, or nil
+// if no policy applies to it.
+func matchSignaturePolicy(policies []SignaturePolicy, ref name.Reference) *SignaturePolicy {
+	repository := ref.Context().Name()
+	var match *SignaturePolicy
+	matchLen := -1
+	for i, policy := range policies {
+		scope := normalizeScope(policy.Scope)
+		switch {
+		case scope == "*":
+			if matchLen < 0 {
+				match, matchLen = &policies[i], 0
+			}
+		case repository == scope || strings.HasPrefix(repository, scope+"/"):
+			if len(scope) > matchLen {
+				match, matchLen = &policies[i], len(scope)
+			}
+		}
+	}
+	return match
+}
+
+// normalizeScope names the registry of the scope the way go-containerregistry names it, so that docker.io matches
+// images of Docker Hub.
+func normalizeScope(scope string) string {
+	scope = strings.TrimSuffix(scope, "/")
+	if scope == "*" {
+		return scope
+	}
+	registry, repository, _ := strings.Cut(scope, "/")
+	if r, err := name.NewRegistry(registry); err == nil {
+		registry = r.Name()
+	}
+	if repository == "" {
+		return registry
+	}
+	return registry + "/" + repository
+}
+
+// verifySignature verifies the signature of the image with the policy that applies to it, if any. A signature of the
+// index the image was resolved from is accepted as well as a signature of the platform image. The error of a failed
+// verification is only returned in enforce mode, while the verification records it either way.
+func (u *Utility) verifySignature(ctx context.Context, ref name.Reference, digest v1.Hash, indexDigest string) (*SignatureVerification, error) {
+	policy := matchSignaturePolicy(u.signaturePolicies, ref)
+	if policy == nil {
+		return nil, nil
+	}
+	verification := &SignatureVerification{
+		Digest: digest.String(),
+		Scope:  policy.Scope,
+		Mode:   policy.Mode,
+	}
+	if verification.Mode == "" {
+		verification.Mode = SignatureModeEnforce
+	}
+
+	digests := []v1.Hash{digest}
+	if indexDigest != "" {
+		index, err := v1.NewHash(indexDigest)
+		if err != nil {
+			return nil, err
+		}
+		digests = []v1.Hash{index, digest}
+	}
+	var (
+		signer, issuer string
+		errs           []error
+	)
+	for _, d := range digests {
+		s, i, err := u.verifySignatures(ctx, policy, ref, d)
+		if err != nil {
+			if len(digests) > 1 {
+				err = fmt.Errorf("digest %s: %w", d, err)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		signer, issuer, errs = s, i, nil
+		verification.Digest = d.String()
+		break
+	}
+	if err := errors.Join(errs...); err != nil {
+		verification.Error = err.Error()
+		if verification.Mode == SignatureModeWarn {
+			logrus.Warnf("Signature of image %s with digest %s could not be verified: %v", ref.Name(), digest, err)
+			return verification, nil
+		}
+		return verification, fmt.Errorf("signature of image %s with digest %s could not be verified: %w", ref.Name(), digest, err)
+	}
+	verification.Verified = true
+	verification.Signer = signer
+	verification.Issuer = issuer
+	logrus.Infof("Verified signature of image %s with digest %s signed by %s", ref.Name(), verification.Digest, signer)
+	return verification, nil
+}
+
+// verifySignatures looks up the cosign signatures of the image, which are stored as the layers of an image tagged
+// after the digest in the same repository, and returns the signer of the first signature that verifies.
+func (u *Utility) verifySignatures(ctx context.Context, policy *SignaturePolicy, ref name.Reference, digest v1.Hash) (string, string, error) {
+	verifier, err := newSignatureVerifier(*policy)
+	if err != nil {
+		return "", "", err
+	}
+	sigRef := ref.Context().Tag(digest.Algorithm + "-" + digest.Hex + ".sig")
+	sigImg, err := u.getImage(ctx, sigRef.Name())
+	if err != nil {
+		return "", "", fmt.Errorf("unable to get signatures %s: %w", sigRef.Name(), err)
+	}
+	manifest, err := sigImg.Manifest()
+	if err != nil {
+		return "", "", fmt.Errorf("unable to get manifest of signatures %s: %w", sigRef.Name(), err)
+	}
+	var errs []error
+	for i, desc := range manifest.Layers {
+		payload, err := signaturePayload(sigImg, desc.Digest)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("signature %d: %w", i, err))
+			continue
+		}
+		signer, issuer, err := verifier.verify(payload, desc.Annotations, digest)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("signature %d: %w", i, err))
+			continue
+		}
+		return signer, issuer, nil
+	}
+	if len(errs) == 0 {
+		return "", "", fmt.Errorf("no signatures found in %s", sigRef.Name())
+	}
+	return "", "", errors.Join(errs...)
+}
+
+func signaturePayload(sigImg v1.Image, digest v1.Hash) ([]byte, error) {
+	layer, err := sigImg.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, maxSignaturePayloadBytes))
+}
+
+// simpleSigningPayload is the payload that cosign signs, which binds the signature to the digest of the image.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// rekorBundle is the signed entry timestamp of a signature in the transparency log.
+type rekorBundle struct {
+	SignedEntryTimestamp []byte       `json:"SignedEntryTimestamp"`
+	Payload              rekorPayload `json:"Payload"`
+}
+
+// rekorPayload is the transparency log entry that the signed entry timestamp signs. Its fields are in lexical order so
+// that it marshals to canonical JSON.
+type rekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedRekord is the body of a transparency log entry of a signature.
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+type signerKey struct {
+	path string
+	key  crypto.PublicKey
+}
+
+// signatureVerifier holds the keys and certificates of a policy.
+type signatureVerifier struct {
+	keys []signerKey
+
+	keyless    *KeylessPolicy
+	roots      *x509.CertPool
+	trustChain []*x509.Certificate
+	// logKeys are the public keys of the transparency log by log ID, the hex encoded SHA-256 of the key.
+	logKeys map[string]crypto.PublicKey
+}
+
+func newSignatureVerifier(policy SignaturePolicy) (*signatureVerifier, error) {
+	switch policy.Mode {
+	case "", SignatureModeEnforce, SignatureModeWarn:
+	default:
+		return nil, fmt.Errorf("invalid mode %s, must be %s or %s", policy.Mode, SignatureModeEnforce, SignatureModeWarn)
+	}
+	if len(policy.PublicKeys) == 0 && policy.Keyless == nil {
+		return nil, fmt.Errorf("neither public keys nor keyless verification are configured")
+	}
+	v := &signatureVerifier{}
+	for _, path := range policy.PublicKeys {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, signerKey{path: path, key: key})
+	}
+	if policy.Keyless == nil {
+		return v, nil
+	}
+
+	v.keyless = policy.Keyless
+	if len(policy.Keyless.Identities) == 0 {
+		return nil, fmt.Errorf("keyless verification has no identities")
+	}
+	for _, identity := range policy.Keyless.Identities {
+		if identity.Subject == "" || identity.Issuer == "" {
+			return nil, fmt.Errorf("keyless identity must have a subject and an issuer")
+		}
+	}
+	certs, err := loadCertificates(policy.Keyless.TrustRoot)
+	if err != nil {
+		return nil, err
+	}
+	v.roots = x509.NewCertPool()
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			v.roots.AddCert(cert)
+		} else {
+			v.trustChain = append(v.trustChain, cert)
+		}
+	}
+	if len(v.trustChain) == len(certs) {
+		return nil, fmt.Errorf("trust root %s has no self-signed root certificate", policy.Keyless.TrustRoot)
+	}
+	if len(policy.Keyless.TransparencyLogPublicKeys) == 0 {
+		return nil, fmt.Errorf("keyless verification has no transparency log public keys")
+	}
+	v.logKeys = map[string]crypto.PublicKey{}
+	for _, path := range policy.Keyless.TransparencyLogPublicKeys {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+		logID := sha256.Sum256(der)
+		v.logKeys[hex.EncodeToString(logID[:])] = key
+	}
+	return v, nil
+}
+
+// verify verifies a single cosign signature of the image and returns its signer.
+func (v *signatureVerifier) verify(payload []byte, annotations map[string]string, digest v1.Hash) (string, string, error) {
+	var p simpleSigningPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return "", "", fmt.Errorf("invalid payload: %w", err)
+	}
+	if p.Critical.Type != cosignSignatureType {
+		return "", "", fmt.Errorf("unsupported payload type %q", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != digest.String() {
+		return "", "", fmt.Errorf("signature is for digest %s", p.Critical.Image.DockerManifestDigest)
+	}
+	sig, err := base64.StdEncoding.DecodeString(annotations[cosignSignatureAnnotation])
+	if err != nil || len(sig) == 0 {
+		return "", "", fmt.Errorf("missing or invalid %s annotation", cosignSignatureAnnotation)
+	}
+
+	if certPEM := annotations[cosignCertificateAnnotation]; certPEM != "" {
+		if v.keyless == nil {
+			return "", "", fmt.Errorf("keyless signature, but keyless verification is not configured")
+		}
+		return v.verifyKeyless(payload, sig, certPEM, annotations)
+	}
+	for _, key := range v.keys {
+		if err := verifySignature(key.key, payload, sig); err == nil {
+			return key.path, "", nil
+		}
+	}
+	return "", "", fmt.Errorf("signature does not match any public key")
+}
+
+// verifyKeyless verifies a signature made with a short-lived certificate. The certificate must chain up to the trust
+// root, must have been valid when the signature was entered into the transparency log, and must identify a trusted
+// signer.
+func (v *signatureVerifier) verifyKeyless(payload, sig []byte, certPEM string, annotations map[string]string) (string, string, error) {
+	certs, err := parseCertificates([]byte(certPEM))
+	if err != nil || len(certs) == 0 {
+		return "", "", fmt.Errorf("invalid certificate: %v", err)
+	}
+	cert := certs[0]
+	integratedTime, err := v.verifyBundle(annotations[cosignBundleAnnotation], payload, sig, cert)
+	if err != nil {
+		return "", "", err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range v.trustChain {
+		intermediates.AddCert(c)
+	}
+	if chain := annotations[cosignChainAnnotation]; chain != "" {
+		chainCerts, err := parseCertificates([]byte(chain))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid certificate chain: %w", err)
+		}
+		for _, c := range chainCerts {
+			intermediates.AddCert(c)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   integratedTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return "", "", fmt.Errorf("certificate is not trusted: %w", err)
+	}
+	if err := verifySignature(cert.PublicKey, payload, sig); err != nil {
+		return "", "", err
+	}
+
+	subject, issuer := certificateIdentity(cert)
+	for _, identity := range v.keyless.Identities {
+		if identity.Subject == subject && identity.Issuer == issuer {
+			return subject, issuer, nil
+		}
+	}
+	return "", "", fmt.Errorf("signer %s issued by %s is not trusted", subject, issuer)
+}
+
+// verifyBundle verifies the signed entry timestamp of the signature with the public key of the transparency log, and
+// returns the time the signature was entered into the log.
+func (v *signatureVerifier) verifyBundle(bundleJSON string, payload, sig []byte, cert *x509.Certificate) (time.Time, error) {
+	if bundleJSON == "" {
+		return time.Time{}, fmt.Errorf("keyless signature has no transparency log bundle")
+	}
+	var bundle rekorBundle
+	if err := json.Unmarshal([]byte(bundleJSON), &bundle); err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log bundle: %w", err)
+	}
+	key, ok := v.logKeys[bundle.Payload.LogID]
+	if !ok {
+		return time.Time{}, fmt.Errorf("transparency log %s is not trusted", bundle.Payload.LogID)
+	}
+	canonical, err := json.Marshal(bundle.Payload)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := verifySignature(key, canonical, bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("invalid signed entry timestamp: %w", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry: %w", err)
+	}
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log entry: %w", err)
+	}
+	if entry.Kind != "hashedrekord" {
+		return time.Time{}, fmt.Errorf("unsupported transparency log entry kind %q", entry.Kind)
+	}
+	payloadHash := sha256.Sum256(payload)
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(payloadHash[:]) {
+		return time.Time{}, fmt.Errorf("transparency log entry is not for the signed payload")
+	}
+	if !bytes.Equal(entry.Spec.Signature.Content, sig) {
+		return time.Time{}, fmt.Errorf("transparency log entry is not for the signature")
+	}
+	entryCerts, err := parseCertificates(entry.Spec.Signature.PublicKey.Content)
+	if err != nil || len(entryCerts) == 0 || !entryCerts[0].Equal(cert) {
+		return time.Time{}, fmt.Errorf("transparency log entry is not for the certificate")
+	}
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// certificateIdentity returns the subject alternative name and the OIDC issuer of a short-lived certificate.
+func certificateIdentity(cert *x509.Certificate) (string, string) {
+	var subject, issuer string
+	if len(cert.EmailAddresses) > 0 {
+		subject = cert.EmailAddresses[0]
+	} else if len(cert.URIs) > 0 {
+		subject = cert.URIs[0].String()
+	}
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			var value string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &value, "utf8"); err == nil {
+				return subject, value
+			}
+		case ext.Id.Equal(oidIssuer):
+			issuer = string(ext.Value)
+		}
+	}
+	return subject, issuer
+}
+
+func verifySignature(key crypto.PublicKey, payload, sig []byte) error {
+	hash := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, hash[:], sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, sig) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded public key found in %s", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+func loadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificates %s: %w", path, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificates found in %s", path)
+	}
+	return certs, nil
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
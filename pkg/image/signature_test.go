@@ -0,0 +1,525 @@
+//go:build !windows
+
+package image
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	testSubject = "https://github.com/rancher/system-agent/.github/workflows/release.yml@refs/heads/main"
+	testIssuer  = "https://token.actions.githubusercontent.com"
+)
+
+func TestStageSignature(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-image-signature-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	signingKey := newTestKey(t)
+	otherKey := newTestKey(t)
+	logKey := newTestKey(t)
+	signingKeyFile := writeTestPublicKey(t, tempDir, "signing.pub", signingKey)
+	otherKeyFile := writeTestPublicKey(t, tempDir, "other.pub", otherKey)
+	logKeyFile := writeTestPublicKey(t, tempDir, "rekor.pub", logKey)
+
+	caKey := newTestKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-fulcio"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustRoot := filepath.Join(tempDir, "fulcio.pem")
+	if err := os.WriteFile(trustRoot, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The short-lived certificate has expired by now, but was valid when the signature was entered into the log.
+	issuerExtension, err := asn1.MarshalWithParams(testIssuer, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjectURI, err := url.Parse(testSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(-50 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		URIs:            []*url.URL{subjectURI},
+		ExtraExtensions: []pkix.Extension{{Id: oidIssuerV2, Value: issuerExtension}},
+	}, caCert, signingKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	integratedTime := time.Now().Add(-55 * time.Minute)
+
+	keylessPolicy := &KeylessPolicy{
+		TrustRoot:                 trustRoot,
+		TransparencyLogPublicKeys: []string{logKeyFile},
+		Identities:                []SignerIdentity{{Subject: testSubject, Issuer: testIssuer}},
+	}
+
+	testCases := []struct {
+		Name     string
+		Policies []SignaturePolicy
+		Sign     func(t *testing.T, ref name.Reference, digest v1.Hash)
+		// Index pushes the image as a multi-platform index, which is signed instead of the platform image with SignIndex
+		// and staged by its digest with PinIndex.
+		Index             bool
+		SignIndex         bool
+		PinIndex          bool
+		ExpectError       bool
+		ExpectStaged      bool
+		ExpectVerified    bool
+		ExpectNoSignature bool
+		ExpectSigner      string
+		ExpectIssuer      string
+	}{
+		{
+			Name:     "keyed",
+			Policies: []SignaturePolicy{{Scope: host, PublicKeys: []string{otherKeyFile, signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, digest.String(), nil)
+			},
+			ExpectStaged:   true,
+			ExpectVerified: true,
+			ExpectSigner:   signingKeyFile,
+		},
+		{
+			Name:     "unsigned",
+			Policies: []SignaturePolicy{{Scope: host, PublicKeys: []string{signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+			},
+			ExpectError: true,
+		},
+		{
+			Name:     "untrusted key",
+			Policies: []SignaturePolicy{{Scope: host, PublicKeys: []string{signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, otherKey, digest.String(), nil)
+			},
+			ExpectError: true,
+		},
+		{
+			Name:     "signature of other digest",
+			Policies: []SignaturePolicy{{Scope: host, PublicKeys: []string{signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, "sha256:"+strings.Repeat("0", 64), nil)
+			},
+			ExpectError: true,
+		},
+		{
+			Name:     "untrusted key in warn mode",
+			Policies: []SignaturePolicy{{Scope: host + "/rancher", Mode: SignatureModeWarn, PublicKeys: []string{signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, otherKey, digest.String(), nil)
+			},
+			ExpectStaged: true,
+		},
+		{
+			Name: "most specific scope",
+			Policies: []SignaturePolicy{
+				{Scope: "*", PublicKeys: []string{otherKeyFile}},
+				{Scope: host + "/rancher/installer", PublicKeys: []string{signingKeyFile}},
+				{Scope: host + "/rancher", PublicKeys: []string{otherKeyFile}},
+			},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, digest.String(), nil)
+			},
+			ExpectStaged:   true,
+			ExpectVerified: true,
+			ExpectSigner:   signingKeyFile,
+		},
+		{
+			Name:     "no policy in scope",
+			Policies: []SignaturePolicy{{Scope: host + "/other", PublicKeys: []string{signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+			},
+			ExpectStaged:      true,
+			ExpectNoSignature: true,
+		},
+		{
+			Name:     "multi-platform signed on index",
+			Policies: []SignaturePolicy{{Scope: host, PublicKeys: []string{signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, digest.String(), nil)
+			},
+			Index:          true,
+			SignIndex:      true,
+			ExpectStaged:   true,
+			ExpectVerified: true,
+			ExpectSigner:   signingKeyFile,
+		},
+		{
+			Name:     "multi-platform signed on platform image",
+			Policies: []SignaturePolicy{{Scope: host, PublicKeys: []string{signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, digest.String(), nil)
+			},
+			Index:          true,
+			ExpectStaged:   true,
+			ExpectVerified: true,
+			ExpectSigner:   signingKeyFile,
+		},
+		{
+			Name:     "multi-platform pinned by index",
+			Policies: []SignaturePolicy{{Scope: host, PublicKeys: []string{signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, digest.String(), nil)
+			},
+			Index:          true,
+			SignIndex:      true,
+			PinIndex:       true,
+			ExpectStaged:   true,
+			ExpectVerified: true,
+			ExpectSigner:   signingKeyFile,
+		},
+		{
+			Name:     "multi-platform unsigned",
+			Policies: []SignaturePolicy{{Scope: host, PublicKeys: []string{signingKeyFile}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+			},
+			Index:       true,
+			ExpectError: true,
+		},
+		{
+			Name:     "keyless",
+			Policies: []SignaturePolicy{{Scope: host, Keyless: keylessPolicy}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, digest.String(), func(payload, sig []byte) map[string]string {
+					return map[string]string{
+						cosignCertificateAnnotation: string(certPEM),
+						cosignBundleAnnotation:      testBundle(t, logKey, payload, sig, certPEM, integratedTime),
+					}
+				})
+			},
+			ExpectStaged:   true,
+			ExpectVerified: true,
+			ExpectSigner:   testSubject,
+			ExpectIssuer:   testIssuer,
+		},
+		{
+			Name: "keyless untrusted identity",
+			Policies: []SignaturePolicy{{Scope: host, Keyless: &KeylessPolicy{
+				TrustRoot:                 trustRoot,
+				TransparencyLogPublicKeys: []string{logKeyFile},
+				Identities:                []SignerIdentity{{Subject: "https://github.com/other/repository", Issuer: testIssuer}},
+			}}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, digest.String(), func(payload, sig []byte) map[string]string {
+					return map[string]string{
+						cosignCertificateAnnotation: string(certPEM),
+						cosignBundleAnnotation:      testBundle(t, logKey, payload, sig, certPEM, integratedTime),
+					}
+				})
+			},
+			ExpectError: true,
+		},
+		{
+			Name:     "keyless after certificate expiry",
+			Policies: []SignaturePolicy{{Scope: host, Keyless: keylessPolicy}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, digest.String(), func(payload, sig []byte) map[string]string {
+					return map[string]string{
+						cosignCertificateAnnotation: string(certPEM),
+						cosignBundleAnnotation:      testBundle(t, logKey, payload, sig, certPEM, time.Now()),
+					}
+				})
+			},
+			ExpectError: true,
+		},
+		{
+			Name:     "keyless without bundle",
+			Policies: []SignaturePolicy{{Scope: host, Keyless: keylessPolicy}},
+			Sign: func(t *testing.T, ref name.Reference, digest v1.Hash) {
+				pushSignature(t, ref, digest, signingKey, digest.String(), func(payload, sig []byte) map[string]string {
+					return map[string]string{
+						cosignCertificateAnnotation: string(certPEM),
+					}
+				})
+			},
+			ExpectError: true,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if err := ValidateSignaturePolicies(tc.Policies); err != nil {
+				t.Fatal(err)
+			}
+			// Every test case uses its own image, so that the signatures of one do not apply to another.
+			ref, err := name.ParseReference(host + "/rancher/installer:v" + string(rune('a'+i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			img := newTestImage(t, "#!/bin/sh\necho "+tc.Name+"\n")
+			digest, err := img.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			signedDigest := digest
+			var indexDigest string
+			if tc.Index {
+				index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+					Add: img,
+					Descriptor: v1.Descriptor{
+						Platform: &v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH},
+					},
+				})
+				if err := remote.WriteIndex(ref, index); err != nil {
+					t.Fatal(err)
+				}
+				hash, err := index.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				indexDigest = hash.String()
+				if tc.SignIndex {
+					signedDigest = hash
+				}
+				if tc.PinIndex {
+					ref = ref.Context().Digest(indexDigest)
+				}
+			} else if err := remote.Write(ref, img); err != nil {
+				t.Fatal(err)
+			}
+			tc.Sign(t, ref, signedDigest)
+
+			u := NewUtility(filepath.Join(tempDir, "images"), "", "", filepath.Join(tempDir, "registries.yaml"), Options{SignaturePolicies: tc.Policies})
+			dest := filepath.Join(tempDir, "stage", tc.Name)
+			staged, err := u.Stage(context.Background(), dest, ref.Name())
+			if tc.ExpectError != (err != nil) {
+				t.Fatalf("expected error %t, got %v", tc.ExpectError, err)
+			}
+			if staged.Digest != digest.String() || staged.IndexDigest != indexDigest {
+				t.Errorf("expected digest %s and index digest %q, got %+v", digest, indexDigest, staged)
+			}
+			_, statErr := os.Stat(filepath.Join(dest, "run.sh"))
+			if tc.ExpectStaged != (statErr == nil) {
+				t.Errorf("expected image to be staged %t, got %v", tc.ExpectStaged, statErr)
+			}
+			if tc.ExpectNoSignature {
+				if staged.Signature != nil {
+					t.Errorf("expected no signature verification, got %+v", staged.Signature)
+				}
+				return
+			}
+			if staged.Signature == nil {
+				t.Fatal("expected signature verification")
+			}
+			if staged.Signature.Digest != signedDigest.String() || staged.Signature.Verified != tc.ExpectVerified || staged.Signature.Signer != tc.ExpectSigner || staged.Signature.Issuer != tc.ExpectIssuer {
+				t.Errorf("unexpected signature verification %+v", staged.Signature)
+			}
+			if !tc.ExpectVerified && staged.Signature.Error == "" {
+				t.Error("expected signature verification to record the error")
+			}
+		})
+	}
+}
+
+func TestValidateSignaturePolicies(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-image-signature-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	keyFile := writeTestPublicKey(t, tempDir, "signing.pub", newTestKey(t))
+
+	testCases := []struct {
+		Name     string
+		Policies []SignaturePolicy
+		Error    string
+	}{
+		{
+			Name:     "valid",
+			Policies: []SignaturePolicy{{Scope: "docker.io/rancher", Mode: SignatureModeWarn, PublicKeys: []string{keyFile}}, {Scope: "*", PublicKeys: []string{keyFile}}},
+		},
+		{
+			Name:     "no scope",
+			Policies: []SignaturePolicy{{PublicKeys: []string{keyFile}}},
+			Error:    "no scope",
+		},
+		{
+			Name:     "duplicate scope",
+			Policies: []SignaturePolicy{{Scope: "docker.io", PublicKeys: []string{keyFile}}, {Scope: "index.docker.io/", PublicKeys: []string{keyFile}}},
+			Error:    "duplicate",
+		},
+		{
+			Name:     "invalid mode",
+			Policies: []SignaturePolicy{{Scope: "*", Mode: "audit", PublicKeys: []string{keyFile}}},
+			Error:    "invalid mode",
+		},
+		{
+			Name:     "no keys",
+			Policies: []SignaturePolicy{{Scope: "*"}},
+			Error:    "neither public keys nor keyless",
+		},
+		{
+			Name:     "missing key",
+			Policies: []SignaturePolicy{{Scope: "*", PublicKeys: []string{filepath.Join(tempDir, "missing.pub")}}},
+			Error:    "no such file",
+		},
+		{
+			Name:     "keyless without identities",
+			Policies: []SignaturePolicy{{Scope: "*", Keyless: &KeylessPolicy{TrustRoot: keyFile, TransparencyLogPublicKeys: []string{keyFile}}}},
+			Error:    "no identities",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := ValidateSignaturePolicies(tc.Policies)
+			if tc.Error == "" && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tc.Error != "" && (err == nil || !strings.Contains(err.Error(), tc.Error)) {
+				t.Errorf("expected error containing %q, got %v", tc.Error, err)
+			}
+		})
+	}
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeTestPublicKey(t *testing.T, dir, file string, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, file)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signTest(t *testing.T, key *ecdsa.PrivateKey, payload []byte) []byte {
+	t.Helper()
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+// pushSignature pushes a cosign signature of the payload for signedDigest to the signature tag of the image.
+func pushSignature(t *testing.T, ref name.Reference, digest v1.Hash, key *ecdsa.PrivateKey, signedDigest string, annotate func(payload, sig []byte) map[string]string) {
+	t.Helper()
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"` + ref.Context().Name() + `"},"image":{"docker-manifest-digest":"` + signedDigest + `"},"type":"cosign container image signature"},"optional":null}`)
+	sig := signTest(t, key, payload)
+	annotations := map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)}
+	if annotate != nil {
+		for k, v := range annotate(payload, sig) {
+			annotations[k] = v
+		}
+	}
+	sigImg, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer(payload, types.MediaType("application/vnd.dev.cosign.simplesigning.v1+json")),
+		Annotations: annotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref.Context().Tag(digest.Algorithm+"-"+digest.Hex+".sig"), sigImg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testBundle returns the transparency log bundle of a keyless signature, signed by the key of the log.
+func testBundle(t *testing.T, logKey *ecdsa.PrivateKey, payload, sig, certPEM []byte, integratedTime time.Time) string {
+	t.Helper()
+	var entry hashedRekord
+	entry.Kind = "hashedrekord"
+	payloadHash := sha256.Sum256(payload)
+	entry.Spec.Data.Hash.Algorithm = "sha256"
+	entry.Spec.Data.Hash.Value = hex.EncodeToString(payloadHash[:])
+	entry.Spec.Signature.Content = sig
+	entry.Spec.Signature.PublicKey.Content = certPEM
+	body, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(logKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	logID := sha256.Sum256(der)
+	bundle := rekorBundle{
+		Payload: rekorPayload{
+			Body:           base64.StdEncoding.EncodeToString(body),
+			IntegratedTime: integratedTime.Unix(),
+			LogID:          hex.EncodeToString(logID[:]),
+			LogIndex:       42,
+		},
+	}
+	canonical, err := json.Marshal(bundle.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle.SignedEntryTimestamp = signTest(t, logKey, canonical)
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -1,15 +1,23 @@
 package image
 
 import (
+	"archive/tar"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/rancher/wharfie/pkg/credentialprovider/plugin"
 	"github.com/rancher/wharfie/pkg/registries"
@@ -32,9 +40,54 @@ type Utility struct {
 	imageCredentialProviderConfig string
 	imageCredentialProviderBinDir string
 	agentRegistriesFile           string
+	cache                         *imageCache
+	signaturePolicies             []SignaturePolicy
+	pullAttempts                  int
+	pullBackoff                   time.Duration
+	pullMaxBackoff                time.Duration
+	pullTimeout                   time.Duration
+
+	// prefetching holds the images that are being prefetched, which are closed once they are.
+	prefetchMu  sync.Mutex
+	prefetching map[string]chan struct{}
+}
+
+// Options holds the optional tunables of a Utility. The zero value preserves the historical behavior.
+type Options struct {
+	// CacheDir is the directory that Stage caches the extracted filesystems of images in, keyed by the digest of the
+	// image. Empty disables the cache.
+	CacheDir string
+	// CacheMaxBytes is the size of the cache above which the least recently used images are evicted. Zero does not
+	// limit the size of the cache.
+	CacheMaxBytes int64
+	// CacheHardlink stages the files of cached images as hard links instead of copies, so instructions must not modify
+	// the files of their image. StageCopy copies them regardless.
+	CacheHardlink bool
+	// SignaturePolicies are the policies that the cosign signatures of images are verified with before they are
+	// staged. Images that no policy applies to are not verified.
+	SignaturePolicies []SignaturePolicy
+	// PullAttempts is the number of times staging an image is attempted when pulling it fails. Zero or one does not
+	// retry.
+	PullAttempts int
+	// PullBackoff is the delay before the first retry, which doubles with every retry up to PullMaxBackoff.
+	PullBackoff    time.Duration
+	PullMaxBackoff time.Duration
+	// PullTimeout is the maximum duration of a single attempt to pull and extract an image. Zero does not limit it.
+	PullTimeout time.Duration
 }
 
-func NewUtility(imagesDir, imageCredentialProviderConfig, imageCredentialProviderBinDir, agentRegistriesFile string) *Utility {
+// StagedImage describes an image that was staged.
+type StagedImage struct {
+	// Digest is the digest of the image.
+	Digest string
+	// IndexDigest is the digest of the index of the multi-platform image that the reference resolved to, which is empty
+	// when the image is not multi-platform or its index could not be resolved.
+	IndexDigest string
+	// Signature is the result of verifying the signature of the image, or nil if no signature policy applies to it.
+	Signature *SignatureVerification
+}
+
+func NewUtility(imagesDir, imageCredentialProviderConfig, imageCredentialProviderBinDir, agentRegistriesFile string, options Options) *Utility {
 	var u Utility
 
 	if imagesDir != "" {
@@ -61,68 +114,308 @@ func NewUtility(imagesDir, imageCredentialProviderConfig, imageCredentialProvide
 		u.agentRegistriesFile = defaultAgentRegistriesFile
 	}
 
-	logrus.Debugf("Instantiated new image utility with imagesDir: %s, imageCredentialProviderConfig: %s, imageCredentialProviderBinDir: %s, agentRegistriesFile: %s", u.imagesDir, u.imageCredentialProviderConfig, u.imageCredentialProviderBinDir, u.agentRegistriesFile)
+	if options.CacheDir != "" {
+		u.cache = &imageCache{
+			dir:      options.CacheDir,
+			maxBytes: options.CacheMaxBytes,
+			hardlink: options.CacheHardlink,
+		}
+	}
+
+	u.signaturePolicies = options.SignaturePolicies
+
+	u.pullAttempts = options.PullAttempts
+	if u.pullAttempts < 1 {
+		u.pullAttempts = 1
+	}
+	u.pullBackoff = options.PullBackoff
+	if u.pullBackoff <= 0 {
+		u.pullBackoff = defaultPullBackoff
+	}
+	u.pullMaxBackoff = options.PullMaxBackoff
+	if u.pullMaxBackoff <= 0 {
+		u.pullMaxBackoff = defaultPullMaxBackoff
+	}
+	u.pullTimeout = options.PullTimeout
+
+	logrus.Debugf("Instantiated new image utility with imagesDir: %s, imageCredentialProviderConfig: %s, imageCredentialProviderBinDir: %s, agentRegistriesFile: %s, cacheDir: %s", u.imagesDir, u.imageCredentialProviderConfig, u.imageCredentialProviderBinDir, u.agentRegistriesFile, options.CacheDir)
 
 	return &u
 }
 
-func (u *Utility) Stage(destDir string, imgString string) error {
+// Stage extracts the filesystem of the image to destDir. With a cache, the image is only extracted into the cache the
+// first time it is staged, and copied from the cache to destDir. When a signature policy applies to the image, its
+// signature is verified first, and in enforce mode an image whose signature cannot be verified is not staged. Pulling
+// the image is retried with backoff until the context is done, and a failed pull returns a *PullError.
+func (u *Utility) Stage(ctx context.Context, destDir string, imgString string) (StagedImage, error) {
+	return u.stage(ctx, destDir, imgString, u.cache != nil && u.cache.hardlink)
+}
+
+// StageCopy stages the image like Stage, but always copies the files of a cached image instead of hard linking them, for
+// a destDir whose files are given to another owner, who must not be able to modify the cache through them.
+func (u *Utility) StageCopy(ctx context.Context, destDir string, imgString string) (StagedImage, error) {
+	return u.stage(ctx, destDir, imgString, false)
+}
+
+func (u *Utility) stage(ctx context.Context, destDir string, imgString string, hardlink bool) (StagedImage, error) {
 	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return StagedImage{}, err
+	}
+
+	ref, err := name.ParseReference(imgString)
+	if err != nil {
+		return StagedImage{}, err
+	}
+
+	u.awaitPrefetch(ctx, imgString)
+
+	var staged StagedImage
+	err = u.withRetry(ctx, imgString, func(ctx context.Context) error {
+		img, indexDigest, err := u.pullImage(ctx, imgString, true)
+		if err != nil {
+			return err
+		}
+
+		digest, err := img.Digest()
+		if err != nil {
+			return fmt.Errorf("unable to compute digest of image %s: %w", imgString, err)
+		}
+		staged = StagedImage{Digest: digest.String(), IndexDigest: indexDigest}
+
+		staged.Signature, err = u.verifySignature(ctx, ref, digest, indexDigest)
+		if err != nil {
+			return &permanentError{err: err}
+		}
+
+		if u.cache != nil {
+			return u.cache.stage(img, digest, imgString, destDir, hardlink)
+		}
+		return extractFiles(img, destDir)
+	})
+	return staged, err
+}
+
+// ExtractFile copies the regular file at filePath in the filesystem of the image to w, without extracting the rest of
+// the image. The image is found the same way as by Stage.
+func (u *Utility) ExtractFile(imgString, filePath string, w io.Writer) error {
+	img, err := u.getImage(context.Background(), imgString)
+	if err != nil {
+		return err
+	}
+
+	rc := mutate.Extract(img)
+	defer rc.Close()
+
+	want := cleanImagePath(filePath)
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("file %s not found in image %s", filePath, imgString)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read filesystem of image %s: %w", imgString, err)
+		}
+		if cleanImagePath(header.Name) != want {
+			continue
+		}
+		if header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%s in image %s is not a regular file", filePath, imgString)
+		}
+		_, err = io.Copy(w, tr)
 		return err
 	}
+}
+
+// getImage returns the image from the local image archives in the images directory if it is found there, and from its
+// registry otherwise. The layers of an image from a registry are pulled with the context when they are read.
+func (u *Utility) getImage(ctx context.Context, imgString string) (v1.Image, error) {
+	img, _, err := u.pullImage(ctx, imgString, false)
+	return img, err
+}
 
-	var img v1.Image
+// pullImage returns the image like getImage. If resolveIndex is set, it also returns the digest of the index of the
+// multi-platform image that the reference resolved to, which is empty when the image is not multi-platform or its
+// index could not be resolved.
+func (u *Utility) pullImage(ctx context.Context, imgString string, resolveIndex bool) (v1.Image, string, error) {
 	image, err := name.ParseReference(imgString)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
 	imagesDir, err := filepath.Abs(u.imagesDir)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	i, err := tarfile.FindImage(imagesDir, image)
-	if err != nil && !errors.Is(err, tarfile.ErrNotFound) {
-		return err
+	registry, err := registries.GetPrivateRegistries(u.findRegistriesYaml())
+	if err != nil {
+		return nil, "", err
 	}
-	img = i
 
-	if img == nil {
-		registry, err := registries.GetPrivateRegistries(u.findRegistriesYaml())
+	if _, err := os.Stat(u.imageCredentialProviderConfig); os.IsExist(err) {
+		logrus.Debugf("Image Credential Provider Configuration file %s existed, using plugins from directory %s", u.imageCredentialProviderConfig, u.imageCredentialProviderBinDir)
+		plugins, err := plugin.RegisterCredentialProviderPlugins(u.imageCredentialProviderConfig, u.imageCredentialProviderBinDir)
 		if err != nil {
-			return err
+			return nil, "", err
+		}
+		registry.DefaultKeychain = plugins
+	} else {
+		// The kubelet image credential provider plugin also falls back to checking legacy Docker credentials, so only
+		// explicitly set up the go-containerregistry DefaultKeychain if plugins are not configured.
+		// DefaultKeychain tries to read config from the home dir, and will error if HOME isn't set, so also gate on that.
+		if os.Getenv("HOME") != "" {
+			registry.DefaultKeychain = authn.DefaultKeychain
 		}
+	}
 
-		if _, err := os.Stat(u.imageCredentialProviderConfig); os.IsExist(err) {
-			logrus.Debugf("Image Credential Provider Configuration file %s existed, using plugins from directory %s", u.imageCredentialProviderConfig, u.imageCredentialProviderBinDir)
-			plugins, err := plugin.RegisterCredentialProviderPlugins(u.imageCredentialProviderConfig, u.imageCredentialProviderBinDir)
-			if err != nil {
-				return err
-			}
-			registry.DefaultKeychain = plugins
-		} else {
-			// The kubelet image credential provider plugin also falls back to checking legacy Docker credentials, so only
-			// explicitly set up the go-containerregistry DefaultKeychain if plugins are not configured.
-			// DefaultKeychain tries to read config from the home dir, and will error if HOME isn't set, so also gate on that.
-			if os.Getenv("HOME") != "" {
-				registry.DefaultKeychain = authn.DefaultKeychain
-			}
-		}
-
-		logrus.Infof("Pulling image %s", image.Name())
-		img, err = registry.Image(image,
-			remote.WithPlatform(v1.Platform{
-				Architecture: runtime.GOARCH,
-				OS:           runtime.GOOS,
-			}),
-		)
-		if err != nil {
-			return fmt.Errorf("%v: failed to get image %s", err, image.Name())
+	// The registry is set up before looking for a local image, as the index of an image that is pinned by the digest of
+	// its index is looked up in the registry to find the platform image in the images directory.
+	img, indexDigest, err := findLocalImage(imagesDir, imgString, image, func(index name.Reference, digest v1.Hash) string {
+		return lookupIndexDigest(ctx, registry.Registry, registry.DefaultKeychain, index, digest)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if img != nil {
+		return img, indexDigest, nil
+	}
+
+	endpoints := registryEndpoints(registry.Registry, image)
+	var urls []string
+	for _, endpoint := range endpoints {
+		urls = append(urls, endpoint.url)
+	}
+	logrus.Infof("Pulling image %s from endpoints %s", image.Name(), strings.Join(urls, ", "))
+	img, err = registry.Image(image,
+		remote.WithPlatform(v1.Platform{
+			Architecture: runtime.GOARCH,
+			OS:           runtime.GOOS,
+		}),
+		remote.WithContext(ctx),
+	)
+	if err != nil {
+		return nil, "", newPullError(image.Name(), endpoints, err)
+	}
+	if !resolveIndex {
+		return img, "", nil
+	}
+	return img, resolveIndexDigest(ctx, registry.Registry, registry.DefaultKeychain, image, img), nil
+}
+
+// resolveIndexDigest returns the digest of the index of the multi-platform image that the reference resolves to, if
+// the index holds img. The digest of an image pinned by the digest of its index is the pinned digest, while the index of
+// an image referenced by tag is looked up by lookupIndexDigest.
+func resolveIndexDigest(ctx context.Context, config *registries.Registry, keychain authn.Keychain, ref name.Reference, img v1.Image) string {
+	digest, err := img.Digest()
+	if err != nil {
+		return ""
+	}
+	if pinned, ok := ref.(name.Digest); ok {
+		if pinned.DigestStr() != digest.String() {
+			return pinned.DigestStr()
 		}
+		return ""
+	}
+	return lookupIndexDigest(ctx, config, keychain, ref, digest)
+}
+
+// lookupIndexDigest returns the digest of the index that the reference resolves to in the registry, if it is an index
+// that holds the image with the digest. The index is only looked up in the upstream registry, as its mirrors can only be
+// reached when pulling the image, so it is not looked up for mirrored registries. The registry is connected to with the
+// credentials and TLS configuration that registries.yaml configures for it. Failing to look up the index is only logged.
+func lookupIndexDigest(ctx context.Context, config *registries.Registry, keychain authn.Keychain, ref name.Reference, digest v1.Hash) string {
+	for _, endpoint := range registryEndpoints(config, ref) {
+		if endpoint.mirror {
+			logrus.Debugf("Not resolving the index of image %s, as its registry is mirrored", ref.Name())
+			return ""
+		}
+	}
+	auth, err := registryAuthenticator(config, keychain, ref)
+	if err != nil {
+		logrus.Debugf("Unable to resolve the index of image %s: %v", ref.Name(), err)
+		return ""
+	}
+	transport, err := registryTransport(config, ref)
+	if err != nil {
+		logrus.Debugf("Unable to resolve the index of image %s: %v", ref.Name(), err)
+		return ""
 	}
+	desc, err := remote.Get(ref, remote.WithContext(ctx), remote.WithAuth(auth), remote.WithTransport(transport))
+	if err != nil {
+		logrus.Debugf("Unable to resolve the index of image %s: %v", ref.Name(), err)
+		return ""
+	}
+	if !desc.MediaType.IsIndex() {
+		return ""
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return ""
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		logrus.Debugf("Unable to resolve the index of image %s: %v", ref.Name(), err)
+		return ""
+	}
+	for _, child := range manifest.Manifests {
+		if child.Digest == digest {
+			return desc.Digest.String()
+		}
+	}
+	// The tag was moved to another index since the image was pulled.
+	return ""
+}
+
+// findLocalImage returns the image from the local image archives in the images directory, or nil if it is not found
+// there. The archives are indexed by tag, so an image referenced by digest is only found when the reference has a tag as
+// well, as in repository:tag@sha256:<hex>, and the tagged image in the archives has the digest. As the archives only hold
+// platform images, an image pinned by the digest of a multi-platform index is found when lookupIndex, which returns the
+// digest of the index a reference resolves to if it holds the image with the digest, finds that the pinned index holds
+// the local image. The digest of the pinned index is returned along with the image then.
+func findLocalImage(imagesDir, imgString string, ref name.Reference, lookupIndex func(index name.Reference, digest v1.Hash) string) (v1.Image, string, error) {
+	tag, ok := ref.(name.Tag)
+	digest, pinned := ref.(name.Digest)
+	if pinned {
+		tagged, _, _ := strings.Cut(imgString, "@")
+		if strings.LastIndex(tagged, ":") <= strings.LastIndex(tagged, "/") {
+			return nil, "", nil
+		}
+		var err error
+		if tag, err = name.NewTag(tagged); err != nil {
+			return nil, "", nil
+		}
+	} else if !ok {
+		return nil, "", nil
+	}
+
+	img, err := tarfile.FindImage(imagesDir, tag)
+	if err != nil {
+		if errors.Is(err, tarfile.ErrNotFound) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	if !pinned {
+		return img, "", nil
+	}
+	localDigest, err := img.Digest()
+	if err != nil {
+		return nil, "", err
+	}
+	if localDigest.String() == digest.DigestStr() {
+		return img, "", nil
+	}
+	if lookupIndex(digest, localDigest) == digest.DigestStr() {
+		return img, digest.DigestStr(), nil
+	}
+	logrus.Infof("Local image %s has digest %s instead of %s, pulling image", tag.Name(), localDigest, digest.DigestStr())
+	return nil, "", nil
+}
 
-	return extractFiles(img, destDir)
+// cleanImagePath returns the path of a file in the filesystem of an image the way it is named in a layer tarball.
+func cleanImagePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
 }
 
 func (u *Utility) findRegistriesYaml() string {
@@ -63,6 +63,15 @@ const (
 	ProbePeriodKey = "probe-period-seconds"
 	// PlanKey is the Secret data key for the plan payload.
 	PlanKey = "plan"
+	// InstructionStatusKey is the Secret data key for the status of the last run of the one-time instructions.
+	InstructionStatusKey = "instruction-status"
+	// FileDriftKey is the Secret data key for the json-marshalled report of the last file drift check.
+	FileDriftKey = "file-drift"
+	// FileVerificationKey is the Secret data key for the json-marshalled files that did not match their digest.
+	FileVerificationKey = "file-verification"
+	// HookFailureKey is the Secret data key for the json-marshalled failure of the pre-apply hook that aborted applying
+	// the plan.
+	HookFailureKey = "hook-failure"
 
 	enqueueAfterDuration  = "5s"
 	cooldownTimerDuration = "30s"
@@ -202,9 +211,6 @@ func (w *watcher) start(ctx context.Context, strictVerify bool) {
 		}
 
 		if planData, ok := secret.Data[PlanKey]; ok {
-			logrus.Tracef("[K8s] Byte data: %v", planData)
-			logrus.Tracef("[K8s] Plan string was %s", string(planData))
-
 			var probeStatuses map[string]planapi.ProbeStatus
 			// retrieve existing probe statuses from the secret if they exist
 			if rawProbeStatusByteData, ok := secret.Data[ProbeStatusesKey]; ok {
@@ -220,6 +226,11 @@ func (w *watcher) start(ctx context.Context, strictVerify bool) {
 			if err != nil {
 				return secret, err
 			}
+			if logrus.IsLevelEnabled(logrus.TraceLevel) {
+				// The plan is logged with its sensitive values masked rather than as the raw secret data.
+				redactedPlan, _ := json.Marshal(w.applyinator.RedactPlan(cp).Plan)
+				logrus.Tracef("[K8s] Plan was %s", redactedPlan)
+			}
 			logrus.Tracef("[K8s] Calculated checksum to be %s", cp.Checksum)
 
 			// currentPlanState is non-empty when Rancher supports plan-state.
@@ -347,23 +358,54 @@ func (w *watcher) start(ctx context.Context, strictVerify bool) {
 			}
 
 			input := applyinator.ApplyInput{
-				CalculatedPlan:             cp,
-				ReconcileFiles:             needsApplied,
-				ExistingOneTimeOutput:      output,
-				ExistingPeriodicOutput:     periodicOutput,
-				RunOneTimeInstructions:     needsApplied,
-				OneTimeInstructionAttempts: planAttempt,
+				CalculatedPlan:                   cp,
+				ReconcileFiles:                   needsApplied,
+				ExistingOneTimeOutput:            output,
+				ExistingPeriodicOutput:           periodicOutput,
+				RunOneTimeInstructions:           needsApplied,
+				OneTimeInstructionAttempts:       planAttempt,
+				ExistingOneTimeInstructionStatus: secret.Data[InstructionStatusKey],
+				ExistingFileDrift:                secret.Data[FileDriftKey],
 			}
 
 			applyOutput, err := w.applyinator.Apply(ctx, input)
-			if err != nil {
+			var digestMismatch *applyinator.DigestMismatchError
+			var hookErr *applyinator.HookError
+			if errors.As(err, &digestMismatch) {
+				// Files that do not match their digest fail the plan without writing any file, and are reported in the secret.
+				logrus.Errorf("[K8s] error encountered when running apply: %v", err)
+				applyOutput.PeriodicOutput = periodicOutput
+				if marshalled, err := json.Marshal(digestMismatch.Files); err != nil {
+					logrus.Errorf("error marshalling file digest mismatches: %v", err)
+				} else {
+					secret.Data[FileVerificationKey] = marshalled
+				}
+			} else if errors.As(err, &hookErr) {
+				// A failing pre-apply hook fails the plan before anything is applied, and is reported in the secret.
+				logrus.Errorf("[K8s] error encountered when running apply: %v", err)
+				applyOutput.PeriodicOutput = periodicOutput
+				if marshalled, err := json.Marshal(hookErr); err != nil {
+					logrus.Errorf("error marshalling hook failure: %v", err)
+				} else {
+					secret.Data[HookFailureKey] = marshalled
+				}
+			} else if err != nil {
 				return secret, fmt.Errorf("error encountered when running apply: %w", err)
+			} else if needsApplied {
+				delete(secret.Data, FileVerificationKey)
+				delete(secret.Data, HookFailureKey)
 			}
 
 			output = applyOutput.OneTimeOutput
 			periodicOutput = applyOutput.PeriodicOutput
 
 			secret.Data[AppliedPeriodicOutputKey] = periodicOutput
+			if len(applyOutput.OneTimeInstructionStatus) > 0 {
+				secret.Data[InstructionStatusKey] = applyOutput.OneTimeInstructionStatus
+			}
+			if len(applyOutput.FileDrift) > 0 {
+				secret.Data[FileDriftKey] = applyOutput.FileDrift
+			}
 
 			if (needsApplied && !applyOutput.OneTimeApplySucceeded) || (!needsApplied && wasFailedPlan) {
 				logrus.Debugf("[K8s] one-time-instructions with checksum (%s) either failed or was already failed (and cooldown period hasn't elapsed) during application", cp.Checksum)
@@ -464,6 +506,10 @@ func (w *watcher) updateSecret(core corecontrollers.Interface, secret *corev1.Se
 							latestSecret.Data[LastApplyTimeKey] = secret.Data[LastApplyTimeKey]
 							latestSecret.Data[AppliedChecksumKey] = secret.Data[AppliedChecksumKey]
 							latestSecret.Data[AppliedOutputKey] = secret.Data[AppliedOutputKey]
+							latestSecret.Data[InstructionStatusKey] = secret.Data[InstructionStatusKey]
+							latestSecret.Data[FileDriftKey] = secret.Data[FileDriftKey]
+							latestSecret.Data[FileVerificationKey] = secret.Data[FileVerificationKey]
+							latestSecret.Data[HookFailureKey] = secret.Data[HookFailureKey]
 							latestSecret.Data[planapi.PlanStateKey] = secret.Data[planapi.PlanStateKey]
 							latestSecret.Data[planapi.PlanRevisionKey] = secret.Data[planapi.PlanRevisionKey]
 							secret = latestSecret
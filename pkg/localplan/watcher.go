@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"os"
 	"path/filepath"
@@ -29,10 +30,16 @@ func WatchFiles(ctx context.Context, applyinator applyinator.Applyinator, bases
 
 // stdout and stderr are both base64, gzipped
 type NodePlanPosition struct {
-	AppliedChecksum string                         `json:"appliedChecksum,omitempty"`
-	Output          []byte                         `json:"output,omitempty"`
-	ProbeStatus     map[string]planapi.ProbeStatus `json:"probeStatus,omitempty"`
-	PeriodicOutput  []byte                         `json:"periodicOutput,omitempty"`
+	AppliedChecksum   string                         `json:"appliedChecksum,omitempty"`
+	Output            []byte                         `json:"output,omitempty"`
+	ProbeStatus       map[string]planapi.ProbeStatus `json:"probeStatus,omitempty"`
+	PeriodicOutput    []byte                         `json:"periodicOutput,omitempty"`
+	InstructionStatus []byte                         `json:"instructionStatus,omitempty"`
+	FileDrift         []byte                         `json:"fileDrift,omitempty"`
+	// FileVerification is the json-marshalled files that did not match their digest when the plan was last applied.
+	FileVerification []byte `json:"fileVerification,omitempty"`
+	// HookFailure is the json-marshalled failure of the pre-apply hook that aborted applying the plan.
+	HookFailure []byte `json:"hookFailure,omitempty"`
 }
 
 type watcher struct {
@@ -108,7 +115,9 @@ func (w *watcher) listFilesIn(ctx context.Context, base string, _ bool) error {
 			continue
 		}
 
-		logrus.Debugf("[local] Plan from file %s was: %v", path, cp.Plan)
+		if logrus.IsLevelEnabled(logrus.DebugLevel) {
+			logrus.Debugf("[local] Plan from file %s was: %v", path, w.applyinator.RedactPlan(cp).Plan)
+		}
 
 		posFile := positionFileName(path)
 		posData, err := readPositionFile(posFile)
@@ -133,15 +142,40 @@ func (w *watcher) listFilesIn(ctx context.Context, base string, _ bool) error {
 		}
 
 		input := applyinator.ApplyInput{
-			CalculatedPlan:         cp,
-			ReconcileFiles:         needsApplied,
-			ExistingOneTimeOutput:  planPosition.Output,
-			ExistingPeriodicOutput: planPosition.PeriodicOutput,
-			RunOneTimeInstructions: needsApplied,
+			CalculatedPlan:                   cp,
+			ReconcileFiles:                   needsApplied,
+			ExistingOneTimeOutput:            planPosition.Output,
+			ExistingPeriodicOutput:           planPosition.PeriodicOutput,
+			ExistingOneTimeInstructionStatus: planPosition.InstructionStatus,
+			ExistingFileDrift:                planPosition.FileDrift,
+			RunOneTimeInstructions:           needsApplied,
 		}
 
 		applyOutput, err := w.applyinator.Apply(ctx, input)
-		if err != nil {
+		var digestMismatch *applyinator.DigestMismatchError
+		var hookErr *applyinator.HookError
+		if errors.As(err, &digestMismatch) {
+			// Files that do not match their digest fail the plan without writing any file, and are reported in the
+			// position file.
+			logrus.Errorf("[local] Error when applying node plan from file: %s: %v", path, err)
+			if marshalled, err := json.Marshal(digestMismatch.Files); err != nil {
+				logrus.Errorf("error marshalling file digest mismatches: %v", err)
+			} else {
+				planPosition.FileVerification = marshalled
+				writePosition(path, posFile, posData, planPosition)
+			}
+			continue
+		} else if errors.As(err, &hookErr) {
+			// A failing pre-apply hook fails the plan before anything is applied, and is reported in the position file.
+			logrus.Errorf("[local] Error when applying node plan from file: %s: %v", path, err)
+			if marshalled, err := json.Marshal(hookErr); err != nil {
+				logrus.Errorf("error marshalling hook failure: %v", err)
+			} else {
+				planPosition.HookFailure = marshalled
+				writePosition(path, posFile, posData, planPosition)
+			}
+			continue
+		} else if err != nil {
 			logrus.Errorf("[local] Error when applying node plan from file: %s: %v", path, err)
 			continue
 		}
@@ -179,23 +213,30 @@ func (w *watcher) listFilesIn(ctx context.Context, base string, _ bool) error {
 		npp.Output = applyOutput.OneTimeOutput
 		npp.ProbeStatus = probeStatuses
 		npp.PeriodicOutput = applyOutput.PeriodicOutput
+		npp.InstructionStatus = applyOutput.OneTimeInstructionStatus
+		npp.FileDrift = applyOutput.FileDrift
 
-		newPPData, err := json.Marshal(npp)
-		if err != nil {
-			logrus.Errorf("error marshalling new plan position data: %v", err)
-		}
-
-		if !bytes.Equal(newPPData, posData) {
-			logrus.Debugf("[local] Writing position data")
-			if err := os.WriteFile(posFile, newPPData, 0600); err != nil {
-				logrus.Errorf("[local] Error encountered when writing position file for %s: %v", path, err)
-			}
-		}
+		writePosition(path, posFile, posData, npp)
 	}
 
 	return nil
 }
 
+// writePosition writes the position of the plan at path to its position file, unless it is unchanged from posData.
+func writePosition(path, posFile string, posData []byte, npp NodePlanPosition) {
+	newPPData, err := json.Marshal(npp)
+	if err != nil {
+		logrus.Errorf("error marshalling new plan position data: %v", err)
+	}
+
+	if !bytes.Equal(newPPData, posData) {
+		logrus.Debugf("[local] Writing position data")
+		if err := applyinator.WriteFileAtomic(posFile, -1, -1, 0600, newPPData); err != nil {
+			logrus.Errorf("[local] Error encountered when writing position file for %s: %v", path, err)
+		}
+	}
+}
+
 func (w *watcher) parsePlan(file string) (applyinator.CalculatedPlan, error) {
 	f, err := os.Open(file)
 	if err != nil {
@@ -208,18 +249,29 @@ func (w *watcher) parsePlan(file string) (applyinator.CalculatedPlan, error) {
 		return applyinator.CalculatedPlan{}, err
 	}
 
-	logrus.Tracef("[local] Byte data: %v", b)
-
-	logrus.Debugf("[local] Plan string was %s", string(b))
-
 	cp, err := applyinator.CalculatePlan(b)
 	if err != nil {
 		return cp, err
 	}
 
+	if logrus.IsLevelEnabled(logrus.DebugLevel) {
+		// The plan is logged with its sensitive values masked rather than as the raw file.
+		redactedPlan, _ := json.Marshal(w.applyinator.RedactPlan(cp).Plan)
+		logrus.Debugf("[local] Plan was %s", redactedPlan)
+	}
+
 	return cp, nil
 }
 
+// ReadPosition reads the position of the plan at planPath, returning an empty position if it has not been applied yet.
+func ReadPosition(planPath string) (NodePlanPosition, error) {
+	posData, err := readPositionFile(positionFileName(planPath))
+	if err != nil {
+		return NodePlanPosition{}, err
+	}
+	return parsePositionData(posData)
+}
+
 func positionFileName(planPath string) string {
 	return strings.TrimSuffix(planPath, planSuffix) + positionSuffix
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+
+	"github.com/rancher/system-agent/pkg/applyinator"
+	"github.com/rancher/system-agent/pkg/config"
+	"github.com/rancher/system-agent/pkg/localplan"
+)
+
+func preview(c *cli.Context) error {
+	planFile := c.Args().First()
+	if planFile == "" {
+		return fmt.Errorf("plan file not specified")
+	}
+
+	cf, err := loadAgentConfig()
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		logrus.Debugf("Agent configuration file %s does not exist, using defaults", configFilePath())
+		cf = config.AgentConfig{}
+	}
+
+	rawPlan, err := os.ReadFile(planFile)
+	if err != nil {
+		return fmt.Errorf("unable to read plan file: %w", err)
+	}
+	cp, err := applyinator.CalculatePlan(rawPlan)
+	if err != nil {
+		return err
+	}
+
+	// A local plan that was already applied has a position file next to it, which determines whether the one-time
+	// instructions would run again and which periodic instructions are due.
+	position, err := localplan.ReadPosition(planFile)
+	if err != nil {
+		return fmt.Errorf("unable to read position of plan file: %w", err)
+	}
+	needsApplied := position.AppliedChecksum != cp.Checksum
+
+	output, err := newApplyinator(cf).Apply(context.Background(), applyinator.ApplyInput{
+		CalculatedPlan:         cp,
+		ReconcileFiles:         needsApplied,
+		RunOneTimeInstructions: needsApplied,
+		ExistingOneTimeOutput:  position.Output,
+		ExistingPeriodicOutput: position.PeriodicOutput,
+		DryRun:                 true,
+	})
+	if err != nil {
+		return err
+	}
+
+	printPreview(c.App.Writer, output.Preview)
+	return nil
+}
+
+// printPreview writes a human-readable report of the preview.
+func printPreview(w io.Writer, preview *applyinator.PlanPreview) {
+	fmt.Fprintf(w, "Plan %s\n", preview.Checksum)
+
+	fmt.Fprintf(w, "\nFiles:\n")
+	if !preview.ReconcileFiles {
+		fmt.Fprintf(w, "  (not reconciled, the plan has already been applied)\n")
+	} else if len(preview.Files) == 0 {
+		fmt.Fprintf(w, "  (none)\n")
+	}
+	for _, file := range preview.Files {
+		fmt.Fprintf(w, "  %-12s %s", file.Change, file.Path)
+		if len(file.Details) > 0 {
+			fmt.Fprintf(w, " (%s)", strings.Join(file.Details, ", "))
+		}
+		fmt.Fprintln(w)
+		if file.Diff != "" {
+			for _, line := range strings.Split(strings.TrimSuffix(file.Diff, "\n"), "\n") {
+				fmt.Fprintf(w, "      %s\n", line)
+			}
+		}
+	}
+
+	printInstructionPreviews(w, "One-time instructions", preview.OneTimeInstructions)
+	printInstructionPreviews(w, "Periodic instructions", preview.PeriodicInstructions)
+}
+
+func printInstructionPreviews(w io.Writer, title string, instructions []applyinator.InstructionPreview) {
+	fmt.Fprintf(w, "\n%s:\n", title)
+	if len(instructions) == 0 {
+		fmt.Fprintf(w, "  (none)\n")
+	}
+	for _, instruction := range instructions {
+		action := "skip"
+		if instruction.Run {
+			action = "run"
+		}
+		name := instruction.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", instruction.Index)
+		}
+		fmt.Fprintf(w, "  %-12s %s", action, name)
+		if instruction.Image != "" {
+			fmt.Fprintf(w, " image=%s", instruction.Image)
+		}
+		if instruction.Command != "" {
+			fmt.Fprintf(w, " command=%s", strings.Join(append([]string{instruction.Command}, instruction.Args...), " "))
+		}
+		if instruction.Reason != "" {
+			fmt.Fprintf(w, " (%s)", instruction.Reason)
+		}
+		fmt.Fprintln(w)
+	}
+}